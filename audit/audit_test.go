@@ -0,0 +1,120 @@
+package audit
+
+import (
+	"auth-api/logging"
+	"auth-api/models"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// recordingSink keeps every event it is handed.
+type recordingSink struct {
+	events []models.AuditEvent
+	err    error
+}
+
+func (s *recordingSink) Write(ctx context.Context, event models.AuditEvent) error {
+	s.events = append(s.events, event)
+	return s.err
+}
+
+// TestRecordFansOut checks every sink receives the event, even after another
+// sink fails, and that a missing timestamp is filled in.
+func TestRecordFansOut(t *testing.T) {
+	failing := &recordingSink{err: errors.New("disk full")}
+	working := &recordingSink{}
+	SetSinks(failing, working)
+	t.Cleanup(func() {
+		SetSinks()
+	})
+
+	Record(context.Background(), models.AuditEvent{Type: EventLogin, Outcome: OutcomeSuccess})
+
+	if len(failing.events) != 1 || len(working.events) != 1 {
+		t.Fatalf("expected both sinks to get the event, got %d and %d", len(failing.events), len(working.events))
+	}
+	if working.events[0].Time.IsZero() {
+		t.Fatalf("expected Record to timestamp the event")
+	}
+}
+
+// TestFromRequest verifies request metadata is copied onto the event.
+func TestFromRequest(t *testing.T) {
+	req := httptest.NewRequest("POST", "/login", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.Header.Set("User-Agent", "curl/8")
+	req = req.WithContext(logging.WithRequestID(req.Context(), "req-9"))
+
+	event := FromRequest(req, EventLogin)
+	if event.IP_addr != "10.0.0.1" || event.UserAgent != "curl/8" || event.RequestID != "req-9" || event.Type != EventLogin {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+}
+
+// TestFileSink ensures events are appended as JSON lines.
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sinks, err := NewSinks("file", path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sink := sinks[0].(*FileSink)
+	t.Cleanup(func() {
+		sink.Close()
+	})
+
+	for _, actor := range []string{"alice", "bob"} {
+		if err := sink.Write(context.Background(), models.AuditEvent{Type: EventRegister, Actor: actor}); err != nil {
+			t.Fatalf("unexpected write error: %v", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open audit file: %v", err)
+	}
+	defer f.Close()
+	var actors []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event models.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("expected json line, got %q", scanner.Text())
+		}
+		actors = append(actors, event.Actor)
+	}
+	if len(actors) != 2 || actors[0] != "alice" || actors[1] != "bob" {
+		t.Fatalf("unexpected audit lines: %v", actors)
+	}
+}
+
+// TestNewSinks covers the db sink and unknown sink names.
+func TestNewSinks(t *testing.T) {
+	sinks, err := NewSinks("db, ", "")
+	if err != nil || len(sinks) != 1 {
+		t.Fatalf("expected a single db sink, got %v (%v)", sinks, err)
+	}
+
+	original := insertAuditEvent
+	var inserted models.AuditEvent
+	insertAuditEvent = func(ctx context.Context, event models.AuditEvent) error {
+		inserted = event
+		return nil
+	}
+	t.Cleanup(func() {
+		insertAuditEvent = original
+	})
+	if err := sinks[0].Write(context.Background(), models.AuditEvent{Actor: "alice"}); err != nil || inserted.Actor != "alice" {
+		t.Fatalf("expected db sink to insert the event, got %+v (%v)", inserted, err)
+	}
+
+	if _, err := NewSinks("db,kafka", ""); err == nil {
+		t.Fatalf("expected unknown sink to be rejected")
+	}
+}
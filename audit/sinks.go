@@ -0,0 +1,52 @@
+package audit
+
+import (
+	"auth-api/db"
+	"auth-api/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// insertAuditEvent is swapped out in tests.
+var insertAuditEvent = db.InsertAuditEvent
+
+// DBSink appends events to the audit_events table.
+type DBSink struct{}
+
+func (DBSink) Write(ctx context.Context, event models.AuditEvent) error {
+	return insertAuditEvent(ctx, event)
+}
+
+// FileSink appends events to a file, one JSON object per line.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileSink opens (or creates) path for appending.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %w", err)
+	}
+	return &FileSink{file: f}, nil
+}
+
+func (s *FileSink) Write(ctx context.Context, event models.AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the underlying file.
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
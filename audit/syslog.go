@@ -0,0 +1,36 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"auth-api/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+)
+
+// SyslogSink sends events to the local syslog daemon under the auth facility.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to the local syslog daemon.
+func NewSyslogSink() (*SyslogSink, error) {
+	w, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, "auth-api")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	return &SyslogSink{writer: w}, nil
+}
+
+func (s *SyslogSink) Write(ctx context.Context, event models.AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.Outcome == OutcomeFailure {
+		return s.writer.Warning(string(line))
+	}
+	return s.writer.Info(string(line))
+}
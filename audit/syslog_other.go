@@ -0,0 +1,21 @@
+//go:build windows || plan9
+
+package audit
+
+import (
+	"auth-api/models"
+	"context"
+	"errors"
+)
+
+// SyslogSink is unavailable on this platform.
+type SyslogSink struct{}
+
+// NewSyslogSink always fails here: log/syslog does not exist on this platform.
+func NewSyslogSink() (*SyslogSink, error) {
+	return nil, errors.New("syslog audit sink is not supported on this platform")
+}
+
+func (s *SyslogSink) Write(ctx context.Context, event models.AuditEvent) error {
+	return errors.New("syslog audit sink is not supported on this platform")
+}
@@ -2,8 +2,14 @@ package auth
 
 import (
 	"auth-api/db"
+	"auth-api/metrics"
+	"auth-api/pkg/verifier"
+	"auth-api/tracing"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -12,66 +18,129 @@ import (
 var (
 	// getSecretKey wraps db.GetSecretKey so tests can replace the dependency.
 	getSecretKey = db.GetSecretKey
+	// insertSecretKey wraps db.InsertSecretKey for the same reason.
+	insertSecretKey = db.InsertSecretKey
 )
 
+// ErrInvalidToken wraps every rejection of the token itself (bad signature,
+// expired, malformed...), as opposed to failures loading the secret. The
+// underlying jwt error stays reachable with errors.Is.
+var ErrInvalidToken = verifier.ErrInvalidToken
+
+// AccessTokenTTL is how long an access token stays valid unless its
+// audience's profile says otherwise.
+const AccessTokenTTL = 900 * time.Second
+
+// secretKeyBytes is the amount of randomness in a generated signing secret.
+// 32 bytes matches the HS256 output size.
+const secretKeyBytes = 32
+
 // JWTResponse represents the payload returned to clients after
 // successfully authenticating.
 type JWTResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in,omitempty"` // access token lifetime in seconds
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
-// CreateJWT creates a signed JWT for the provided username using the secret key
-// stored in the database.
-func CreateJWT(username string) (JWTResponse, error) {
-
-	new_token := jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
-		jwt.RegisteredClaims{
-			Issuer:    getHostname(),
-			Subject:   username,
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(900 * time.Second)),
-		})
-	secretKey, err := getSecretKey()
-	if err != nil {
-		return JWTResponse{}, err
-	}
-	tokenString, err := new_token.SignedString(secretKey)
-	if err != nil {
-		fmt.Printf("error generating JWT for %v: %v\n", username, err)
-	}
-	return JWTResponse{AccessToken: tokenString, TokenType: "bearer"}, err
+// Claims are the claims we read back from access tokens: the registered ones
+// plus the id of the session the token belongs to. Profile claims aren't
+// parsed, they are for the audience's service.
+type Claims struct {
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
 }
 
-// ValidateJWT verifies the provided token string against the stored secret key.
-func ValidateJWT(JWT string) error {
+// CreateJWT creates a signed JWT for the provided username and session using
+// the keypair loaded by LoadSigningKey, or else the secret key stored in the
+// database. The token profile of audience ("" for
+// the default one) sets its lifetime and extra claims.
+func CreateJWT(ctx context.Context, username, sessionID, audience string) (_ JWTResponse, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "auth.CreateJWT")
+	defer func() { tracing.End(span, err) }()
 
-	claims := &jwt.RegisteredClaims{}
-	secretKey, err := getSecretKey()
+	profile, err := ProfileFor(audience)
 	if err != nil {
-		return err
+		return JWTResponse{}, err
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	for name, value := range profile.Claims {
+		claims[name] = value
 	}
-	keyFunc := func(token *jwt.Token) (any, error) {
-		return secretKey, nil
+	claims["iss"] = tokenIssuer()
+	claims["sub"] = username
+	claims["aud"] = profile.Audience
+	claims["iat"] = jwt.NewNumericDate(now)
+	claims["exp"] = jwt.NewNumericDate(now.Add(profile.TTL))
+	if sessionID != "" {
+		claims["sid"] = sessionID
 	}
 
-	token, err := jwt.ParseWithClaims(JWT, claims, keyFunc)
+	var tokenString string
+	if key := signingKey; key != nil {
+		new_token := jwt.NewWithClaims(key.method, claims)
+		new_token.Header["kid"] = key.kid
+		tokenString, err = new_token.SignedString(key.private)
+	} else {
+		new_token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		var secretKey []byte
+		secretKey, err = getSecretKey(ctx)
+		if err != nil {
+			return JWTResponse{}, err
+		}
+		tokenString, err = new_token.SignedString(secretKey)
+	}
 	if err != nil {
-		err = fmt.Errorf("error: failed to parse token string: %w", err)
-		return err
+		return JWTResponse{}, fmt.Errorf("error generating JWT for %v: %w", username, err)
 	}
+	metrics.Tokens.WithLabelValues(metrics.TokenIssued).Inc()
+	return JWTResponse{AccessToken: tokenString, TokenType: "bearer", ExpiresIn: int(profile.TTL.Seconds())}, nil
+}
+
+// ValidateJWT verifies the provided token string against the stored secret
+// key, with the checks of the validator set by SetValidator (by default: HS256,
+// issued by us for config.TokenAudience).
+func ValidateJWT(ctx context.Context, JWT string) error {
+	_, err := ParseJWT(ctx, JWT)
+	return err
+}
+
+// ParseJWT verifies the token like ValidateJWT and hands back its claims.
+func ParseJWT(ctx context.Context, JWT string) (*Claims, error) {
+	return validator.Parse(ctx, JWT)
+}
 
-	if !token.Valid {
-		return fmt.Errorf("token is invalid")
+// GenerateSecretKey returns a new cryptographically random signing secret,
+// hex encoded so it fits the TEXT column of the secrets table.
+func GenerateSecretKey() (string, error) {
+	buf := make([]byte, secretKeyBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate secret key: %w", err)
 	}
-	return nil
+	return hex.EncodeToString(buf), nil
 }
 
-func getHostname() string {
-	host, err := os.Hostname()
+// EnsureSecretKey checks that a usable signing secret is stored. When the
+// secret is missing and generate is true, a fresh one is created and saved,
+// otherwise the missing secret is reported as an error.
+func EnsureSecretKey(ctx context.Context, generate bool) error {
+	secretKey, err := getSecretKey(ctx)
+	if err == nil {
+		if len(secretKey) == 0 {
+			return fmt.Errorf("stored secret key is empty")
+		}
+		return nil
+	}
+	if !errors.Is(err, db.ErrSecretKeyNotFound) || !generate {
+		return err
+	}
+
+	newKey, err := GenerateSecretKey()
 	if err != nil {
-		host = "auth api"
+		return err
 	}
-	return host
+	return insertSecretKey(ctx, newKey)
 }
@@ -1,18 +1,30 @@
 package auth
 
 import (
+	"auth-api/config"
+	"auth-api/db"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // TestCreateJWTSuccess ensures that CreateJWT returns a signed token and the
 // expected metadata when the secret key lookup succeeds.
 func TestCreateJWTSuccess(t *testing.T) {
 	originalGetSecretKey := getSecretKey
-	getSecretKey = func() ([]byte, error) {
+	getSecretKey = func(ctx context.Context) ([]byte, error) {
 		return []byte("secret"), nil
 	}
 	t.Cleanup(func() {
@@ -20,7 +32,7 @@ func TestCreateJWTSuccess(t *testing.T) {
 	})
 
 	// Generate a token for a known user and validate the response contract.
-	resp, err := CreateJWT("alice")
+	resp, err := CreateJWT(context.Background(), "alice", "session-1", "")
 	if err != nil {
 		t.Fatalf("CreateJWT returned unexpected error: %v", err)
 	}
@@ -32,22 +44,25 @@ func TestCreateJWTSuccess(t *testing.T) {
 	}
 
 	// Independently parse the JWT to ensure the claims were encoded correctly.
-	token, err := jwt.ParseWithClaims(resp.AccessToken, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
+	token, err := jwt.ParseWithClaims(resp.AccessToken, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		return []byte("secret"), nil
 	})
 	if err != nil {
 		t.Fatalf("failed to parse generated token: %v", err)
 	}
-	claims, ok := token.Claims.(*jwt.RegisteredClaims)
+	claims, ok := token.Claims.(*Claims)
 	if !ok {
 		t.Fatalf("unexpected claim type: %T", token.Claims)
 	}
 	if claims.Subject != "alice" {
 		t.Errorf("expected subject 'alice', got %s", claims.Subject)
 	}
+	if claims.SessionID != "session-1" {
+		t.Errorf("expected session id 'session-1', got %s", claims.SessionID)
+	}
 
-	if claims.Issuer != getHostname() {
-		t.Errorf("expected issuer '%s', got %s", getHostname(), claims.Issuer)
+	if claims.Issuer != "auth-api" {
+		t.Errorf("expected issuer 'auth-api', got %s", claims.Issuer)
 	}
 	if claims.ExpiresAt == nil || time.Until(claims.ExpiresAt.Time) > 16*time.Minute || time.Until(claims.ExpiresAt.Time) < 14*time.Minute {
 		t.Errorf("expected expiry about 15 minutes from now, got %v", claims.ExpiresAt)
@@ -58,14 +73,14 @@ func TestCreateJWTSuccess(t *testing.T) {
 // the signing secret cannot be retrieved.
 func TestCreateJWTSecretKeyError(t *testing.T) {
 	originalGetSecretKey := getSecretKey
-	getSecretKey = func() ([]byte, error) {
+	getSecretKey = func(ctx context.Context) ([]byte, error) {
 		return nil, errors.New("boom")
 	}
 	t.Cleanup(func() {
 		getSecretKey = originalGetSecretKey
 	})
 
-	_, err := CreateJWT("alice")
+	_, err := CreateJWT(context.Background(), "alice", "session-1", "")
 	if err == nil {
 		t.Fatalf("expected error when secret key retrieval fails")
 	}
@@ -75,28 +90,39 @@ func TestCreateJWTSecretKeyError(t *testing.T) {
 // malformed tokens fail.
 func TestValidateJWT(t *testing.T) {
 	originalGetSecretKey := getSecretKey
-	getSecretKey = func() ([]byte, error) {
+	getSecretKey = func(ctx context.Context) ([]byte, error) {
 		return []byte("secret"), nil
 	}
 	t.Cleanup(func() {
 		getSecretKey = originalGetSecretKey
 	})
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Subject:  "alice",
-		Issuer:   "SCDP",
-		IssuedAt: jwt.NewNumericDate(time.Now()),
-	})
-	tokenString, err := token.SignedString([]byte("secret"))
-	if err != nil {
-		t.Fatalf("failed to sign token: %v", err)
+	sign := func(issuer, audience string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+			Subject:   "alice",
+			Issuer:    issuer,
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		})
+		tokenString, err := token.SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		return tokenString
 	}
 
-	if err := ValidateJWT(tokenString); err != nil {
+	if err := ValidateJWT(context.Background(), sign(tokenIssuer(), config.TokenAudience)); err != nil {
 		t.Fatalf("expected token to be valid, got error: %v", err)
 	}
+	if err := ValidateJWT(context.Background(), sign(tokenIssuer(), "billing")); !errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		t.Fatalf("expected wrong audience to be rejected, got %v", err)
+	}
+	if err := ValidateJWT(context.Background(), sign("SCDP", config.TokenAudience)); !errors.Is(err, jwt.ErrTokenInvalidIssuer) {
+		t.Fatalf("expected wrong issuer to be rejected, got %v", err)
+	}
 
-	if err := ValidateJWT("not-a-token"); err == nil {
+	if err := ValidateJWT(context.Background(), "not-a-token"); err == nil {
 		t.Fatalf("expected validation error for malformed token")
 	}
 }
@@ -105,14 +131,537 @@ func TestValidateJWT(t *testing.T) {
 // returned to the caller.
 func TestValidateJWTSecretKeyError(t *testing.T) {
 	originalGetSecretKey := getSecretKey
-	getSecretKey = func() ([]byte, error) {
+	getSecretKey = func(ctx context.Context) ([]byte, error) {
 		return nil, errors.New("boom")
 	}
 	t.Cleanup(func() {
 		getSecretKey = originalGetSecretKey
 	})
 
-	if err := ValidateJWT("anything"); err == nil {
+	if err := ValidateJWT(context.Background(), "anything"); err == nil {
 		t.Fatalf("expected error when secret key lookup fails")
 	}
 }
+
+// TestGenerateSecretKey checks generated secrets have the expected length and
+// are not repeated.
+func TestGenerateSecretKey(t *testing.T) {
+	first, err := GenerateSecretKey()
+	if err != nil {
+		t.Fatalf("GenerateSecretKey returned unexpected error: %v", err)
+	}
+	second, err := GenerateSecretKey()
+	if err != nil {
+		t.Fatalf("GenerateSecretKey returned unexpected error: %v", err)
+	}
+	if len(first) != secretKeyBytes*2 {
+		t.Fatalf("expected %d hex characters, got %d", secretKeyBytes*2, len(first))
+	}
+	if first == second {
+		t.Fatalf("expected distinct secrets")
+	}
+}
+
+// TestEnsureSecretKey covers the present, missing and bootstrap paths of the
+// startup secret check.
+func TestEnsureSecretKey(t *testing.T) {
+	originalGetSecretKey := getSecretKey
+	originalInsertSecretKey := insertSecretKey
+	t.Cleanup(func() {
+		getSecretKey = originalGetSecretKey
+		insertSecretKey = originalInsertSecretKey
+	})
+
+	var inserted string
+	insertSecretKey = func(ctx context.Context, secretKey string) error {
+		inserted = secretKey
+		return nil
+	}
+
+	getSecretKey = func(ctx context.Context) ([]byte, error) {
+		return []byte("secret"), nil
+	}
+	if err := EnsureSecretKey(context.Background(), true); err != nil {
+		t.Fatalf("expected existing secret to pass, got %v", err)
+	}
+	if inserted != "" {
+		t.Fatalf("expected no insert when a secret exists")
+	}
+
+	getSecretKey = func(ctx context.Context) ([]byte, error) {
+		return nil, db.ErrSecretKeyNotFound
+	}
+	if err := EnsureSecretKey(context.Background(), false); !errors.Is(err, db.ErrSecretKeyNotFound) {
+		t.Fatalf("expected missing secret error, got %v", err)
+	}
+	if err := EnsureSecretKey(context.Background(), true); err != nil {
+		t.Fatalf("expected bootstrap to succeed, got %v", err)
+	}
+	if len(inserted) != secretKeyBytes*2 {
+		t.Fatalf("expected generated secret to be inserted, got %q", inserted)
+	}
+
+	getSecretKey = func(ctx context.Context) ([]byte, error) {
+		return nil, errors.New("db down")
+	}
+	inserted = ""
+	if err := EnsureSecretKey(context.Background(), true); err == nil || inserted != "" {
+		t.Fatalf("expected lookup failure to propagate without inserting")
+	}
+}
+
+// TestDummyPasswordHash checks the stand-in hash used for unknown users is a
+// real bcrypt hash at the configured cost that rejects passwords.
+func TestDummyPasswordHash(t *testing.T) {
+	hash := DummyPasswordHash()
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		t.Fatalf("dummy hash is not a bcrypt hash: %v", err)
+	}
+	if want := passwordHasher.(BcryptHasher).Cost; cost != want {
+		t.Fatalf("expected cost %d, got %d", want, cost)
+	}
+	if DummyPasswordHash() != hash {
+		t.Fatalf("expected the dummy hash to be computed once")
+	}
+	if err := ComparePassword(context.Background(), hash, ""); err == nil {
+		t.Fatalf("dummy hash should not match anything")
+	}
+}
+
+// failingHasher is a bcrypt hasher that can't hash.
+type failingHasher struct{ BcryptHasher }
+
+func (failingHasher) Hash(string) (string, error) { return "", errors.New("no") }
+
+// TestDummyPasswordHashFailure checks a hasher that can't build the dummy
+// hash is refused at startup, and that a failed build never panics.
+func TestDummyPasswordHashFailure(t *testing.T) {
+	original, originalDummy := passwordHasher, DummyPasswordHash()
+	t.Cleanup(func() {
+		passwordHasher, dummyHash = original, originalDummy
+	})
+
+	if err := SetPasswordHasher(failingHasher{}); err == nil {
+		t.Fatalf("expected SetPasswordHasher to fail")
+	}
+	if passwordHasher != original || DummyPasswordHash() != originalDummy {
+		t.Fatalf("expected a failed SetPasswordHasher to change nothing")
+	}
+
+	passwordHasher, dummyHash = failingHasher{}, ""
+	if hash := DummyPasswordHash(); hash != "" {
+		t.Fatalf("expected no dummy hash, got %q", hash)
+	}
+}
+
+// TestArgon2idHasher covers hashing, verification and the encoded format.
+func TestArgon2idHasher(t *testing.T) {
+	h := Argon2idHasher{MemoryKiB: 1024, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+	encoded, err := h.Hash("password123")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$") || !h.Identifies(encoded) {
+		t.Fatalf("unexpected encoding: %s", encoded)
+	}
+	if ok, err := h.Verify(encoded, "password123"); !ok || err != nil {
+		t.Fatalf("expected password to verify, got %v (%v)", ok, err)
+	}
+	if ok, err := h.Verify(encoded, "wrong"); ok || err != nil {
+		t.Fatalf("expected wrong password to fail cleanly, got %v (%v)", ok, err)
+	}
+	if _, err := h.Verify("$argon2id$v=19$garbage", "password123"); err == nil {
+		t.Fatalf("expected malformed hash to error")
+	}
+
+	stronger := h
+	stronger.Time = 2
+	if h.NeedsRehash(encoded) || !stronger.NeedsRehash(encoded) {
+		t.Fatalf("expected only the stronger hasher to want a rehash")
+	}
+}
+
+// TestPasswordUpgradePath checks hashes from an old algorithm still verify
+// and are flagged for rehash once the configured hasher changes.
+func TestPasswordUpgradePath(t *testing.T) {
+	original := passwordHasher
+	t.Cleanup(func() {
+		SetPasswordHasher(original)
+	})
+	setHasher := func(h PasswordHasher) {
+		t.Helper()
+		if err := SetPasswordHasher(h); err != nil {
+			t.Fatalf("SetPasswordHasher returned error: %v", err)
+		}
+	}
+
+	setHasher(BcryptHasher{Cost: bcrypt.MinCost})
+	oldHash, err := HashPassword(context.Background(), "password123")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if NeedsRehash(oldHash) {
+		t.Fatalf("fresh hash should not need a rehash")
+	}
+
+	setHasher(BcryptHasher{Cost: bcrypt.MinCost + 1})
+	if !NeedsRehash(oldHash) {
+		t.Fatalf("expected a cost increase to trigger a rehash")
+	}
+
+	setHasher(Argon2idHasher{MemoryKiB: 1024, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32})
+	if err := ComparePassword(context.Background(), oldHash, "password123"); err != nil {
+		t.Fatalf("expected the bcrypt hash to keep verifying, got %v", err)
+	}
+	if err := ComparePassword(context.Background(), oldHash, "wrong"); !errors.Is(err, ErrPasswordMismatch) {
+		t.Fatalf("expected ErrPasswordMismatch, got %v", err)
+	}
+	if !NeedsRehash(oldHash) {
+		t.Fatalf("expected a bcrypt hash to need a rehash under argon2id")
+	}
+	newHash, err := HashPassword(context.Background(), "password123")
+	if err != nil || NeedsRehash(newHash) {
+		t.Fatalf("expected a current argon2id hash, got %q (%v)", newHash, err)
+	}
+	if strings.HasPrefix(DummyPasswordHash(), "$2") {
+		t.Fatalf("expected the dummy hash to follow the configured hasher")
+	}
+
+	if err := ComparePassword(context.Background(), "plaintext?", "plaintext?"); err == nil || errors.Is(err, ErrPasswordMismatch) {
+		t.Fatalf("expected an unrecognized format error, got %v", err)
+	}
+	if _, err := NewPasswordHasher("md5"); err == nil {
+		t.Fatalf("expected unknown algorithm to be rejected")
+	}
+}
+
+// TestNewPasswordHasherArgon2Limits checks out of range argon2id settings are
+// an error up front rather than a panic on the first hash.
+func TestNewPasswordHasherArgon2Limits(t *testing.T) {
+	memory, iterations, threads := config.Argon2MemoryKiB, config.Argon2Time, config.Argon2Threads
+	t.Cleanup(func() {
+		config.Argon2MemoryKiB, config.Argon2Time, config.Argon2Threads = memory, iterations, threads
+	})
+
+	cases := []struct {
+		name                        string
+		memory, iterations, threads int
+	}{
+		{"zero threads", 1024, 1, 0},
+		{"threads wrap to zero", 4096, 1, 256},
+		{"negative threads", 1024, 1, -1},
+		{"zero time", 1024, 0, 1},
+		{"memory below 8 per thread", 16, 1, 4},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config.Argon2MemoryKiB, config.Argon2Time, config.Argon2Threads = tc.memory, tc.iterations, tc.threads
+			if _, err := NewPasswordHasher("argon2id"); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+
+	config.Argon2MemoryKiB, config.Argon2Time, config.Argon2Threads = 1024, 1, 1
+	if _, err := NewPasswordHasher("argon2id"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, _, _, err := decodeArgon2id("$argon2id$v=19$m=1024,t=1,p=0$c2FsdA$a2V5"); err == nil {
+		t.Fatalf("expected p=0 in a stored hash to be rejected")
+	}
+}
+
+// TestRefreshToken checks a refresh token carries its session id and hashes
+// deterministically.
+func TestRefreshToken(t *testing.T) {
+	sessionID, err := NewSessionID()
+	if err != nil {
+		t.Fatalf("NewSessionID returned error: %v", err)
+	}
+	token, err := NewRefreshToken(sessionID)
+	if err != nil {
+		t.Fatalf("NewRefreshToken returned error: %v", err)
+	}
+	other, _ := NewRefreshToken(sessionID)
+	if token == other {
+		t.Fatalf("expected refresh tokens to differ")
+	}
+
+	got, ok := SessionIDFromRefreshToken(token)
+	if !ok || got != sessionID {
+		t.Fatalf("expected session id %s, got %s (%v)", sessionID, got, ok)
+	}
+	for _, bad := range []string{"", "nodot", ".secret", "id."} {
+		if _, ok := SessionIDFromRefreshToken(bad); ok {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+
+	if HashToken(token) != HashToken(token) || HashToken(token) == HashToken(other) || strings.Contains(HashToken(token), sessionID) {
+		t.Fatalf("unexpected token hashes")
+	}
+}
+
+// TestCheckRefreshToken tells the current, the spent and a made up refresh
+// token apart.
+func TestCheckRefreshToken(t *testing.T) {
+	current, previous := HashToken("s1.current"), HashToken("s1.spent")
+	cases := []struct {
+		token    string
+		previous string
+		want     RefreshTokenUse
+	}{
+		{"s1.current", previous, RefreshCurrent},
+		{"s1.spent", previous, RefreshReused},
+		{"s1.garbage", previous, RefreshUnknown},
+		{"s1.spent", "", RefreshUnknown},
+	}
+	for _, tc := range cases {
+		if got := CheckRefreshToken(tc.token, current, tc.previous); got != tc.want {
+			t.Errorf("CheckRefreshToken(%q) = %v, want %v", tc.token, got, tc.want)
+		}
+	}
+}
+
+// TestTokenProfiles checks a profile's audience, lifetime and claims end up
+// in the token, and that unknown audiences are refused.
+func TestTokenProfiles(t *testing.T) {
+	originalGetSecretKey := getSecretKey
+	getSecretKey = func(ctx context.Context) ([]byte, error) {
+		return []byte("secret"), nil
+	}
+	profiles, err := ParseTokenProfiles(`[{"audience":"billing","ttl":"5m","claims":{"tenant":"acme","roles":["reader"]}}]`, "auth-api")
+	if err != nil {
+		t.Fatalf("ParseTokenProfiles returned error: %v", err)
+	}
+	if len(profiles) != 2 || profiles[1].Audience != "auth-api" || profiles[1].TTL != AccessTokenTTL {
+		t.Fatalf("expected the default audience to be added, got %+v", profiles)
+	}
+	SetTokenProfiles(profiles...)
+	t.Cleanup(func() {
+		getSecretKey = originalGetSecretKey
+		SetTokenProfiles(TokenProfile{Audience: config.TokenAudience, TTL: AccessTokenTTL})
+	})
+
+	resp, err := CreateJWT(context.Background(), "alice", "s1", "billing")
+	if err != nil {
+		t.Fatalf("CreateJWT returned error: %v", err)
+	}
+	if resp.ExpiresIn != 300 {
+		t.Fatalf("expected a 5 minute token, got %d seconds", resp.ExpiresIn)
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(resp.AccessToken, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte("secret"), nil
+	}, jwt.WithAudience("billing"))
+	if err != nil {
+		t.Fatalf("failed to parse generated token: %v", err)
+	}
+	if claims["tenant"] != "acme" || claims["sid"] != "s1" {
+		t.Fatalf("unexpected claims: %v", claims)
+	}
+	// a billing token is no good for this API
+	if err := ValidateJWT(context.Background(), resp.AccessToken); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected a billing token to be rejected here, got %v", err)
+	}
+
+	if _, err := CreateJWT(context.Background(), "alice", "s1", "nope"); !errors.Is(err, ErrUnknownAudience) {
+		t.Fatalf("expected ErrUnknownAudience, got %v", err)
+	}
+	for _, bad := range []string{`{`, `[{"ttl":"5m"}]`, `[{"audience":"a","ttl":"soon"}]`, `[{"audience":"a","claims":{"sub":"root"}}]`} {
+		if _, err := ParseTokenProfiles(bad, "auth-api"); err == nil {
+			t.Fatalf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+// TestValidator checks each kind of rejection comes back as its typed error.
+func TestValidator(t *testing.T) {
+	key := []byte("secret")
+	v := &Validator{
+		Algorithms:     []string{"HS256"},
+		Issuer:         "us",
+		Audience:       "api",
+		Leeway:         time.Minute,
+		MaxAge:         time.Hour,
+		RequiredClaims: []string{"sub", "exp", "iat"},
+		Key: func(ctx context.Context) ([]byte, error) {
+			return key, nil
+		},
+	}
+	now := time.Now()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{"iss": "us", "aud": "api", "sub": "alice", "sid": "s1", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()}
+	}
+	sign := func(method jwt.SigningMethod, signKey any, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(signKey)
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		return token
+	}
+	with := func(name string, value any) jwt.MapClaims {
+		claims := valid()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	claims, err := v.Parse(context.Background(), sign(jwt.SigningMethodHS256, key, valid()))
+	if err != nil || claims.Subject != "alice" || claims.SessionID != "s1" {
+		t.Fatalf("expected a valid token, got %+v, %v", claims, err)
+	}
+	// inside the leeway still passes
+	if _, err := v.Parse(context.Background(), sign(jwt.SigningMethodHS256, key, with("exp", now.Add(-30*time.Second).Unix()))); err != nil {
+		t.Fatalf("expected leeway to cover 30s of skew, got %v", err)
+	}
+
+	cases := map[string]struct {
+		token string
+		want  error
+	}{
+		"expired":       {sign(jwt.SigningMethodHS256, key, with("exp", now.Add(-2*time.Minute).Unix())), ErrTokenExpired},
+		"too old":       {sign(jwt.SigningMethodHS256, key, with("iat", now.Add(-2*time.Hour).Unix())), ErrTokenExpired},
+		"not yet valid": {sign(jwt.SigningMethodHS256, key, with("nbf", now.Add(time.Hour).Unix())), ErrTokenNotYetValid},
+		"bad signature": {sign(jwt.SigningMethodHS256, []byte("other"), valid()), ErrTokenSignature},
+		"wrong alg":     {sign(jwt.SigningMethodHS512, key, valid()), ErrTokenSignature},
+		"alg none":      {sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid()), ErrTokenSignature},
+		"audience":      {sign(jwt.SigningMethodHS256, key, with("aud", "billing")), ErrTokenAudience},
+		"issuer":        {sign(jwt.SigningMethodHS256, key, with("iss", "them")), ErrTokenIssuer},
+		"missing sub":   {sign(jwt.SigningMethodHS256, key, with("sub", nil)), ErrTokenMissingClaim},
+		"garbage":       {"not-a-token", ErrTokenMalformed},
+	}
+	for name, tc := range cases {
+		_, err := v.Parse(context.Background(), tc.token)
+		if !errors.Is(err, tc.want) || !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("%s: expected %v, got %v", name, tc.want, err)
+		}
+	}
+}
+
+// TestSigningKeypair checks tokens are signed with a loaded keypair, carry
+// its published kid and validate without the shared secret.
+func TestSigningKeypair(t *testing.T) {
+	pemKey, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("GenerateSigningKey returned error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(path, pemKey, 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	originalGetSecretKey := getSecretKey
+	getSecretKey = func(ctx context.Context) ([]byte, error) {
+		return []byte("secret"), nil
+	}
+	t.Cleanup(func() {
+		getSecretKey = originalGetSecretKey
+		signingKey = nil
+		SetValidator(NewValidator())
+	})
+	if len(PublicKeys().Keys) != 0 {
+		t.Fatalf("expected no public keys without a keypair")
+	}
+	if err := LoadSigningKey(path); err != nil {
+		t.Fatalf("LoadSigningKey returned error: %v", err)
+	}
+	SetValidator(NewValidator())
+
+	resp, err := CreateJWT(context.Background(), "alice", "s1", "")
+	if err != nil {
+		t.Fatalf("CreateJWT returned error: %v", err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(resp.AccessToken, jwt.MapClaims{})
+	if err != nil {
+		t.Fatalf("failed to read token header: %v", err)
+	}
+	keys := PublicKeys().Keys
+	if len(keys) != 1 || token.Header["alg"] != "ES256" || token.Header["kid"] != keys[0].Kid || keys[0].Kty != "EC" {
+		t.Fatalf("unexpected header %v for key set %+v", token.Header, keys)
+	}
+	if _, err := ParseJWT(context.Background(), resp.AccessToken); err != nil {
+		t.Fatalf("expected our keypair token to validate, got %v", err)
+	}
+
+	// the secret no longer mints tokens we accept
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": tokenIssuer(), "aud": config.TokenAudience, "sub": "alice", "iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	if _, err := ParseJWT(context.Background(), forged); !errors.Is(err, ErrTokenSignature) {
+		t.Fatalf("expected an HS256 token to be refused, got %v", err)
+	}
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(p384)
+	if err != nil {
+		t.Fatalf("failed to encode key: %v", err)
+	}
+	for name, data := range map[string][]byte{
+		"not pem": []byte("nope"),
+		"p-384":   pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+	} {
+		if _, err := parseSigningKey(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// TestValidateUsername checks the username format rules.
+func TestValidateUsername(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"alice":                 true,
+		"a.l_i-ce9":             true,
+		"7ce":                   true,
+		"":                      false,
+		"al":                    false,
+		strings.Repeat("a", 33): false,
+		"_alice":                false,
+		"alice smith":           false,
+		"alice@example":         false,
+	} {
+		err := ValidateUsername(name)
+		if ok && err != nil {
+			t.Fatalf("%q: expected valid, got %v", name, err)
+		}
+		if !ok && !errors.Is(err, ErrInvalidUsername) {
+			t.Fatalf("%q: expected ErrInvalidUsername, got %v", name, err)
+		}
+	}
+}
+
+// TestNormalizeUsername checks normalization and the look-alike rules that
+// back the reserved names.
+func TestNormalizeUsername(t *testing.T) {
+	for in, want := range map[string]string{
+		" Alice\t":  "alice",
+		"ＡＬＩＣＥ":     "alice",
+		"Straße":    "straße", // as lower() has it, see NormalizeUsername
+		"bob.smith": "bob.smith",
+	} {
+		if got := NormalizeUsername(in); got != want {
+			t.Fatalf("NormalizeUsername(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	if UsernameSkeleton("a1ice") != UsernameSkeleton("alice") || UsernameSkeleton("rnallory") != UsernameSkeleton("mallory") {
+		t.Fatalf("expected look-alikes to share a skeleton")
+	}
+	for _, name := range []string{"admin", "adm1n", "r00t"} {
+		if err := ValidateUsername(name); !errors.Is(err, ErrInvalidUsername) {
+			t.Fatalf("%q: expected a reserved name, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minRSABits is the smallest RSA signing key we accept.
+const minRSABits = 2048
+
+// keypair is an asymmetric key access tokens are signed with instead of the
+// shared secret. Its public half is published as a JWK set, so other
+// services can verify tokens without being able to mint them.
+type keypair struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  JSONWebKey
+}
+
+// signingKey is set by LoadSigningKey at startup. nil means HS256 with the
+// stored secret.
+var signingKey *keypair
+
+// JSONWebKey is the public half of a signing key (RFC 7517), RSA or EC.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is the document served at /.well-known/jwks.json.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// LoadSigningKey reads a PEM private key, P-256 EC (ES256) or RSA of at
+// least 2048 bits (RS256), and signs access tokens with it from now on.
+// Call SetValidator(NewValidator()) afterwards so our own checks expect it.
+func LoadSigningKey(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read signing key: %w", err)
+	}
+	key, err := parseSigningKey(data)
+	if err != nil {
+		return err
+	}
+	signingKey = key
+	return nil
+}
+
+// GenerateSigningKey returns a new P-256 private key, PKCS #8 PEM encoded,
+// for LoadSigningKey.
+func GenerateSigningKey() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode signing key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// PublicKeys returns the key set other services verify our tokens with. It
+// is empty while tokens are signed with the shared secret.
+func PublicKeys() JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	if signingKey != nil {
+		set.Keys = append(set.Keys, signingKey.public)
+	}
+	return set
+}
+
+func parseSigningKey(data []byte) (*keypair, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing key is not PEM encoded")
+	}
+	var parsed any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+
+	key := &keypair{}
+	switch k := parsed.(type) {
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported curve %s, want P-256", k.Curve.Params().Name)
+		}
+		key.method, key.private = jwt.SigningMethodES256, k
+		key.public = JSONWebKey{Kty: "EC", Crv: "P-256", X: b64(k.X.FillBytes(make([]byte, 32))), Y: b64(k.Y.FillBytes(make([]byte, 32)))}
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("rsa signing key has %d bits, want at least %d", k.N.BitLen(), minRSABits)
+		}
+		key.method, key.private = jwt.SigningMethodRS256, k
+		key.public = JSONWebKey{Kty: "RSA", N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", parsed)
+	}
+
+	key.kid = thumbprint(key.public)
+	key.public.Kid, key.public.Use, key.public.Alg = key.kid, "sig", key.method.Alg()
+	return key, nil
+}
+
+// thumbprint is the RFC 7638 SHA-256 thumbprint of jwk: a kid that only
+// changes with the key.
+func thumbprint(jwk JSONWebKey) string {
+	// the required members only, in lexicographic order
+	var members string
+	switch jwk.Kty {
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, jwk.E, jwk.Kty, jwk.N)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return b64(sum[:])
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"auth-api/config"
+	"auth-api/metrics"
+	"auth-api/tracing"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrPasswordMismatch is returned by ComparePassword for a wrong password.
+var ErrPasswordMismatch = errors.New("password does not match")
+
+// PasswordHasher hashes and verifies passwords with one algorithm. Stored
+// hashes are self-describing (algorithm and parameters are encoded in the
+// string) so any hasher can tell whether it produced a given hash.
+type PasswordHasher interface {
+	// Name identifies the algorithm, e.g. "bcrypt" or "argon2id".
+	Name() string
+	// Hash returns the encoded hash of password.
+	Hash(password string) (string, error)
+	// Verify reports whether password matches the encoded hash.
+	Verify(encoded, password string) (bool, error)
+	// Identifies reports whether encoded was made by this algorithm.
+	Identifies(encoded string) bool
+	// NeedsRehash reports whether encoded (made by this algorithm) uses
+	// weaker parameters than the hasher is currently configured with.
+	NeedsRehash(encoded string) bool
+}
+
+// BcryptHasher hashes with bcrypt at Cost. Its hashes look like $2a$10$...
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Name() string { return "bcrypt" }
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+func (h BcryptHasher) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h BcryptHasher) Identifies(encoded string) bool {
+	_, err := bcrypt.Cost([]byte(encoded))
+	return err == nil
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < h.Cost
+}
+
+// Argon2idHasher hashes with argon2id, encoding results in the PHC string
+// format: $argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<key>
+type Argon2idHasher struct {
+	MemoryKiB uint32
+	Time      uint32
+	Threads   uint8
+	SaltLen   uint32
+	KeyLen    uint32
+}
+
+const argon2idPrefix = "$argon2id$"
+
+func (h Argon2idHasher) Name() string { return "argon2id" }
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.MemoryKiB, h.Threads, h.KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, h.MemoryKiB, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h Argon2idHasher) Verify(encoded, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.MemoryKiB, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h Argon2idHasher) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, argon2idPrefix)
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, _, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.MemoryKiB < h.MemoryKiB || params.Time < h.Time ||
+		params.Threads < h.Threads || uint32(len(key)) < h.KeyLen
+}
+
+// decodeArgon2id splits a PHC encoded argon2id hash into its parts.
+func decodeArgon2id(encoded string) (params Argon2idHasher, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.MemoryKiB, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+	if params.Time < 1 || params.Threads < 1 {
+		// argon2.IDKey panics on these
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2id key: %w", err)
+	}
+	return params, salt, key, nil
+}
+
+// NewPasswordHasher builds the hasher named by algorithm ("bcrypt" or
+// "argon2id") with its parameters taken from config.
+func NewPasswordHasher(algorithm string) (PasswordHasher, error) {
+	switch algorithm {
+	case "bcrypt", "":
+		return BcryptHasher{Cost: max(bcrypt.MinCost, min(config.BcryptCost, bcrypt.MaxCost))}, nil
+	case "argon2id":
+		// checked before narrowing: 256 threads would wrap to 0
+		switch {
+		case config.Argon2Threads < 1 || config.Argon2Threads > math.MaxUint8:
+			return nil, fmt.Errorf("ARGON2_THREADS must be 1 to %d, got %d", math.MaxUint8, config.Argon2Threads)
+		case config.Argon2Time < 1 || int64(config.Argon2Time) > math.MaxUint32:
+			return nil, fmt.Errorf("ARGON2_TIME must be at least 1, got %d", config.Argon2Time)
+		case config.Argon2MemoryKiB < 8*config.Argon2Threads || int64(config.Argon2MemoryKiB) > math.MaxUint32:
+			return nil, fmt.Errorf("ARGON2_MEMORY_KIB must be at least 8 per thread (%d), got %d",
+				8*config.Argon2Threads, config.Argon2MemoryKiB)
+		}
+		return Argon2idHasher{
+			MemoryKiB: uint32(config.Argon2MemoryKiB),
+			Time:      uint32(config.Argon2Time),
+			Threads:   uint8(config.Argon2Threads),
+			SaltLen:   16,
+			KeyLen:    32,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown password hasher %q", algorithm)
+}
+
+var (
+	// passwordHasher hashes new passwords. Replace with SetPasswordHasher.
+	passwordHasher, _ = NewPasswordHasher("bcrypt")
+
+	dummyHashMu sync.Mutex
+	dummyHash   string
+)
+
+// SetPasswordHasher changes the algorithm used for new hashes. Existing
+// hashes of any known algorithm keep verifying, and get upgraded on login
+// (see NeedsRehash). It also builds the unknown-user hash DummyPasswordHash
+// returns, so a hasher that can't hash fails here and not at a login. Call
+// it during startup, before serving.
+func SetPasswordHasher(h PasswordHasher) error {
+	hashed, err := newDummyHash(h)
+	if err != nil {
+		return err
+	}
+	dummyHashMu.Lock()
+	defer dummyHashMu.Unlock()
+	passwordHasher = h
+	dummyHash = hashed
+	return nil
+}
+
+// hasherFor finds the hasher that can verify encoded, preferring the
+// configured one so its parameters are used for rehash checks.
+func hasherFor(encoded string) (PasswordHasher, error) {
+	for _, h := range []PasswordHasher{passwordHasher, BcryptHasher{}, Argon2idHasher{}} {
+		if h.Identifies(encoded) {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("unrecognized password hash format")
+}
+
+// DummyPasswordHash returns a valid hash from the configured hasher that
+// matches no real password. Comparing against it when a user doesn't exist
+// makes unknown usernames cost the same time as wrong passwords.
+// SetPasswordHasher builds it; without that call the default hasher's is
+// built on first use. It never fails a request: should that build fail, the
+// error is logged and "" returned, which matches nothing either.
+func DummyPasswordHash() string {
+	dummyHashMu.Lock()
+	defer dummyHashMu.Unlock()
+	if dummyHash == "" {
+		hashed, err := newDummyHash(passwordHasher)
+		if err != nil {
+			slog.Error("no dummy password hash, unknown usernames now fail faster than wrong passwords", "error", err)
+			return ""
+		}
+		dummyHash = hashed
+	}
+	return dummyHash
+}
+
+// newDummyHash hashes a random password with h. The input only needs to be
+// unguessable, not remembered, and rand.Text stays well within bcrypt's 72
+// bytes.
+func newDummyHash(h PasswordHasher) (string, error) {
+	hashed, err := h.Hash(rand.Text())
+	if err != nil {
+		return "", fmt.Errorf("failed to build dummy password hash: %w", err)
+	}
+	return hashed, nil
+}
+
+// HashPassword hashes a password for storage with the configured hasher.
+func HashPassword(ctx context.Context, password string) (_ string, err error) {
+	hasher := passwordHasher
+	_, span := tracing.Tracer.Start(ctx, "password.Hash")
+	span.SetAttributes(attribute.String("password.algorithm", hasher.Name()))
+	defer func() { tracing.End(span, err) }()
+	defer metrics.ObservePasswordHash(hasher.Name(), metrics.PasswordHash, time.Now())
+
+	return hasher.Hash(password)
+}
+
+// ComparePassword checks a password against a stored hash of any known
+// algorithm. A nil error means they match; a wrong password is
+// ErrPasswordMismatch.
+func ComparePassword(ctx context.Context, encoded, password string) (err error) {
+	_, span := tracing.Tracer.Start(ctx, "password.Verify")
+	defer func() {
+		// a wrong password is an expected outcome, not a span error
+		span.SetAttributes(attribute.Bool("password.match", err == nil))
+		if err != nil && !errors.Is(err, ErrPasswordMismatch) {
+			tracing.End(span, err)
+			return
+		}
+		span.End()
+	}()
+
+	hasher, err := hasherFor(encoded)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.String("password.algorithm", hasher.Name()))
+	defer metrics.ObservePasswordHash(hasher.Name(), metrics.PasswordVerify, time.Now())
+
+	ok, err := hasher.Verify(encoded, password)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// NeedsRehash reports whether a stored hash should be replaced, because it
+// was made by a different algorithm than the configured one or with weaker
+// parameters. Only call it after the password verified, then store
+// HashPassword of the plaintext.
+func NeedsRehash(encoded string) bool {
+	if !passwordHasher.Identifies(encoded) {
+		return true
+	}
+	return passwordHasher.NeedsRehash(encoded)
+}
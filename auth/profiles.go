@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"auth-api/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrUnknownAudience is returned when a token is requested for an audience
+// with no profile.
+var ErrUnknownAudience = errors.New("unknown audience")
+
+// TokenProfile describes the access tokens issued for one audience: how long
+// they live and which extra claims (roles, tenant...) they carry.
+type TokenProfile struct {
+	Audience string
+	TTL      time.Duration
+	Claims   map[string]any
+}
+
+// reservedClaims are set by CreateJWT and can't come from a profile.
+var reservedClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true, "jti": true, "sid": true,
+}
+
+var (
+	profilesMu    sync.RWMutex
+	tokenProfiles = map[string]TokenProfile{
+		config.TokenAudience: {Audience: config.TokenAudience, TTL: AccessTokenTTL},
+	}
+)
+
+// ParseTokenProfiles reads the TOKEN_PROFILES JSON. The default audience
+// always gets a profile, with AccessTokenTTL and no extra claims unless the
+// JSON says otherwise.
+func ParseTokenProfiles(raw, defaultAudience string) ([]TokenProfile, error) {
+	var entries []struct {
+		Audience string         `json:"audience"`
+		TTL      string         `json:"ttl"`
+		Claims   map[string]any `json:"claims"`
+	}
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+			return nil, fmt.Errorf("invalid token profiles: %w", err)
+		}
+	}
+
+	profiles := []TokenProfile{}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Audience == "" {
+			return nil, fmt.Errorf("invalid token profiles: audience required")
+		}
+		if seen[entry.Audience] {
+			return nil, fmt.Errorf("invalid token profiles: duplicate audience %q", entry.Audience)
+		}
+		seen[entry.Audience] = true
+
+		profile := TokenProfile{Audience: entry.Audience, TTL: AccessTokenTTL, Claims: entry.Claims}
+		if entry.TTL != "" {
+			ttl, err := time.ParseDuration(entry.TTL)
+			if err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("invalid token profiles: bad ttl %q for %q", entry.TTL, entry.Audience)
+			}
+			profile.TTL = ttl
+		}
+		for name := range entry.Claims {
+			if reservedClaims[name] {
+				return nil, fmt.Errorf("invalid token profiles: claim %q of %q is reserved", name, entry.Audience)
+			}
+		}
+		profiles = append(profiles, profile)
+	}
+	if !seen[defaultAudience] {
+		profiles = append(profiles, TokenProfile{Audience: defaultAudience, TTL: AccessTokenTTL})
+	}
+	return profiles, nil
+}
+
+// SetTokenProfiles replaces the profiles CreateJWT issues tokens with.
+func SetTokenProfiles(profiles ...TokenProfile) {
+	byAudience := make(map[string]TokenProfile, len(profiles))
+	for _, profile := range profiles {
+		byAudience[profile.Audience] = profile
+	}
+	profilesMu.Lock()
+	tokenProfiles = byAudience
+	profilesMu.Unlock()
+}
+
+// ProfileFor returns the profile of audience, "" meaning config.TokenAudience.
+func ProfileFor(audience string) (TokenProfile, error) {
+	if audience == "" {
+		audience = config.TokenAudience
+	}
+	profilesMu.RLock()
+	profile, ok := tokenProfiles[audience]
+	profilesMu.RUnlock()
+	if !ok {
+		return TokenProfile{}, fmt.Errorf("%w: %q", ErrUnknownAudience, audience)
+	}
+	return profile, nil
+}
+
+// tokenIssuer is the iss claim we sign and expect.
+func tokenIssuer() string {
+	return config.TokenIssuer
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Refresh tokens look like "<session id>.<secret>". The id part lets us find
+// the session; only a hash of the whole token is stored.
+
+// NewSessionID returns a random identifier for a new session.
+func NewSessionID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// NewRefreshToken returns a fresh refresh token for sessionID.
+func NewRefreshToken(sessionID string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	return sessionID + "." + hex.EncodeToString(buf), nil
+}
+
+// SessionIDFromRefreshToken extracts the session id part of a refresh token.
+func SessionIDFromRefreshToken(token string) (string, bool) {
+	sessionID, secret, ok := strings.Cut(token, ".")
+	if !ok || sessionID == "" || secret == "" {
+		return "", false
+	}
+	return sessionID, true
+}
+
+// RefreshTokenUse is what a presented refresh token turns out to be for its
+// session.
+type RefreshTokenUse int
+
+const (
+	// RefreshUnknown is neither the current nor the previous refresh token:
+	// a guess, or one older than the last refresh. Refuse it, but leave the
+	// session alone. Its id is no secret, anyone can put it in front.
+	RefreshUnknown RefreshTokenUse = iota
+	// RefreshCurrent is the session's live refresh token.
+	RefreshCurrent
+	// RefreshReused is the token the last refresh spent. Two parties hold
+	// it and one of them isn't the user, so the session should end.
+	RefreshReused
+)
+
+// CheckRefreshToken compares token with a session's current and previous
+// refresh token hashes, in constant time.
+func CheckRefreshToken(token, currentHash, previousHash string) RefreshTokenUse {
+	hash := []byte(HashToken(token))
+	switch {
+	case subtle.ConstantTimeCompare(hash, []byte(currentHash)) == 1:
+		return RefreshCurrent
+	case previousHash != "" && subtle.ConstantTimeCompare(hash, []byte(previousHash)) == 1:
+		return RefreshReused
+	}
+	return RefreshUnknown
+}
+
+// HashToken is how refresh and access tokens are stored: never in the clear.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewCSRFToken returns a random token for the double-submit CSRF check of
+// cookie sessions.
+func NewCSRFToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate csrf token: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+type userCtxKey struct{}
+type sessionCtxKey struct{}
+
+// WithUser returns a copy of ctx carrying the authenticated username.
+func WithUser(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, userCtxKey{}, username)
+}
+
+// UserFromContext returns the username stored by WithUser, or "" for
+// unauthenticated requests.
+func UserFromContext(ctx context.Context) string {
+	username, _ := ctx.Value(userCtxKey{}).(string)
+	return username
+}
+
+// WithSessionID returns a copy of ctx carrying the current session id.
+func WithSessionID(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionCtxKey{}, sessionID)
+}
+
+// SessionIDFromContext returns the session id stored by WithSessionID.
+func SessionIDFromContext(ctx context.Context) string {
+	sessionID, _ := ctx.Value(sessionCtxKey{}).(string)
+	return sessionID
+}
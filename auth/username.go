@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"auth-api/config"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Usernames are 3 to 32 characters of letters, digits, '.', '_' and '-',
+// starting with a letter or digit.
+const (
+	UsernameMinLen = 3
+	UsernameMaxLen = 32
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// reservedUsernames can't be registered, on top of config.ReservedUsernames.
+// Matched by skeleton, so "adm1n" is taken too.
+var reservedUsernames = []string{
+	"abuse", "admin", "administrator", "anonymous", "api", "auth", "help",
+	"hostmaster", "me", "nobody", "noreply", "null", "postmaster", "root",
+	"security", "support", "system", "webmaster",
+}
+
+// skeletonReplacer folds characters that are easy to mistake for each other
+// onto one of them. init/006_username_case_insensitive.sql has the same
+// rules as username_skeleton(), keep the two in step.
+var skeletonReplacer = strings.NewReplacer("0", "o", "1", "l", "i", "l", "rn", "m", "vv", "w")
+
+// NormalizeUsername is the canonical form of a username, applied on
+// register and login: surrounding whitespace trimmed, Unicode NFKC (so
+// full width and other compatibility forms become plain letters) and
+// lowercased. Lowercased, not case folded: the lookup and the unique index
+// compare with the database's lower(), and folding would disagree with it
+// ("ß" folds to "ss"), locking such names out.
+func NormalizeUsername(username string) string {
+	return strings.ToLower(norm.NFKC.String(strings.TrimSpace(username)))
+}
+
+// UsernameSkeleton maps a normalized username onto its look-alike class:
+// "alice", "a1ice" and "aIice" share a skeleton.
+func UsernameSkeleton(username string) string {
+	return skeletonReplacer.Replace(strings.ToLower(username))
+}
+
+// ErrInvalidUsername is wrapped by every ValidateUsername rejection. The
+// wrapping error's message says which rule failed, fit to show the user.
+var ErrInvalidUsername = errors.New("invalid username")
+
+// ValidateUsername checks a new, already normalized username against the
+// format rules and the reserved names. Only new accounts are held to them,
+// existing names must keep logging in.
+func ValidateUsername(username string) error {
+	switch n := utf8.RuneCountInString(username); {
+	case n == 0:
+		return usernameError("required")
+	case n < UsernameMinLen:
+		return usernameError(fmt.Sprintf("must be at least %d characters", UsernameMinLen))
+	case n > UsernameMaxLen:
+		return usernameError(fmt.Sprintf("must be at most %d characters", UsernameMaxLen))
+	case !usernamePattern.MatchString(username):
+		return usernameError("may only contain letters, digits, '.', '_' and '-', and must start with a letter or digit")
+	case reserved(username):
+		return usernameError("is reserved")
+	}
+	return nil
+}
+
+// usernameError is an ErrInvalidUsername whose message is just the rule.
+type usernameError string
+
+func (e usernameError) Error() string { return string(e) }
+
+func (e usernameError) Unwrap() error { return ErrInvalidUsername }
+
+// reserved reports whether username looks like a reserved name.
+func reserved(username string) bool {
+	skeleton := UsernameSkeleton(username)
+	return slices.ContainsFunc(slices.Concat(reservedUsernames, config.ReservedUsernames), func(name string) bool {
+		return UsernameSkeleton(NormalizeUsername(name)) == skeleton
+	})
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"auth-api/config"
+	"auth-api/metrics"
+	"auth-api/pkg/verifier"
+	"auth-api/tracing"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Typed token rejections, shared with pkg/verifier so other services tell
+// them apart the same way. Each wraps ErrInvalidToken, so callers that only
+// care whether the token was rejected can keep checking for that.
+var (
+	ErrTokenExpired      = verifier.ErrTokenExpired
+	ErrTokenNotYetValid  = verifier.ErrTokenNotYetValid
+	ErrTokenSignature    = verifier.ErrTokenSignature
+	ErrTokenAudience     = verifier.ErrTokenAudience
+	ErrTokenIssuer       = verifier.ErrTokenIssuer
+	ErrTokenMissingClaim = verifier.ErrTokenMissingClaim
+	ErrTokenMalformed    = verifier.ErrTokenMalformed
+)
+
+// defaultRequiredClaims are required when TOKEN_REQUIRED_CLAIMS is unset.
+var defaultRequiredClaims = []string{"sub", "exp", "iat"}
+
+// Validator checks access tokens. The zero value accepts nothing: at least
+// one algorithm has to be allowed.
+type Validator struct {
+	// Algorithms lists the accepted alg header values, e.g. HS256. Pinning
+	// them stops alg=none and algorithm confusion attacks.
+	Algorithms []string
+	// Issuer and Audience must match iss and aud when set.
+	Issuer   string
+	Audience string
+	// Leeway is the clock skew allowed on exp, nbf and iat.
+	Leeway time.Duration
+	// MaxAge rejects tokens issued longer ago than this, whatever their
+	// exp says. Zero turns the check off.
+	MaxAge time.Duration
+	// RequiredClaims must be present in every token.
+	RequiredClaims []string
+	// Key returns the verification key. When nil it is the public half of
+	// the keypair loaded by LoadSigningKey, or else the stored signing
+	// secret.
+	Key func(ctx context.Context) ([]byte, error)
+}
+
+// NewValidator returns the validator for tokens this API accepts, built
+// from config.
+func NewValidator() *Validator {
+	required := config.TokenRequiredClaims
+	if len(required) == 0 {
+		required = defaultRequiredClaims
+	}
+	alg := jwt.SigningMethodHS256.Alg()
+	if signingKey != nil {
+		alg = signingKey.method.Alg()
+	}
+	return &Validator{
+		Algorithms:     []string{alg},
+		Issuer:         tokenIssuer(),
+		Audience:       config.TokenAudience,
+		Leeway:         config.TokenLeeway,
+		MaxAge:         config.TokenMaxAge,
+		RequiredClaims: required,
+	}
+}
+
+// validator is what ParseJWT and ValidateJWT use.
+var validator = NewValidator()
+
+// SetValidator replaces the validator used by ParseJWT and ValidateJWT.
+func SetValidator(v *Validator) {
+	validator = v
+}
+
+// Parse verifies token and returns its claims. Rejections are one of the
+// typed errors above; anything else (e.g. a failed key lookup) means the
+// token was never looked at.
+func (v *Validator) Parse(ctx context.Context, token string) (_ *Claims, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "auth.ValidateJWT")
+	defer func() { tracing.End(span, err) }()
+
+	var key any
+	switch {
+	case v.Key != nil:
+		key, err = v.Key(ctx)
+	case signingKey != nil:
+		key = signingKey.private.Public()
+	default:
+		key, err = getSecretKey(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := v.parse(token, key)
+	if err != nil {
+		metrics.Tokens.WithLabelValues(metrics.TokenRejected).Inc()
+		return nil, err
+	}
+	metrics.Tokens.WithLabelValues(metrics.TokenValidated).Inc()
+	return claims, nil
+}
+
+func (v *Validator) parse(token string, key any) (*Claims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(v.Algorithms),
+		jwt.WithLeeway(v.Leeway),
+		jwt.WithIssuedAt(),
+	}
+	if v.Issuer != "" {
+		options = append(options, jwt.WithIssuer(v.Issuer))
+	}
+	if v.Audience != "" {
+		options = append(options, jwt.WithAudience(v.Audience))
+	}
+
+	raw := jwt.MapClaims{}
+	keyFunc := func(*jwt.Token) (any, error) {
+		return key, nil
+	}
+	_, err := jwt.NewParser(options...).ParseWithClaims(token, raw, keyFunc)
+	if err != nil {
+		return nil, verifier.Classify(err)
+	}
+
+	for _, name := range v.RequiredClaims {
+		if _, ok := raw[name]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrTokenMissingClaim, name)
+		}
+	}
+
+	// round trip through JSON to get the typed claims we use
+	var claims Claims
+	data, err := json.Marshal(raw)
+	if err == nil {
+		err = json.Unmarshal(data, &claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenMalformed, err)
+	}
+
+	if v.MaxAge > 0 {
+		if claims.IssuedAt == nil {
+			return nil, fmt.Errorf("%w: iat", ErrTokenMissingClaim)
+		}
+		if time.Since(claims.IssuedAt.Time) > v.MaxAge+v.Leeway {
+			return nil, fmt.Errorf("%w: issued more than %v ago", ErrTokenExpired, v.MaxAge)
+		}
+	}
+	return &claims, nil
+}
@@ -0,0 +1,188 @@
+// Package clientip works out the real address of a client that may be
+// talking to us through reverse proxies.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// The forwarding headers a proxy can put the client in.
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded"
+)
+
+var (
+	mu      sync.RWMutex
+	trusted []netip.Prefix
+	header  = HeaderXForwardedFor
+)
+
+// SetTrustedProxies replaces the proxies whose forwarding headers we
+// believe. Entries are IPs or CIDR ranges; none means the headers are
+// always ignored.
+func SetTrustedProxies(proxies []string) error {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		prefix, err := parsePrefix(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	trusted = prefixes
+	return nil
+}
+
+// SetProxyHeader picks the one forwarding header our trusted proxies set,
+// X-Forwarded-For (the default) or Forwarded. The other one is never read:
+// a proxy that only appends to X-Forwarded-For passes a Forwarded header on
+// just as the client made it up.
+func SetProxyHeader(name string) error {
+	switch {
+	case strings.EqualFold(name, HeaderXForwardedFor):
+		name = HeaderXForwardedFor
+	case strings.EqualFold(name, HeaderForwarded):
+		name = HeaderForwarded
+	default:
+		return fmt.Errorf("unsupported proxy header %q, want %s or %s", name, HeaderXForwardedFor, HeaderForwarded)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	header = name
+	return nil
+}
+
+// ProxyHeader is the forwarding header set by SetProxyHeader.
+func ProxyHeader() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return header
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// FromRequest is the client IP of r, see Resolve.
+func FromRequest(r *http.Request) string {
+	return Resolve(r.RemoteAddr, r.Header.Values(ProxyHeader()))
+}
+
+// Resolve works out the client IP from the address the connection came
+// from and the values of the ProxyHeader that came with it. The header is
+// only read when remoteAddr is a trusted proxy, and then from the right:
+// trusted hops are skipped, the first untrusted one is the client. Anyone
+// can send the header, so whatever is left of that isn't believed.
+func Resolve(remoteAddr string, values []string) string {
+	remote, ok := parseAddr(remoteAddr)
+	if !ok {
+		return hostOnly(remoteAddr)
+	}
+
+	mu.RLock()
+	proxies, name := trusted, header
+	mu.RUnlock()
+
+	if !isTrusted(proxies, remote) {
+		return remote.String()
+	}
+
+	var hops []string
+	if name == HeaderForwarded {
+		hops = forwardedFors(values)
+	} else {
+		hops = splitList(values)
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseAddr(hops[i])
+		if !ok {
+			// "unknown", an obfuscated name or junk: the last hop we could
+			// read is as close as we get
+			break
+		}
+		client = hop
+		if !isTrusted(proxies, hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+func isTrusted(proxies []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddr reads an IP with or without a port, IPv6 with or without brackets.
+func parseAddr(s string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(hostOnly(s))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+func hostOnly(s string) string {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+}
+
+// splitList flattens comma separated header values, every occurrence of
+// the header counts.
+func splitList(values []string) []string {
+	var out []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	}
+	return out
+}
+
+// forwardedFors pulls the for= parameters out of Forwarded header values:
+// `for=192.0.2.60;proto=http, for="[2001:db8::17]:4711"`. An element
+// without one still counts, as a hop we can't read.
+func forwardedFors(values []string) []string {
+	var out []string
+	for _, element := range splitList(values) {
+		hop := "unknown"
+		for _, pair := range strings.Split(element, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if strings.EqualFold(key, "for") {
+				hop = strings.Trim(value, `"`)
+			}
+		}
+		out = append(out, hop)
+	}
+	return out
+}
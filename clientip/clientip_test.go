@@ -0,0 +1,94 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func trust(t *testing.T, proxies ...string) {
+	t.Helper()
+	if err := SetTrustedProxies(proxies); err != nil {
+		t.Fatalf("SetTrustedProxies: %v", err)
+	}
+	t.Cleanup(func() {
+		SetTrustedProxies(nil)
+	})
+}
+
+// TestResolve walks the forwarding headers for the trusted and untrusted cases.
+func TestResolve(t *testing.T) {
+	trust(t, "10.0.0.0/8", "2001:db8::1")
+
+	cases := []struct {
+		name   string
+		header string
+		remote string
+		values []string
+		want   string
+	}{
+		{"direct", HeaderXForwardedFor, "203.0.113.7:5555", nil, "203.0.113.7"},
+		{"untrusted peer can't spoof", HeaderXForwardedFor, "203.0.113.7:5555", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", HeaderXForwardedFor, "10.0.0.2:5555", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", HeaderXForwardedFor, "10.0.0.2:5555", []string{"198.51.100.1, 10.1.1.1"}, "198.51.100.1"},
+		{"spoofed left of the client", HeaderXForwardedFor, "10.0.0.2:5555", []string{"1.2.3.4, 198.51.100.1, 10.1.1.1"}, "198.51.100.1"},
+		{"repeated header", HeaderXForwardedFor, "10.0.0.2:5555", []string{"198.51.100.1", "10.1.1.1"}, "198.51.100.1"},
+		{"all hops trusted", HeaderXForwardedFor, "10.0.0.2:5555", []string{"10.9.9.9"}, "10.9.9.9"},
+		{"no header", HeaderXForwardedFor, "10.0.0.2:5555", nil, "10.0.0.2"},
+		{"junk hop", HeaderXForwardedFor, "10.0.0.2:5555", []string{"198.51.100.1, nonsense"}, "10.0.0.2"},
+		{"ipv6 proxy", HeaderXForwardedFor, "[2001:db8::1]:443", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"forwarded", HeaderForwarded, "10.0.0.2:5555", []string{`for=198.51.100.1;proto=https`}, "198.51.100.1"},
+		{"forwarded ipv6", HeaderForwarded, "10.0.0.2:5555", []string{`for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{"forwarded chain", HeaderForwarded, "10.0.0.2:5555", []string{`For=198.51.100.1, for=10.1.1.1`}, "198.51.100.1"},
+		{"forwarded unknown", HeaderForwarded, "10.0.0.2:5555", []string{`for=unknown`}, "10.0.0.2"},
+		{"mapped ipv4", HeaderXForwardedFor, "[::ffff:203.0.113.7]:5555", nil, "203.0.113.7"},
+		{"no port", HeaderXForwardedFor, "203.0.113.7", nil, "203.0.113.7"},
+	}
+	t.Cleanup(func() {
+		SetProxyHeader(HeaderXForwardedFor)
+	})
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := SetProxyHeader(tc.header); err != nil {
+				t.Fatalf("SetProxyHeader: %v", err)
+			}
+			if got := Resolve(tc.remote, tc.values); got != tc.want {
+				t.Fatalf("Resolve = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestFromRequest checks only the configured header is read off the request:
+// a Forwarded header passed through by an X-Forwarded-For proxy is the
+// client's own invention.
+func TestFromRequest(t *testing.T) {
+	trust(t, "10.0.0.1")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("Forwarded", "for=1.2.3.4")
+	if got := FromRequest(req); got != "198.51.100.1" {
+		t.Fatalf("FromRequest = %q, want 198.51.100.1", got)
+	}
+
+	if err := SetProxyHeader("forwarded"); err != nil {
+		t.Fatalf("SetProxyHeader: %v", err)
+	}
+	t.Cleanup(func() {
+		SetProxyHeader(HeaderXForwardedFor)
+	})
+	if got := FromRequest(req); got != "1.2.3.4" {
+		t.Fatalf("FromRequest = %q, want 1.2.3.4", got)
+	}
+	if err := SetProxyHeader("X-Real-IP"); err == nil {
+		t.Fatalf("expected an unsupported header to be rejected")
+	}
+}
+
+// TestSetTrustedProxiesInvalid rejects entries that are neither IPs nor CIDRs.
+func TestSetTrustedProxiesInvalid(t *testing.T) {
+	if err := SetTrustedProxies([]string{"10.0.0.0/8", "proxy.internal"}); err == nil {
+		t.Fatalf("expected an error for a host name")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"auth-api/auth"
+	"auth-api/db"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+const keysUsage = `usage: auth-api keys <command>
+
+commands:
+  init            generate and store a signing secret if none exists
+  show [-reveal]  print the fingerprint (or the value) of the stored secret
+  rotate          replace the stored secret. outstanding tokens stop validating
+  keypair         print a new P-256 private key (PEM) for TOKEN_SIGNING_KEY_FILE`
+
+// runKeys handles the `auth-api keys` subcommands and returns the exit code.
+func runKeys(args []string) int {
+	ctx := context.Background()
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, keysUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "init":
+		_, err := db.GetSecretKey(ctx)
+		if err == nil {
+			fmt.Println("signing secret already exists. use `keys rotate` to replace it")
+			return 0
+		}
+		if !errors.Is(err, db.ErrSecretKeyNotFound) {
+			fmt.Fprintf(os.Stderr, "failed to check signing secret: %v\n", err)
+			return 1
+		}
+		if err := auth.EnsureSecretKey(ctx, true); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create signing secret: %v\n", err)
+			return 1
+		}
+		fmt.Println("signing secret created")
+
+	case "show":
+		fs := flag.NewFlagSet("keys show", flag.ContinueOnError)
+		reveal := fs.Bool("reveal", false, "print the secret itself instead of its fingerprint")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		secretKey, err := db.GetSecretKey(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read signing secret: %v\n", err)
+			return 1
+		}
+		if *reveal {
+			fmt.Println(string(secretKey))
+			return 0
+		}
+		fmt.Printf("sha256:%s\n", fingerprint(secretKey))
+
+	case "rotate":
+		newKey, err := auth.GenerateSecretKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		if err := db.RotateSecretKey(ctx, newKey); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate signing secret: %v\n", err)
+			return 1
+		}
+		fmt.Printf("signing secret rotated. new fingerprint sha256:%s\n", fingerprint([]byte(newKey)))
+
+	case "keypair":
+		key, err := auth.GenerateSigningKey()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		os.Stdout.Write(key)
+
+	default:
+		fmt.Fprintln(os.Stderr, keysUsage)
+		return 2
+	}
+	return 0
+}
+
+// fingerprint identifies a secret without printing it.
+func fingerprint(secretKey []byte) string {
+	sum := sha256.Sum256(secretKey)
+	return hex.EncodeToString(sum[:8])
+}
@@ -1,30 +1,190 @@
 package main
 
 import (
+	"auth-api/audit"
+	"auth-api/auth"
+	"auth-api/clientip"
 	"auth-api/config"
 	"auth-api/db"
-	api "auth-api/handlers"
-	mw "auth-api/middleware"
-	"log"
+	"auth-api/geoip"
+	"auth-api/grpcapi"
+	"auth-api/logging"
+	"auth-api/logins"
+	"auth-api/metrics"
+	"auth-api/openapi"
+	"auth-api/tracing"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 
-	http.HandleFunc("/health", mw.Logger(api.HealthHandler))
-
-	http.HandleFunc("/login", mw.Logger(api.LoginHandler))
-	http.HandleFunc("/register", mw.Logger(api.RegisterHandler))
+	err := logging.Setup(os.Stderr, config.LogLevel, config.LogFormat)
+	if err != nil {
+		fatal("failed configuring logging", err)
+	}
 
-	http.HandleFunc("/secret", mw.Logger(mw.CheckJwt(api.SecretHandler)))
+	// stop on ctrl-c / docker stop so spans get flushed on the way out
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Initialize the DB. All these values live in the .env or .env.local
-	err := db.InitDB(config.User, config.DbName, config.Password, config.Host)
+	err = db.InitDB(ctx, config.User, config.DbName, config.Password, config.Host)
+
+	if err != nil {
+		fatal("failed initializing the db", err)
+	}
+
+	// `auth-api keys ...` manages the signing secret instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		os.Exit(runKeys(os.Args[2:]))
+	}
+
+	shutdownTracing, err := tracing.Setup(ctx, config.TraceExporter, config.TraceFile)
+	if err != nil {
+		fatal("failed configuring tracing", err)
+	}
+
+	// catch a missing signing secret now, not at the first login
+	err = auth.EnsureSecretKey(ctx, config.BootstrapSecret)
+	if err != nil {
+		fatal("signing secret unavailable. run `auth-api keys init` or set JWT_BOOTSTRAP_SECRET=true", err)
+	}
+
+	// a keypair replaces the secret for access tokens, ours and other services' checks alike
+	if config.TokenSigningKeyFile != "" {
+		err = auth.LoadSigningKey(config.TokenSigningKeyFile)
+		if err != nil {
+			fatal("failed loading the token signing key", err)
+		}
+		auth.SetValidator(auth.NewValidator())
+	}
+
+	hasher, err := auth.NewPasswordHasher(config.PasswordHasher)
+	if err != nil {
+		fatal("failed configuring password hashing", err)
+	}
+	// builds the unknown-user dummy hash too, so the first such login isn't slower than the rest
+	err = auth.SetPasswordHasher(hasher)
+	if err != nil {
+		fatal("failed configuring password hashing", err)
+	}
+
+	profiles, err := auth.ParseTokenProfiles(config.TokenProfiles, config.TokenAudience)
+	if err != nil {
+		fatal("failed configuring token profiles", err)
+	}
+	auth.SetTokenProfiles(profiles...)
+
+	auditSinks, err := audit.NewSinks(config.AuditSinks, config.AuditFile)
+	if err != nil {
+		fatal("failed configuring audit sinks", err)
+	}
+	audit.SetSinks(auditSinks...)
 
+	err = clientip.SetTrustedProxies(config.TrustedProxies)
+	if err == nil {
+		err = clientip.SetProxyHeader(config.TrustedProxyHeader)
+	}
 	if err != nil {
-		log.Fatalf("failed initializing the db: %v", err)
+		fatal("failed configuring trusted proxies", err)
+	}
+
+	err = geoip.Open(config.GeoIPDB)
+	if err != nil {
+		fatal("failed loading the geoip database", err)
+	}
+	defer geoip.Close()
+
+	riskActions, err := logins.ParseActions(config.LoginRiskActions)
+	if err != nil {
+		fatal("failed configuring login risk actions", err)
+	}
+	logins.SetActions(riskActions)
+
+	err = metrics.RegisterDBStats(db.GetDB())
+	if err != nil {
+		fatal("failed registering db metrics", err)
+	}
+
+	// the spec backs request validation, a broken one should stop us here
+	if _, err := openapi.Spec(); err != nil {
+		fatal("failed loading the openapi spec", err)
 	}
 
-	http.ListenAndServe(":8976", nil)
+	server := &http.Server{Addr: ":8976", Handler: newHandler()}
+	go func() {
+		slog.Info("listening", "addr", server.Addr)
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("server stopped", err)
+		}
+	}()
+
+	// the gRPC API runs next to the HTTP one, on its own port
+	grpcServer := grpcapi.NewServer()
+	if config.GRPCAddr != "" {
+		listener, err := net.Listen("tcp", config.GRPCAddr)
+		if err != nil {
+			fatal("failed to listen for grpc", err)
+		}
+		go func() {
+			slog.Info("listening", "addr", config.GRPCAddr, "protocol", "grpc")
+			if err := grpcServer.Serve(listener); err != nil {
+				fatal("grpc server stopped", err)
+			}
+		}()
+	}
+
+	// deleted accounts are kept for the grace period, then purged
+	if config.AccountDeleteGrace > 0 && config.AccountPurgeInterval > 0 {
+		go purgeDeletedAccounts(ctx, config.AccountDeleteGrace, config.AccountPurgeInterval)
+	}
+
+	<-ctx.Done()
+	slog.Info("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to shut down server", "error", err)
+	}
+	grpcServer.GracefulStop()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("failed to flush traces", "error", err)
+	}
+
+}
+
+// purgeDeletedAccounts removes accounts deleted more than grace ago, now and
+// then every interval until ctx is done.
+func purgeDeletedAccounts(ctx context.Context, grace, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := db.PurgeDeletedUsers(ctx, grace)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to purge deleted accounts", "error", err)
+		} else if purged > 0 {
+			slog.InfoContext(ctx, "purged deleted accounts", "count", purged)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
 
+// fatal logs through slog and exits, our stand in for log.Fatalf
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
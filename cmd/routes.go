@@ -0,0 +1,65 @@
+package main
+
+import (
+	"auth-api/config"
+	api "auth-api/handlers"
+	"auth-api/metrics"
+	mw "auth-api/middleware"
+	"auth-api/openapi"
+	"auth-api/router"
+	"net/http"
+)
+
+// newRouter is everything the HTTP server serves. Keep openapi/openapi.json
+// in step with it, routes_test.go checks the two agree.
+func newRouter() *router.Router {
+	r := router.New()
+
+	// probes get hit every few seconds, keep them out of the access log
+	r.HandleFunc("GET /healthz", api.HealthzHandler)
+	r.HandleFunc("GET /readyz", api.ReadyzHandler)
+	r.Handle("GET /metrics", metrics.Handler())
+	r.HandleFunc("GET /openapi.json", openapi.Handler)
+	r.HandleFunc("GET /.well-known/jwks.json", api.JWKSHandler)
+
+	// every API route gets the same outer layers: trace span, request id,
+	// access log, metrics
+	base := r.Group("", mw.Tracing, mw.RequestID, mw.Logger, mw.Metrics)
+
+	// then a check against the OpenAPI document, after authentication where
+	// there is any: anonymous callers get a 401, not details of the schema
+	public := base.Group("", mw.ValidateRequest)
+	public.HandleFunc("GET /health", api.HealthHandler)
+	// token responses must never be cached
+	public.HandleFunc("POST /login", api.LoginHandler, mw.NoStore)
+	public.HandleFunc("POST /register", api.RegisterHandler)
+	public.HandleFunc("POST /refresh", api.RefreshHandler, mw.NoStore)
+
+	authed := base.Group("", mw.CheckJwt, mw.ValidateRequest)
+	authed.HandleFunc("GET /secret", api.SecretHandler)
+	authed.HandleFunc("POST /logout", api.LogoutHandler)
+	authed.HandleFunc("GET /sessions", api.SessionsHandler)
+	authed.HandleFunc("DELETE /sessions/{id}", api.DeleteSessionHandler)
+	authed.HandleFunc("GET /me", api.ProfileHandler)
+	authed.HandleFunc("PATCH /me", api.UpdateProfileHandler)
+	authed.HandleFunc("DELETE /me", api.DeleteAccountHandler)
+	authed.HandleFunc("GET /me/logins", api.MyLoginsHandler)
+
+	admin := base.Group("/admin", mw.CheckJwt, mw.RequireAdmin, mw.ValidateRequest)
+	admin.HandleFunc("GET /audit", api.AuditHandler)
+
+	return r
+}
+
+// newHandler puts the browser facing layers in front of the router: CORS has
+// to see preflight requests before routing turns them into 405s.
+func newHandler() http.Handler {
+	cors := mw.CORS(mw.CORSOptions{
+		AllowedOrigins:   config.CORSAllowedOrigins,
+		AllowedMethods:   config.CORSAllowedMethods,
+		AllowedHeaders:   config.CORSAllowedHeaders,
+		AllowCredentials: config.CORSAllowCredentials,
+		MaxAge:           config.CORSMaxAge,
+	})
+	return router.Chain(mw.SecurityHeaders(config.HSTSMaxAge), cors)(newRouter().ServeHTTP)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"auth-api/openapi"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// pathParam matches {name} segments, in route and OpenAPI paths alike.
+var pathParam = regexp.MustCompile(`\{[^}]+\}`)
+
+// TestSpecMatchesRoutes checks every route is documented and every documented
+// operation is served.
+func TestSpecMatchesRoutes(t *testing.T) {
+	spec, err := openapi.Spec()
+	if err != nil {
+		t.Fatalf("failed to load spec: %v", err)
+	}
+
+	// routes -> spec
+	r := newRouter()
+	for _, rt := range r.Routes() {
+		item := spec.Paths.Find(rt.Path)
+		if item == nil {
+			t.Errorf("route %s %s is not in openapi.json", rt.Method, rt.Path)
+			continue
+		}
+		if item.GetOperation(rt.Method) == nil {
+			t.Errorf("route %s %s has no operation in openapi.json", rt.Method, rt.Path)
+		}
+	}
+
+	// spec -> routes: every documented operation must reach a handler
+	for path, item := range spec.Paths.Map() {
+		for method := range item.Operations() {
+			target := pathParam.ReplaceAllString(path, "x")
+			found := false
+			for _, rt := range r.Routes() {
+				if rt.Method == method && pathParam.ReplaceAllString(rt.Path, "x") == target {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("openapi.json documents %s %s but nothing serves it", method, path)
+			}
+		}
+	}
+}
+
+// TestOpenAPIServed checks the document is served as JSON.
+func TestOpenAPIServed(t *testing.T) {
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("expected the JSON document, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rr.Body.String(), `"openapi": "3.0.3"`) {
+		t.Fatalf("unexpected body: %.100s", rr.Body.String())
+	}
+}
+
+// TestAuthBeforeValidation checks anonymous calls to authenticated routes
+// get a 401 challenge whatever their body, not a validation error.
+func TestAuthBeforeValidation(t *testing.T) {
+	for _, tc := range []struct{ contentType, body string }{
+		{"application/json", `{"display_name": 42}`},
+		{"text/plain", "nope"},
+	} {
+		req := httptest.NewRequest(http.MethodPatch, "/me", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusUnauthorized || !strings.HasPrefix(rr.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Fatalf("%s: expected a 401 Bearer challenge, got %d %q: %s", tc.contentType, rr.Code, rr.Header().Get("WWW-Authenticate"), rr.Body.String())
+		}
+	}
+}
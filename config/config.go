@@ -1,10 +1,227 @@
 package config
 
-import "os"
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 var (
 	User     = os.Getenv("DB_USER")
 	Password = os.Getenv("DB_PASSWORD")
 	DbName   = os.Getenv("DB_NAME")
 	Host     = os.Getenv("DB_HOST")
+
+	// BootstrapSecret lets the server generate and store a JWT signing
+	// secret on startup when none exists yet.
+	BootstrapSecret = os.Getenv("JWT_BOOTSTRAP_SECRET") == "true"
+
+	// TokenSigningKeyFile is a PEM private key (P-256 or RSA) to sign
+	// access tokens with instead of the shared secret. Its public half is
+	// served at /.well-known/jwks.json. Generate one with `auth-api keys
+	// keypair`.
+	TokenSigningKeyFile = envString("TOKEN_SIGNING_KEY_FILE", "")
+
+	// LogLevel is one of debug, info, warn, error. LogFormat is json or text.
+	LogLevel  = envString("LOG_LEVEL", "info")
+	LogFormat = envString("LOG_FORMAT", "json")
+
+	// TraceExporter is one of none, otlp, stdout, file. The otlp exporter is
+	// pointed at a collector with the standard OTEL_EXPORTER_OTLP_ENDPOINT.
+	// TraceFile is where the file exporter appends spans.
+	TraceExporter = envString("TRACE_EXPORTER", "none")
+	TraceFile     = envString("TRACE_FILE", "traces.jsonl")
+
+	// AuditSinks lists where audit events go: any of db, file, syslog,
+	// comma separated. AuditFile is the file sink's path.
+	AuditSinks = envString("AUDIT_SINKS", "db")
+	AuditFile  = envString("AUDIT_FILE", "audit.jsonl")
+
+	// AdminUsers may use the /admin endpoints.
+	AdminUsers = envList("ADMIN_USERS")
+
+	// ReservedUsernames can't be registered, in addition to the built in
+	// list (admin, root, ...).
+	ReservedUsernames = envList("RESERVED_USERNAMES")
+
+	// PasswordHasher picks the algorithm for new password hashes: bcrypt or
+	// argon2id. Stored hashes of either kind keep working and are upgraded
+	// to the current algorithm and parameters on the next login.
+	PasswordHasher = envString("PASSWORD_HASHER", "bcrypt")
+
+	// BcryptCost is the work factor for new password hashes (bcrypt.DefaultCost is 10).
+	BcryptCost = envInt("BCRYPT_COST", 10)
+
+	// argon2id parameters, defaults per the RFC 9106 second recommended option
+	Argon2MemoryKiB = envInt("ARGON2_MEMORY_KIB", 64*1024)
+	Argon2Time      = envInt("ARGON2_TIME", 3)
+	Argon2Threads   = envInt("ARGON2_THREADS", 4)
+
+	// RegisterConcealExisting makes /register answer the same way whether
+	// or not the username is already taken, so it can't be used to probe
+	// for accounts.
+	RegisterConcealExisting = os.Getenv("REGISTER_CONCEAL_EXISTING") == "true"
+
+	// MaxBodyBytes caps request bodies, larger ones get a 413.
+	MaxBodyBytes = int64(envInt("MAX_BODY_BYTES", 64<<10))
+
+	// DBQueryTimeout bounds every database query, 0 for no limit.
+	// DBQueryTimeouts overrides it per query, by the query's name:
+	// "GetUserByName=1s,QueryAuditEvents=10s"
+	DBQueryTimeout  = envDuration("DB_QUERY_TIMEOUT", 5*time.Second)
+	DBQueryTimeouts = envDurations("DB_QUERY_TIMEOUTS")
+
+	// ReadyTimeout bounds each dependency check behind /readyz.
+	ReadyTimeout = envDuration("READY_TIMEOUT", 2*time.Second)
+
+	// RefreshTokenTTL is how long a session (and its refresh token) lives
+	// without being refreshed.
+	RefreshTokenTTL = envDuration("REFRESH_TOKEN_TTL", 720*time.Hour)
+
+	// TokenIssuer is the iss claim of our tokens. It must be the same on
+	// every replica, or tokens from one are refused by the others.
+	// TokenAudience is the audience this API itself accepts, and the one
+	// tokens are issued for when the client doesn't ask for another.
+	TokenIssuer   = envString("TOKEN_ISSUER", "auth-api")
+	TokenAudience = envString("TOKEN_AUDIENCE", "auth-api")
+
+	// TokenProfiles is a JSON list of per-audience token settings, e.g.
+	// [{"audience":"billing","ttl":"5m","claims":{"roles":["reader"]}}]
+	TokenProfiles = os.Getenv("TOKEN_PROFILES")
+
+	// CORS for browser clients on other origins. No allowed origins means
+	// no CORS headers at all. "*" allows any origin, but credentials only go
+	// to origins listed by name.
+	CORSAllowedOrigins   = envList("CORS_ALLOWED_ORIGINS")
+	CORSAllowedMethods   = envListDefault("CORS_ALLOWED_METHODS", "GET", "POST", "PATCH", "DELETE")
+	CORSAllowedHeaders   = envListDefault("CORS_ALLOWED_HEADERS", "Authorization", "Content-Type", "X-Request-ID", "X-CSRF-Token")
+	CORSAllowCredentials = os.Getenv("CORS_ALLOW_CREDENTIALS") == "true"
+	CORSMaxAge           = envDuration("CORS_MAX_AGE", 10*time.Minute)
+
+	// CookieSessions lets browser clients log in with ?mode=cookie: the
+	// tokens are set as HttpOnly cookies instead of being returned in the
+	// body, and state changing requests must carry the CSRF token.
+	// CookieDomain scopes the cookies (empty means this host only),
+	// COOKIE_SECURE=false allows plain http for local development and
+	// CookieSameSite is strict, lax or none.
+	CookieSessions = os.Getenv("COOKIE_SESSIONS") == "true"
+	CookieDomain   = os.Getenv("COOKIE_DOMAIN")
+	CookieSecure   = os.Getenv("COOKIE_SECURE") != "false"
+	CookieSameSite = envString("COOKIE_SAMESITE", "strict")
+
+	// HSTSMaxAge is sent in Strict-Transport-Security, 0 leaves it out.
+	HSTSMaxAge = envDuration("HSTS_MAX_AGE", 365*24*time.Hour)
+
+	// TrustedProxies are the addresses (or CIDR ranges) of our reverse
+	// proxies. Only their forwarding header is believed when working out
+	// the client's IP.
+	TrustedProxies = envList("TRUSTED_PROXIES")
+
+	// TrustedProxyHeader is the header those proxies put the client in,
+	// X-Forwarded-For or Forwarded. Only that one is read.
+	TrustedProxyHeader = envString("TRUSTED_PROXY_HEADER", "X-Forwarded-For")
+
+	// GeoIPDB is a MaxMind (.mmdb) city or country database used to fill in
+	// the location of registrations and logins, "" to go without.
+	GeoIPDB = os.Getenv("GEOIP_DB")
+
+	// LoginRiskActions says what a login tripping a risk rule gets, as
+	// rule=action pairs: "impossible_travel=step_up". Actions are flag (the
+	// default: allow, record and audit) and step_up (refuse until the user
+	// can prove more than a password).
+	// LoginRiskMaxSpeedKmh is the fastest travel between two logins that
+	// still counts as possible.
+	LoginRiskActions     = envList("LOGIN_RISK_ACTIONS")
+	LoginRiskMaxSpeedKmh = envInt("LOGIN_RISK_MAX_SPEED_KMH", 1000)
+
+	// AccountDeleteGrace is how long a deleted account is kept (unusable,
+	// its username still taken) before it is purged for good. 0 deletes
+	// right away. AccountPurgeInterval is how often the purge runs.
+	AccountDeleteGrace   = envDuration("ACCOUNT_DELETE_GRACE", 30*24*time.Hour)
+	AccountPurgeInterval = envDuration("ACCOUNT_PURGE_INTERVAL", time.Hour)
+
+	// GRPCAddr is where the gRPC API listens, "" to turn it off.
+	GRPCAddr = envString("GRPC_ADDR", ":8977")
+
+	// TokenLeeway is the clock skew tolerated on exp, nbf and iat.
+	// TokenMaxAge rejects tokens issued longer ago than this, 0 for no limit.
+	// TokenRequiredClaims must be in every token (default sub, exp, iat).
+	TokenLeeway         = envDuration("TOKEN_LEEWAY", 30*time.Second)
+	TokenMaxAge         = envDuration("TOKEN_MAX_AGE", 0)
+	TokenRequiredClaims = envList("TOKEN_REQUIRED_CLAIMS")
 )
+
+// envString reads key from the environment, falling back to def when unset.
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envList reads a comma separated list, dropping blanks.
+func envList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// envListDefault is envList with a fallback for an unset variable.
+func envListDefault(key string, def ...string) []string {
+	if os.Getenv(key) == "" {
+		return def
+	}
+	return envList(key)
+}
+
+// envDurations reads a comma separated list of name=duration pairs,
+// skipping malformed entries.
+func envDurations(key string) map[string]time.Duration {
+	out := map[string]time.Duration{}
+	for _, pair := range envList(key) {
+		name, raw, _ := strings.Cut(pair, "=")
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil {
+			log.Printf("config: ignoring invalid %s entry %q: %v", key, pair, err)
+			continue
+		}
+		out[strings.TrimSpace(name)] = d
+	}
+	return out
+}
+
+// envInt reads an integer from the environment, falling back to def when
+// unset or malformed.
+func envInt(key string, def int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Printf("config: ignoring invalid %s=%q: %v", key, raw, err)
+		return def
+	}
+	return n
+}
+
+// envDuration reads a time.ParseDuration value (e.g. "500ms") from the
+// environment, falling back to def when unset or malformed.
+func envDuration(key string, def time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("config: ignoring invalid %s=%q: %v", key, raw, err)
+		return def
+	}
+	return d
+}
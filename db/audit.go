@@ -0,0 +1,111 @@
+package db
+
+import (
+	"auth-api/models"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// maxAuditEvents caps a single audit query, whatever limit the caller asks for.
+const maxAuditEvents = 500
+
+// InsertAuditEvent appends an event to the audit_events table.
+func InsertAuditEvent(ctx context.Context, event models.AuditEvent) (err error) {
+	const query = `INSERT INTO audit_events
+		(occurred_at, event_type, actor, target, outcome, reason, ip_addr, user_agent, request_id)
+		values ($1, $2, $3, $4, $5, $6, NULLIF($7, '')::inet, $8, $9)`
+	ctx, end := startQuery(ctx, "db.InsertAuditEvent", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx,
+		event.Time, event.Type, event.Actor, event.Target, event.Outcome,
+		event.Reason, event.IP_addr, event.UserAgent, event.RequestID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save audit event: %w", err)
+	}
+	return nil
+}
+
+// QueryAuditEvents returns the newest audit events matching filter.
+func QueryAuditEvents(ctx context.Context, filter models.AuditFilter) (_ []models.AuditEvent, err error) {
+
+	// only the WHERE clause varies. values always go in as placeholders
+	var (
+		where []string
+		args  []any
+	)
+	addCond := func(cond string, value any) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if filter.Type != "" {
+		addCond("event_type = $%d", filter.Type)
+	}
+	if filter.Actor != "" {
+		addCond("actor = $%d", filter.Actor)
+	}
+	if filter.Outcome != "" {
+		addCond("outcome = $%d", filter.Outcome)
+	}
+	if !filter.Since.IsZero() {
+		addCond("occurred_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		addCond("occurred_at < $%d", filter.Until)
+	}
+	limit := filter.Limit
+	if limit <= 0 || limit > maxAuditEvents {
+		limit = maxAuditEvents
+	}
+	args = append(args, limit)
+
+	query := `SELECT id, occurred_at, event_type, COALESCE(actor, ''), COALESCE(target, ''), outcome,
+		COALESCE(reason, ''), COALESCE(host(ip_addr), ''), COALESCE(user_agent, ''), COALESCE(request_id, '')
+		FROM audit_events`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY occurred_at DESC, id DESC LIMIT $%d", len(args))
+
+	ctx, end := startQuery(ctx, "db.QueryAuditEvents", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var e models.AuditEvent
+		err = rows.Scan(
+			&e.ID, &e.Time, &e.Type, &e.Actor, &e.Target, &e.Outcome,
+			&e.Reason, &e.IP_addr, &e.UserAgent, &e.RequestID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		events = append(events, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit events: %w", err)
+	}
+	return events, nil
+}
@@ -1,11 +1,17 @@
 package db
 
 import (
+	"auth-api/config"
 	"auth-api/models"
+	"auth-api/tracing"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var (
@@ -15,16 +21,49 @@ var (
 	// sqlOpen and prepare are overridable for tests to inject fakes.
 	sqlOpen = sql.Open
 	prepare = defaultPrepare
+
+	// ErrSecretKeyNotFound is returned when the secrets table holds no row
+	// for this project.
+	ErrSecretKeyNotFound = errors.New("secret key not found")
+
+	// ErrNotFound is returned by lookups that match no row.
+	ErrNotFound = errors.New("not found")
+
+	// ErrUsernameTaken is returned by RegisterUser when the name already
+	// exists, in any case. Checking first can't rule that out: two
+	// registrations for the same name can both pass the check.
+	ErrUsernameTaken = errors.New("username taken")
 )
 
+// uniqueViolation is the Postgres error code for a unique index conflict.
+const uniqueViolation = "23505"
+
+// ExpectedSchemaVersion is the highest init/*.sql migration this build
+// relies on. Bump it together with every new migration file.
+const ExpectedSchemaVersion = 9
+
+// secretProjectName is the project_name key of our row in the secrets table.
+const secretProjectName = "go-auth-api"
+
 // The following abstractions were added by ChatGPT
 type rowScanner interface {
 	Scan(dest ...any) error
 }
 
+// rowsScanner is the multi-row counterpart of rowScanner, met by *sql.Rows.
+type rowsScanner interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close() error
+}
+
+// statement is a prepared query. ctx cancels the query and bounds how long
+// it may take, a hung database must not hang the request.
 type statement interface {
-	QueryRow(args ...any) rowScanner
-	Exec(args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, args ...any) rowScanner
+	QueryContext(ctx context.Context, args ...any) (rowsScanner, error)
+	ExecContext(ctx context.Context, args ...any) (sql.Result, error)
 	Close() error
 }
 
@@ -32,28 +71,56 @@ type sqlStmt struct {
 	stmt *sql.Stmt
 }
 
-func (s *sqlStmt) QueryRow(args ...any) rowScanner {
-	return s.stmt.QueryRow(args...)
+func (s *sqlStmt) QueryRowContext(ctx context.Context, args ...any) rowScanner {
+	return s.stmt.QueryRowContext(ctx, args...)
+}
+
+func (s *sqlStmt) QueryContext(ctx context.Context, args ...any) (rowsScanner, error) {
+	return s.stmt.QueryContext(ctx, args...)
 }
 
-func (s *sqlStmt) Exec(args ...any) (sql.Result, error) {
-	return s.stmt.Exec(args...)
+func (s *sqlStmt) ExecContext(ctx context.Context, args ...any) (sql.Result, error) {
+	return s.stmt.ExecContext(ctx, args...)
 }
 
 func (s *sqlStmt) Close() error {
 	return s.stmt.Close()
 }
 
-func defaultPrepare(db *sql.DB, query string) (statement, error) {
-	stmt, err := db.Prepare(query)
+func defaultPrepare(ctx context.Context, db *sql.DB, query string) (statement, error) {
+	stmt, err := db.PrepareContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 	return &sqlStmt{stmt: stmt}, nil
 }
 
+// startQuery opens the span for the query called name and bounds ctx by
+// its timeout, see config.DBQueryTimeouts. Call end with the query's error
+// when done, meant for `defer func() { end(err) }()`.
+func startQuery(ctx context.Context, name, query string) (_ context.Context, end func(error)) {
+	ctx, span := tracing.StartDBSpan(ctx, name, query)
+	cancel := context.CancelFunc(func() {})
+	if timeout := queryTimeout(name); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	return ctx, func(err error) {
+		cancel()
+		tracing.End(span, err)
+	}
+}
+
+// queryTimeout is the time limit for the query called name ("db.GetUserByName").
+func queryTimeout(name string) time.Duration {
+	if timeout, ok := config.DBQueryTimeouts[strings.TrimPrefix(name, "db.")]; ok {
+		return timeout
+	}
+	return config.DBQueryTimeout
+}
+
 // InitDB configures the global database connection pool using the provided creds
-func InitDB(user, dbName, password, host string) error {
+// and checks it can reach the database before ctx is done.
+func InitDB(ctx context.Context, user, dbName, password, host string) error {
 
 	DSN := fmt.Sprintf(
 		"user=%s dbname=%s password=%v host=%s sslmode=disable",
@@ -63,12 +130,12 @@ func InitDB(user, dbName, password, host string) error {
 	var err error
 	ACTIVE_DB, err = sqlOpen("postgres", DSN)
 	if err != nil {
-		return fmt.Errorf("error opening db: %v", err)
+		return fmt.Errorf("error opening db: %w", err)
 	}
 	// ping to test
-	err = ACTIVE_DB.Ping()
+	err = ACTIVE_DB.PingContext(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to ping db: %v", err)
+		return fmt.Errorf("failed to ping db: %w", err)
 	}
 	return nil
 }
@@ -78,14 +145,52 @@ func GetDB() *sql.DB {
 	return ACTIVE_DB
 }
 
+// Ping checks that the database is reachable within the context deadline.
+func Ping(ctx context.Context) (err error) {
+	ctx, end := startQuery(ctx, "db.Ping", "")
+	defer func() { end(err) }()
+
+	db := GetDB()
+	if db == nil {
+		return fmt.Errorf("db not initialized")
+	}
+	return db.PingContext(ctx)
+}
+
+// SchemaVersion returns the highest migration version recorded in the
+// schema_migrations table.
+func SchemaVersion(ctx context.Context) (_ int, err error) {
+	const query = "SELECT COALESCE(MAX(version), 0) FROM schema_migrations"
+	ctx, end := startQuery(ctx, "db.SchemaVersion", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	var version int
+	err = stmt.QueryRowContext(ctx).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
 // GetUserByName retrieves a user record from the USERS table using the supplied
-// username.
-func GetUserByName(username string) (*models.ServiceUser, error) {
+// username. Case doesn't matter, see init/006_username_case_insensitive.sql.
+// No such user, or a deleted one, is ErrNotFound.
+func GetUserByName(ctx context.Context, username string) (_ *models.ServiceUser, err error) {
+	const query = "SELECT username, password, location, ip_addr FROM USERS WHERE lower(username) = lower($1) AND deleted_at IS NULL"
+	ctx, end := startQuery(ctx, "db.GetUserByName", query)
+	defer func() { end(err) }()
 
 	db := GetDB()
-	stmt, err := prepare(db, "SELECT username, password, location, ip_addr FROM USERS WHERE USERNAME = $1")
+	stmt, err := prepare(ctx, db, query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to prepare statement: %v", err)
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
 	}
 	defer stmt.Close() // very interesting. when you defer it closes the statement when the func ends
 
@@ -93,49 +198,162 @@ func GetUserByName(username string) (*models.ServiceUser, error) {
 	// QueryRow returns a non-nil value, always. if scan turns up no data, that is, if there a no rows, then you get an error
 	// you gotta scan it into your struct
 	var user_data models.ServiceUser
-	row := stmt.QueryRow(username)
+	row := stmt.QueryRowContext(ctx, username)
 	err = row.Scan(
 		&user_data.Username, &user_data.Password, &user_data.Location, &user_data.IP_addr,
 	)
 
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		return nil, fmt.Errorf("no user found: %v", err)
+		return nil, fmt.Errorf("failed to look up user: %w", err)
 	}
 	return &user_data, nil
 
 }
 
-// RegisterUser inserts a new user record into the USERS table.
-func RegisterUser(newUser models.ServiceUser) error {
+// ConfusableUsername returns an existing username that looks like username
+// (same username_skeleton), or "" when there is none.
+func ConfusableUsername(ctx context.Context, username string) (_ string, err error) {
+	const query = "SELECT username FROM USERS WHERE username_skeleton(username) = username_skeleton($1) LIMIT 1"
+	ctx, end := startQuery(ctx, "db.ConfusableUsername", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return "", fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	var existing string
+	err = stmt.QueryRowContext(ctx, username).Scan(&existing)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up similar usernames: %w", err)
+	}
+	return existing, nil
+}
+
+// RegisterUser inserts a new user record into the USERS table. A name that
+// is already taken is ErrUsernameTaken.
+func RegisterUser(ctx context.Context, newUser models.ServiceUser) (err error) {
+	const query = "INSERT INTO USERS (username, password, location, ip_addr) values ($1, $2, $3, $4)"
+	ctx, end := startQuery(ctx, "db.RegisterUser", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, newUser.Username, newUser.Password, newUser.Location, newUser.IP_addr)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return ErrUsernameTaken
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save user to db: %w", err)
+	}
+	return nil
+}
+
+// UpdatePasswordHash replaces the stored password hash of a user.
+func UpdatePasswordHash(ctx context.Context, username, hashed string) (err error) {
+	const query = "UPDATE USERS SET password = $2 WHERE USERNAME = $1"
+	ctx, end := startQuery(ctx, "db.UpdatePasswordHash", query)
+	defer func() { end(err) }()
+
 	db := GetDB()
-	stmt, err := prepare(db, "INSERT INTO USERS (username, password, location, ip_addr) values ($1, $2, $3, $4)")
+	stmt, err := prepare(ctx, db, query)
 	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %v", err)
+		return fmt.Errorf("failed to prepare statement: %w", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(newUser.Username, newUser.Password, newUser.Location, newUser.IP_addr)
+	_, err = stmt.ExecContext(ctx, username, hashed)
 	if err != nil {
-		return fmt.Errorf("failed to save user to db: %v", err)
+		return fmt.Errorf("failed to update password hash: %w", err)
 	}
 	return nil
 }
 
 // GetSecretKey fetches the signing secret for JWT issuance from the secrets table.
-func GetSecretKey() ([]byte, error) {
+func GetSecretKey(ctx context.Context) (_ []byte, err error) {
+	const query = "SELECT SECRET_KEY FROM secrets where project_name = $1"
+	ctx, end := startQuery(ctx, "db.GetSecretKey", query)
+	defer func() { end(err) }()
+
 	db := GetDB()
-	stmt, err := prepare(db, "SELECT SECRET_KEY FROM secrets where project_name = 'go-auth-api'")
+	stmt, err := prepare(ctx, db, query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to prepare statement: %v", err)
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
 	}
 	defer stmt.Close()
 
 	var secretKey string
-	err = stmt.QueryRow().Scan(&secretKey)
+	err = stmt.QueryRowContext(ctx, secretProjectName).Scan(&secretKey)
 
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSecretKeyNotFound
+	}
 	if err != nil {
-		return nil, fmt.Errorf("secret key not found: %v", err)
+		return nil, fmt.Errorf("failed to read secret key: %w", err)
 	}
 
 	return []byte(secretKey), nil
 }
+
+// InsertSecretKey stores the signing secret for this project. It fails if a
+// secret already exists; use RotateSecretKey to replace one.
+func InsertSecretKey(ctx context.Context, secretKey string) (err error) {
+	const query = "INSERT INTO secrets (project_name, secret_key) values ($1, $2)"
+	ctx, end := startQuery(ctx, "db.InsertSecretKey", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, secretProjectName, secretKey)
+	if err != nil {
+		return fmt.Errorf("failed to save secret key: %w", err)
+	}
+	return nil
+}
+
+// RotateSecretKey replaces the existing signing secret. Every token signed
+// with the old secret stops validating once this returns.
+func RotateSecretKey(ctx context.Context, secretKey string) (err error) {
+	const query = "UPDATE secrets SET secret_key = $2, updated_at = now() WHERE project_name = $1"
+	ctx, end := startQuery(ctx, "db.RotateSecretKey", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, secretProjectName, secretKey)
+	if err != nil {
+		return fmt.Errorf("failed to rotate secret key: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to rotate secret key: %w", err)
+	}
+	if rows == 0 {
+		return ErrSecretKeyNotFound
+	}
+	return nil
+}
@@ -4,11 +4,18 @@ import (
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"auth-api/config"
 	"auth-api/models"
+
+	"github.com/lib/pq"
 )
 
 // stubConn implements the minimum driver.Conn interface needed for exercising
@@ -70,7 +77,7 @@ func TestInitDBSuccess(t *testing.T) {
 		sqlOpen = originalOpen
 	})
 
-	if err := InitDB("test", "testdb", "secret", "localhost"); err != nil {
+	if err := InitDB(context.Background(), "test", "testdb", "secret", "localhost"); err != nil {
 		t.Fatalf("InitDB returned error: %v", err)
 	}
 	t.Cleanup(func() {
@@ -95,7 +102,7 @@ func TestInitDBOpenError(t *testing.T) {
 		sqlOpen = originalOpen
 	})
 
-	if err := InitDB("test", "db", "pw", "localhost"); err == nil {
+	if err := InitDB(context.Background(), "test", "db", "pw", "localhost"); err == nil {
 		t.Fatalf("expected error when open fails")
 	}
 }
@@ -111,7 +118,7 @@ func TestInitDBPingError(t *testing.T) {
 		sqlOpen = originalOpen
 	})
 
-	if err := InitDB("user", "db", "pw", "localhost"); err == nil {
+	if err := InitDB(context.Background(), "user", "db", "pw", "localhost"); err == nil {
 		t.Fatalf("expected ping failure to propagate")
 	}
 	if ACTIVE_DB != nil {
@@ -132,20 +139,37 @@ func TestGetDB(t *testing.T) {
 // fakeStmt models the behaviour of prepared statements, letting tests inject
 // row and execution outcomes.
 type fakeStmt struct {
-	row     rowScanner
-	execErr error
-	closed  bool
+	row      rowScanner
+	rows     *fakeRows
+	execErr  error
+	noRows   bool // Exec reports zero affected rows
+	closed   bool
+	lastArgs []any
+	lastCtx  context.Context
 }
 
-func (f *fakeStmt) QueryRow(args ...any) rowScanner {
+func (f *fakeStmt) QueryRowContext(ctx context.Context, args ...any) rowScanner {
+	f.lastCtx, f.lastArgs = ctx, args
 	return f.row
 }
 
-func (f *fakeStmt) Exec(args ...any) (sql.Result, error) {
+func (f *fakeStmt) QueryContext(ctx context.Context, args ...any) (rowsScanner, error) {
+	f.lastCtx, f.lastArgs = ctx, args
+	if f.rows == nil {
+		return nil, errors.New("no rows programmed")
+	}
+	return f.rows, nil
+}
+
+func (f *fakeStmt) ExecContext(ctx context.Context, args ...any) (sql.Result, error) {
+	f.lastCtx, f.lastArgs = ctx, args
 	if f.execErr != nil {
 		return nil, f.execErr
 	}
-	return fakeResult{}, nil
+	if f.noRows {
+		return fakeResult{rows: 0}, nil
+	}
+	return fakeResult{rows: 1}, nil
 }
 
 func (f *fakeStmt) Close() error {
@@ -173,6 +197,38 @@ func (f fakeRow) Scan(dest ...any) error {
 			if str, ok := f.values[i].(string); ok {
 				*d = str
 			}
+		case *int:
+			if n, ok := f.values[i].(int); ok {
+				*d = n
+			}
+		case *int64:
+			if n, ok := f.values[i].(int64); ok {
+				*d = n
+			}
+		case *time.Time:
+			if ts, ok := f.values[i].(time.Time); ok {
+				*d = ts
+			}
+		case *bool:
+			if b, ok := f.values[i].(bool); ok {
+				*d = b
+			}
+		case **float64:
+			if p, ok := f.values[i].(*float64); ok {
+				*d = p
+			}
+		case **time.Time:
+			if p, ok := f.values[i].(*time.Time); ok {
+				*d = p
+			}
+		case *[]byte:
+			if b, ok := f.values[i].([]byte); ok {
+				*d = b
+			}
+		case sql.Scanner:
+			if err := d.Scan(f.values[i]); err != nil {
+				return err
+			}
 		default:
 			return errors.New("unsupported scan type")
 		}
@@ -180,10 +236,37 @@ func (f fakeRow) Scan(dest ...any) error {
 	return nil
 }
 
-type fakeResult struct{}
+// fakeRows hands out one fakeRow per Next call.
+type fakeRows struct {
+	rows   []fakeRow
+	pos    int
+	closed bool
+}
+
+func (f *fakeRows) Next() bool {
+	f.pos++
+	return f.pos <= len(f.rows)
+}
+
+func (f *fakeRows) Scan(dest ...any) error {
+	return f.rows[f.pos-1].Scan(dest...)
+}
+
+func (f *fakeRows) Err() error {
+	return nil
+}
+
+func (f *fakeRows) Close() error {
+	f.closed = true
+	return nil
+}
+
+type fakeResult struct {
+	rows int64
+}
 
-func (fakeResult) LastInsertId() (int64, error) { return 0, nil }
-func (fakeResult) RowsAffected() (int64, error) { return 1, nil }
+func (fakeResult) LastInsertId() (int64, error)   { return 0, nil }
+func (f fakeResult) RowsAffected() (int64, error) { return f.rows, nil }
 
 // TestGetUserByName verifies the happy path of retrieving and scanning user
 // data from the database.
@@ -191,7 +274,7 @@ func TestGetUserByName(t *testing.T) {
 	originalPrepare := prepare
 	row := fakeRow{values: []any{"alice", "hashed", "Earth", "127.0.0.1"}}
 	stmt := &fakeStmt{row: row}
-	prepare = func(db *sql.DB, query string) (statement, error) {
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
 		return stmt, nil
 	}
 	ACTIVE_DB = &sql.DB{}
@@ -199,7 +282,7 @@ func TestGetUserByName(t *testing.T) {
 		prepare = originalPrepare
 	})
 
-	user, err := GetUserByName("alice")
+	user, err := GetUserByName(context.Background(), "alice")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -214,7 +297,7 @@ func TestGetUserByName(t *testing.T) {
 // TestGetUserByNameError asserts that prepare failures are surfaced.
 func TestGetUserByNameError(t *testing.T) {
 	originalPrepare := prepare
-	prepare = func(db *sql.DB, query string) (statement, error) {
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
 		return nil, errors.New("prepare failed")
 	}
 	ACTIVE_DB = &sql.DB{}
@@ -222,7 +305,7 @@ func TestGetUserByNameError(t *testing.T) {
 		prepare = originalPrepare
 	})
 
-	if _, err := GetUserByName("alice"); err == nil {
+	if _, err := GetUserByName(context.Background(), "alice"); err == nil {
 		t.Fatalf("expected prepare error")
 	}
 }
@@ -231,7 +314,7 @@ func TestGetUserByNameError(t *testing.T) {
 func TestGetUserByNameScanError(t *testing.T) {
 	originalPrepare := prepare
 	stmt := &fakeStmt{row: fakeRow{err: errors.New("no rows")}}
-	prepare = func(db *sql.DB, query string) (statement, error) {
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
 		return stmt, nil
 	}
 	ACTIVE_DB = &sql.DB{}
@@ -239,7 +322,7 @@ func TestGetUserByNameScanError(t *testing.T) {
 		prepare = originalPrepare
 	})
 
-	if _, err := GetUserByName("alice"); err == nil {
+	if _, err := GetUserByName(context.Background(), "alice"); err == nil {
 		t.Fatalf("expected scan error")
 	}
 }
@@ -248,7 +331,7 @@ func TestGetUserByNameScanError(t *testing.T) {
 func TestRegisterUser(t *testing.T) {
 	originalPrepare := prepare
 	stmt := &fakeStmt{}
-	prepare = func(db *sql.DB, query string) (statement, error) {
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
 		return stmt, nil
 	}
 	ACTIVE_DB = &sql.DB{}
@@ -257,7 +340,7 @@ func TestRegisterUser(t *testing.T) {
 	})
 
 	user := models.ServiceUser{Username: "alice", Password: "hashed", Location: "Earth", IP_addr: "127.0.0.1"}
-	if err := RegisterUser(user); err != nil {
+	if err := RegisterUser(context.Background(), user); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if !stmt.closed {
@@ -269,7 +352,7 @@ func TestRegisterUser(t *testing.T) {
 // creation are surfaced.
 func TestRegisterUserPrepareError(t *testing.T) {
 	originalPrepare := prepare
-	prepare = func(db *sql.DB, query string) (statement, error) {
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
 		return nil, errors.New("prepare failed")
 	}
 	ACTIVE_DB = &sql.DB{}
@@ -277,7 +360,7 @@ func TestRegisterUserPrepareError(t *testing.T) {
 		prepare = originalPrepare
 	})
 
-	if err := RegisterUser(models.ServiceUser{}); err == nil {
+	if err := RegisterUser(context.Background(), models.ServiceUser{}); err == nil {
 		t.Fatalf("expected prepare error")
 	}
 }
@@ -286,7 +369,7 @@ func TestRegisterUserPrepareError(t *testing.T) {
 func TestRegisterUserExecError(t *testing.T) {
 	originalPrepare := prepare
 	stmt := &fakeStmt{execErr: errors.New("insert failed")}
-	prepare = func(db *sql.DB, query string) (statement, error) {
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
 		return stmt, nil
 	}
 	ACTIVE_DB = &sql.DB{}
@@ -294,7 +377,7 @@ func TestRegisterUserExecError(t *testing.T) {
 		prepare = originalPrepare
 	})
 
-	if err := RegisterUser(models.ServiceUser{}); err == nil {
+	if err := RegisterUser(context.Background(), models.ServiceUser{}); err == nil {
 		t.Fatalf("expected exec error")
 	}
 }
@@ -303,7 +386,7 @@ func TestRegisterUserExecError(t *testing.T) {
 func TestGetSecretKey(t *testing.T) {
 	originalPrepare := prepare
 	stmt := &fakeStmt{row: fakeRow{values: []any{"topsecret"}}}
-	prepare = func(db *sql.DB, query string) (statement, error) {
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
 		return stmt, nil
 	}
 	ACTIVE_DB = &sql.DB{}
@@ -311,7 +394,7 @@ func TestGetSecretKey(t *testing.T) {
 		prepare = originalPrepare
 	})
 
-	key, err := GetSecretKey()
+	key, err := GetSecretKey(context.Background())
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -324,7 +407,7 @@ func TestGetSecretKey(t *testing.T) {
 // scanning when retrieving the secret.
 func TestGetSecretKeyErrors(t *testing.T) {
 	originalPrepare := prepare
-	prepare = func(db *sql.DB, query string) (statement, error) {
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
 		return nil, errors.New("prepare failed")
 	}
 	ACTIVE_DB = &sql.DB{}
@@ -332,16 +415,620 @@ func TestGetSecretKeyErrors(t *testing.T) {
 		prepare = originalPrepare
 	})
 
-	if _, err := GetSecretKey(); err == nil {
+	if _, err := GetSecretKey(context.Background()); err == nil {
 		t.Fatalf("expected prepare failure")
 	}
 
 	rowStmt := &fakeStmt{row: fakeRow{err: errors.New("not found")}}
-	prepare = func(db *sql.DB, query string) (statement, error) {
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
 		return rowStmt, nil
 	}
 
-	if _, err := GetSecretKey(); err == nil {
+	if _, err := GetSecretKey(context.Background()); err == nil {
 		t.Fatalf("expected scan failure")
 	}
 }
+
+// TestGetSecretKeyMissing ensures a missing secrets row is reported with the
+// sentinel error so callers can bootstrap one.
+func TestGetSecretKeyMissing(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{row: fakeRow{err: sql.ErrNoRows}}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	if _, err := GetSecretKey(context.Background()); !errors.Is(err, ErrSecretKeyNotFound) {
+		t.Fatalf("expected ErrSecretKeyNotFound, got %v", err)
+	}
+}
+
+// TestInsertSecretKey covers storing a new secret and surfacing Exec errors.
+func TestInsertSecretKey(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	if err := InsertSecretKey(context.Background(), "topsecret"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !stmt.closed {
+		t.Fatalf("expected statement to be closed")
+	}
+
+	stmt.execErr = errors.New("duplicate key")
+	if err := InsertSecretKey(context.Background(), "topsecret"); err == nil {
+		t.Fatalf("expected exec error")
+	}
+}
+
+// TestRotateSecretKey covers replacing the secret and surfacing Exec errors.
+func TestRotateSecretKey(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	if err := RotateSecretKey(context.Background(), "newsecret"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stmt.execErr = errors.New("update failed")
+	if err := RotateSecretKey(context.Background(), "newsecret"); err == nil {
+		t.Fatalf("expected exec error")
+	}
+}
+
+// TestPing verifies Ping reports an uninitialized pool and succeeds against a
+// reachable one.
+func TestPing(t *testing.T) {
+	ACTIVE_DB = nil
+	if err := Ping(context.Background()); err == nil {
+		t.Fatalf("expected error for nil db")
+	}
+
+	ACTIVE_DB = sql.OpenDB(&fakeConnector{})
+	t.Cleanup(func() {
+		ACTIVE_DB.Close()
+		ACTIVE_DB = nil
+	})
+	if err := Ping(context.Background()); err != nil {
+		t.Fatalf("unexpected ping error: %v", err)
+	}
+}
+
+// TestSchemaVersion covers reading the migration version and its failure path.
+func TestSchemaVersion(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{row: fakeRow{values: []any{ExpectedSchemaVersion}}}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	version, err := SchemaVersion(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version != ExpectedSchemaVersion {
+		t.Fatalf("expected version %d, got %d", ExpectedSchemaVersion, version)
+	}
+
+	stmt.row = fakeRow{err: errors.New("relation does not exist")}
+	if _, err := SchemaVersion(context.Background()); err == nil {
+		t.Fatalf("expected scan error")
+	}
+}
+
+// TestInsertAuditEvent checks every event field is passed to the insert.
+func TestInsertAuditEvent(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	event := models.AuditEvent{Time: time.Now(), Type: "login", Actor: "alice", Outcome: "success", IP_addr: "127.0.0.1", RequestID: "req-1"}
+	if err := InsertAuditEvent(context.Background(), event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stmt.lastArgs) != 9 || stmt.lastArgs[2] != "alice" || stmt.lastArgs[8] != "req-1" {
+		t.Fatalf("unexpected insert args: %v", stmt.lastArgs)
+	}
+
+	stmt.execErr = errors.New("insert failed")
+	if err := InsertAuditEvent(context.Background(), event); err == nil {
+		t.Fatalf("expected exec error")
+	}
+}
+
+// TestQueryAuditEvents verifies filters become placeholders in order and rows
+// are scanned into events.
+func TestQueryAuditEvents(t *testing.T) {
+	originalPrepare := prepare
+	now := time.Now()
+	stmt := &fakeStmt{rows: &fakeRows{rows: []fakeRow{
+		{values: []any{int64(2), now, "login", "alice", "", "failure", "invalid_password", "127.0.0.1", "curl", "req-2"}},
+		{values: []any{int64(1), now, "login", "alice", "", "success", "", "127.0.0.1", "curl", "req-1"}},
+	}}}
+	var capturedQuery string
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		capturedQuery = query
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	events, err := QueryAuditEvents(context.Background(), models.AuditFilter{Actor: "alice", Since: now.Add(-time.Hour), Limit: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 2 || events[0].ID != 2 || events[0].Reason != "invalid_password" || !events[1].Time.Equal(now) {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	if !strings.Contains(capturedQuery, "WHERE actor = $1 AND occurred_at >= $2") || !strings.Contains(capturedQuery, "LIMIT $3") {
+		t.Fatalf("unexpected query: %s", capturedQuery)
+	}
+	if len(stmt.lastArgs) != 3 || stmt.lastArgs[0] != "alice" || stmt.lastArgs[2] != 10 {
+		t.Fatalf("unexpected query args: %v", stmt.lastArgs)
+	}
+	if !stmt.rows.closed {
+		t.Fatalf("expected rows to be closed")
+	}
+}
+
+// TestUpdatePasswordHash checks the username and new hash reach the update.
+func TestUpdatePasswordHash(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	if err := UpdatePasswordHash(context.Background(), "alice", "$argon2id$..."); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stmt.lastArgs) != 2 || stmt.lastArgs[0] != "alice" || stmt.lastArgs[1] != "$argon2id$..." {
+		t.Fatalf("unexpected update args: %v", stmt.lastArgs)
+	}
+
+	stmt.execErr = errors.New("update failed")
+	if err := UpdatePasswordHash(context.Background(), "alice", "x"); err == nil {
+		t.Fatalf("expected exec error")
+	}
+}
+
+// TestCreateSession checks the session fields and ttl reach the insert, and
+// that an unknown user is an error.
+func TestCreateSession(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	session := models.Session{ID: "s1", Username: "alice", UserAgent: "curl", IP_addr: "127.0.0.1", AccessHash: "a", RefreshHash: "r", Audience: "billing"}
+	if err := CreateSession(context.Background(), session, time.Hour); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []any{"s1", "a", "r", "curl", "127.0.0.1", int64(3600), "alice", "billing"}
+	if fmt.Sprint(stmt.lastArgs) != fmt.Sprint(want) {
+		t.Fatalf("unexpected insert args: %v", stmt.lastArgs)
+	}
+
+	stmt.noRows = true
+	if err := CreateSession(context.Background(), session, time.Hour); err == nil {
+		t.Fatalf("expected an error for an unknown user")
+	}
+}
+
+// TestGetSession covers scanning a session and the not found mapping.
+func TestGetSession(t *testing.T) {
+	originalPrepare := prepare
+	now := time.Now()
+	stmt := &fakeStmt{row: fakeRow{values: []any{"s1", "alice", "curl", "127.0.0.1", now, now, now.Add(time.Hour), "", "r", "p"}}}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	session, err := GetSession(context.Background(), "s1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if session.ID != "s1" || session.Username != "alice" || session.RefreshHash != "r" || session.PreviousRefreshHash != "p" || !session.ExpiresAt.After(now) {
+		t.Fatalf("unexpected session: %+v", session)
+	}
+
+	stmt.row = fakeRow{err: sql.ErrNoRows}
+	if _, err := GetSession(context.Background(), "gone"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+// TestListSessions checks every row is returned for the user.
+func TestListSessions(t *testing.T) {
+	originalPrepare := prepare
+	now := time.Now()
+	stmt := &fakeStmt{rows: &fakeRows{rows: []fakeRow{
+		{values: []any{"s2", "alice", "firefox", "10.0.0.2", now, now, now, "", "", ""}},
+		{values: []any{"s1", "alice", "curl", "10.0.0.1", now, now, now, "", "", ""}},
+	}}}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	sessions, err := ListSessions(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != "s2" || sessions[1].UserAgent != "curl" {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+	if len(stmt.lastArgs) != 1 || stmt.lastArgs[0] != "alice" || !stmt.rows.closed {
+		t.Fatalf("unexpected query args %v or rows left open", stmt.lastArgs)
+	}
+}
+
+// TestDeleteSession checks the delete is scoped to the owner and that a miss
+// is ErrSessionNotFound.
+func TestDeleteSession(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	if err := DeleteSession(context.Background(), "alice", "s1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stmt.lastArgs) != 2 || stmt.lastArgs[0] != "alice" || stmt.lastArgs[1] != "s1" {
+		t.Fatalf("unexpected delete args: %v", stmt.lastArgs)
+	}
+
+	stmt.noRows = true
+	if err := DeleteSession(context.Background(), "bob", "s1"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+// TestRotateSessionTokens checks a stale refresh hash doesn't rotate, that
+// the spent one is kept and that the session is extended by the ttl.
+func TestRotateSessionTokens(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{noRows: true}
+	var query string
+	prepare = func(ctx context.Context, db *sql.DB, q string) (statement, error) {
+		query = q
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	if err := RotateSessionTokens(context.Background(), "s1", "old", "new", "access", time.Hour); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+	if len(stmt.lastArgs) != 5 || stmt.lastArgs[1] != "old" || stmt.lastArgs[2] != "new" || stmt.lastArgs[4] != int64(3600) {
+		t.Fatalf("unexpected update args: %v", stmt.lastArgs)
+	}
+	if !strings.Contains(query, "previous_refresh_token_hash = refresh_token_hash") {
+		t.Fatalf("expected the spent hash to be kept: %s", query)
+	}
+}
+
+// TestConfusableUsername checks a look-alike is reported and no match is
+// not an error.
+func TestConfusableUsername(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{row: fakeRow{values: []any{"alice"}}}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		if !strings.Contains(query, "username_skeleton") {
+			t.Fatalf("unexpected query: %s", query)
+		}
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	existing, err := ConfusableUsername(context.Background(), "a1ice")
+	if err != nil || existing != "alice" || stmt.lastArgs[0] != "a1ice" {
+		t.Fatalf("expected alice, got %q (%v)", existing, err)
+	}
+
+	stmt.row = fakeRow{err: sql.ErrNoRows}
+	if existing, err := ConfusableUsername(context.Background(), "bob"); err != nil || existing != "" {
+		t.Fatalf("expected no match, got %q (%v)", existing, err)
+	}
+}
+
+// TestGetUserByNameNotFound checks a missing user is ErrNotFound, not a
+// scan error.
+func TestGetUserByNameNotFound(t *testing.T) {
+	originalPrepare := prepare
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return &fakeStmt{row: fakeRow{err: sql.ErrNoRows}}, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	if _, err := GetUserByName(context.Background(), "alice"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+// TestRegisterUserUniqueViolation checks a unique index conflict comes back
+// as ErrUsernameTaken.
+func TestRegisterUserUniqueViolation(t *testing.T) {
+	originalPrepare := prepare
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return &fakeStmt{execErr: &pq.Error{Code: "23505", Constraint: "users_username_lower_key"}}, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	err := RegisterUser(context.Background(), models.ServiceUser{Username: "alice"})
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("expected ErrUsernameTaken, got %v", err)
+	}
+}
+
+// TestQueryTimeout checks that queries run under DBQueryTimeout, or their own
+// DBQueryTimeouts entry, and that the deadline is released afterwards.
+func TestQueryTimeout(t *testing.T) {
+	originalPrepare, originalTimeout, originalTimeouts := prepare, config.DBQueryTimeout, config.DBQueryTimeouts
+	stmt := &fakeStmt{row: fakeRow{values: []any{"alice", "hashed", "Earth", "127.0.0.1"}}}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare, config.DBQueryTimeout, config.DBQueryTimeouts = originalPrepare, originalTimeout, originalTimeouts
+	})
+
+	cases := []struct {
+		name     string
+		timeout  time.Duration
+		timeouts map[string]time.Duration
+		want     time.Duration // 0: no deadline
+	}{
+		{"default", time.Minute, nil, time.Minute},
+		{"override", time.Minute, map[string]time.Duration{"GetUserByName": time.Hour}, time.Hour},
+		{"other query overridden", time.Minute, map[string]time.Duration{"GetSession": time.Hour}, time.Minute},
+		{"disabled", 0, nil, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config.DBQueryTimeout, config.DBQueryTimeouts = tc.timeout, tc.timeouts
+
+			start := time.Now()
+			if _, err := GetUserByName(context.Background(), "alice"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			deadline, ok := stmt.lastCtx.Deadline()
+			if ok != (tc.want > 0) {
+				t.Fatalf("deadline set = %v, want %v", ok, tc.want > 0)
+			}
+			if ok && (deadline.Before(start.Add(tc.want)) || deadline.After(time.Now().Add(tc.want))) {
+				t.Fatalf("deadline %v not %v after the call", deadline, tc.want)
+			}
+			if ok && stmt.lastCtx.Err() == nil {
+				t.Fatalf("query context still live after returning")
+			}
+		})
+	}
+}
+
+// TestInsertLogin checks the attempt is stored against its username, the
+// risk rules as a text array.
+func TestInsertLogin(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	rec := models.LoginRecord{Username: "alice", Time: time.Now(), IP_addr: "10.0.0.1", Risk: []string{"new_device"}}
+	if err := InsertLogin(context.Background(), rec); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stmt.lastArgs) != 11 || stmt.lastArgs[0] != "alice" || stmt.lastArgs[4] != "10.0.0.1" {
+		t.Fatalf("unexpected args: %v", stmt.lastArgs)
+	}
+	if risk, ok := stmt.lastArgs[10].(pq.StringArray); !ok || len(risk) != 1 || risk[0] != "new_device" {
+		t.Fatalf("expected the risk as a pq.StringArray, got %#v", stmt.lastArgs[10])
+	}
+}
+
+// TestListLogins checks rows are scanned, coordinates and risk included, and
+// the limit is capped.
+func TestListLogins(t *testing.T) {
+	originalPrepare := prepare
+	now := time.Now()
+	lat, lon := 52.52, 13.40
+	stmt := &fakeStmt{rows: &fakeRows{rows: []fakeRow{
+		{values: []any{int64(2), "alice", now, true, "", "10.0.0.2", "Berlin, Germany", "DE", &lat, &lon, "firefox", []byte("{new_device}")}},
+		{values: []any{int64(1), "alice", now, false, "invalid_password", "10.0.0.1", "Internet", "", (*float64)(nil), (*float64)(nil), "curl", []byte("{}")}},
+	}}}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	records, err := ListLogins(context.Background(), "alice", 10000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 2 || !records[0].Success || *records[0].Latitude != lat || records[0].Risk[0] != "new_device" {
+		t.Fatalf("unexpected first record: %+v", records[0])
+	}
+	if records[1].Reason != "invalid_password" || records[1].Latitude != nil || len(records[1].Risk) != 0 {
+		t.Fatalf("unexpected second record: %+v", records[1])
+	}
+	if len(stmt.lastArgs) != 2 || stmt.lastArgs[0] != "alice" || stmt.lastArgs[1] != maxLogins || !stmt.rows.closed {
+		t.Fatalf("unexpected query args %v or rows left open", stmt.lastArgs)
+	}
+}
+
+// TestListSuccessfulLogins checks failed attempts are filtered in the query,
+// not after the limit.
+func TestListSuccessfulLogins(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{rows: &fakeRows{}}
+	var query string
+	prepare = func(ctx context.Context, db *sql.DB, q string) (statement, error) {
+		query = q
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	if _, err := ListSuccessfulLogins(context.Background(), "alice", 50); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(query, "AND l.success") || stmt.lastArgs[1] != 50 {
+		t.Fatalf("unexpected query %q with args %v", query, stmt.lastArgs)
+	}
+}
+
+// TestUpdateProfile checks only the fields being changed are set, with their
+// values as placeholders, and that a missing user is ErrNotFound.
+func TestUpdateProfile(t *testing.T) {
+	originalPrepare := prepare
+	now := time.Now()
+	stmt := &fakeStmt{row: fakeRow{values: []any{"alice", "Alice", "", []byte(`{"a":1}`), now, &now}}}
+	var queries []string
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		queries = append(queries, query)
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	name := "Alice"
+	profile, err := UpdateProfile(context.Background(), "alice", models.ProfileUpdate{
+		DisplayName: &name,
+		Metadata:    json.RawMessage(`{"a":1}`),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if profile.DisplayName != "Alice" || string(profile.Metadata) != `{"a":1}` || profile.UpdatedAt == nil {
+		t.Fatalf("unexpected profile: %+v", profile)
+	}
+	if !strings.Contains(queries[0], "display_name = NULLIF($2, '')") || !strings.Contains(queries[0], "metadata = $3::jsonb") || strings.Contains(queries[0], "email =") {
+		t.Fatalf("unexpected query: %s", queries[0])
+	}
+	if len(stmt.lastArgs) != 3 || stmt.lastArgs[0] != "alice" || stmt.lastArgs[1] != "Alice" || stmt.lastArgs[2] != `{"a":1}` {
+		t.Fatalf("unexpected args: %v", stmt.lastArgs)
+	}
+
+	stmt.row = fakeRow{err: sql.ErrNoRows}
+	if _, err := UpdateProfile(context.Background(), "ghost", models.ProfileUpdate{DisplayName: &name}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+// TestSoftDeleteUser checks a user already deleted, or never there, is
+// ErrNotFound.
+func TestSoftDeleteUser(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{row: fakeRow{values: []any{1}}}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	if err := SoftDeleteUser(context.Background(), "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stmt.row = fakeRow{values: []any{0}}
+	if err := SoftDeleteUser(context.Background(), "alice"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+// TestPurgeDeletedUsers checks the grace period goes in as seconds.
+func TestPurgeDeletedUsers(t *testing.T) {
+	originalPrepare := prepare
+	stmt := &fakeStmt{}
+	prepare = func(ctx context.Context, db *sql.DB, query string) (statement, error) {
+		return stmt, nil
+	}
+	ACTIVE_DB = &sql.DB{}
+	t.Cleanup(func() {
+		prepare = originalPrepare
+	})
+
+	purged, err := PurgeDeletedUsers(context.Background(), 48*time.Hour)
+	if err != nil || purged != 1 {
+		t.Fatalf("expected 1 purged, got %d (%v)", purged, err)
+	}
+	if len(stmt.lastArgs) != 1 || stmt.lastArgs[0] != int64(172800) {
+		t.Fatalf("unexpected args: %v", stmt.lastArgs)
+	}
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"auth-api/models"
+	"context"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// maxLogins caps a single login_history query.
+const maxLogins = 200
+
+// InsertLogin appends a login attempt to the login_history of rec.Username.
+// An attempt on a username with no account stores nothing.
+func InsertLogin(ctx context.Context, rec models.LoginRecord) (err error) {
+	const query = `INSERT INTO login_history
+		(user_id, occurred_at, success, reason, ip_addr, location, country, latitude, longitude, user_agent, risk)
+		SELECT id, $2, $3, NULLIF($4, ''), NULLIF($5, '')::inet, NULLIF($6, ''), NULLIF($7, ''), $8, $9, NULLIF($10, ''), $11
+		FROM USERS WHERE USERNAME = $1`
+	ctx, end := startQuery(ctx, "db.InsertLogin", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx,
+		rec.Username, rec.Time, rec.Success, rec.Reason, rec.IP_addr, rec.Location,
+		rec.Country, rec.Latitude, rec.Longitude, rec.UserAgent, pq.StringArray(rec.Risk),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save login: %w", err)
+	}
+	return nil
+}
+
+// loginColumns are the login_history columns scanned by queryLogins.
+const loginColumns = `l.id, u.username, l.occurred_at, l.success, COALESCE(l.reason, ''),
+	COALESCE(host(l.ip_addr), ''), COALESCE(l.location, ''), COALESCE(l.country, ''),
+	l.latitude, l.longitude, COALESCE(l.user_agent, ''), l.risk`
+
+// ListLogins returns the newest limit login attempts of a user, newest first.
+func ListLogins(ctx context.Context, username string, limit int) (_ []models.LoginRecord, err error) {
+	const query = "SELECT " + loginColumns + ` FROM login_history l JOIN USERS u ON u.id = l.user_id
+		WHERE u.username = $1
+		ORDER BY l.occurred_at DESC, l.id DESC LIMIT $2`
+	ctx, end := startQuery(ctx, "db.ListLogins", query)
+	defer func() { end(err) }()
+
+	return queryLogins(ctx, query, username, limit)
+}
+
+// ListSuccessfulLogins is ListLogins without the failed attempts. Anyone
+// knowing the username can add those, so they must not be able to push the
+// user's real logins out of a window this size.
+func ListSuccessfulLogins(ctx context.Context, username string, limit int) (_ []models.LoginRecord, err error) {
+	const query = "SELECT " + loginColumns + ` FROM login_history l JOIN USERS u ON u.id = l.user_id
+		WHERE u.username = $1 AND l.success
+		ORDER BY l.occurred_at DESC, l.id DESC LIMIT $2`
+	ctx, end := startQuery(ctx, "db.ListSuccessfulLogins", query)
+	defer func() { end(err) }()
+
+	return queryLogins(ctx, query, username, limit)
+}
+
+// queryLogins runs a login_history query taking a username and a limit,
+// capped at maxLogins.
+func queryLogins(ctx context.Context, query, username string, limit int) ([]models.LoginRecord, error) {
+	if limit <= 0 || limit > maxLogins {
+		limit = maxLogins
+	}
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, username, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query logins: %w", err)
+	}
+	defer rows.Close()
+
+	logins := []models.LoginRecord{}
+	for rows.Next() {
+		var (
+			rec  models.LoginRecord
+			risk pq.StringArray
+		)
+		err = rows.Scan(
+			&rec.ID, &rec.Username, &rec.Time, &rec.Success, &rec.Reason,
+			&rec.IP_addr, &rec.Location, &rec.Country,
+			&rec.Latitude, &rec.Longitude, &rec.UserAgent, &risk,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan login: %w", err)
+		}
+		rec.Risk = risk
+		logins = append(logins, rec)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read logins: %w", err)
+	}
+	return logins, nil
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"auth-api/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const profileColumns = `username, COALESCE(display_name, ''), COALESCE(email, ''), metadata, created_at, updated_at`
+
+func scanProfile(row rowScanner) (*models.Profile, error) {
+	var (
+		p        models.Profile
+		metadata []byte
+	)
+	err := row.Scan(&p.Username, &p.DisplayName, &p.Email, &metadata, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.Metadata = metadata
+	return &p, nil
+}
+
+// GetProfile returns the profile of a user. No such user, or a deleted one,
+// is ErrNotFound.
+func GetProfile(ctx context.Context, username string) (_ *models.Profile, err error) {
+	const query = "SELECT " + profileColumns + " FROM USERS WHERE username = $1 AND deleted_at IS NULL"
+	ctx, end := startQuery(ctx, "db.GetProfile", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	profile, err := scanProfile(stmt.QueryRowContext(ctx, username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile: %w", err)
+	}
+	return profile, nil
+}
+
+// UpdateProfile applies update to a user's profile and returns the result.
+// No such user, or a deleted one, is ErrNotFound.
+func UpdateProfile(ctx context.Context, username string, update models.ProfileUpdate) (_ *models.Profile, err error) {
+
+	// only the SET clause varies. values always go in as placeholders
+	args := []any{username}
+	set := []string{"updated_at = now()"}
+	addSet := func(assignment string, value any) {
+		args = append(args, value)
+		set = append(set, fmt.Sprintf(assignment, len(args)))
+	}
+	if update.DisplayName != nil {
+		addSet("display_name = NULLIF($%d, '')", *update.DisplayName)
+	}
+	if update.Email != nil {
+		addSet("email = NULLIF($%d, '')", *update.Email)
+	}
+	if update.Metadata != nil {
+		addSet("metadata = $%d::jsonb", string(update.Metadata))
+	}
+	query := "UPDATE USERS SET " + strings.Join(set, ", ") +
+		" WHERE username = $1 AND deleted_at IS NULL RETURNING " + profileColumns
+
+	ctx, end := startQuery(ctx, "db.UpdateProfile", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	profile, err := scanProfile(stmt.QueryRowContext(ctx, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update profile: %w", err)
+	}
+	return profile, nil
+}
+
+// SoftDeleteUser marks a user deleted and ends all of their sessions. The
+// row stays until PurgeDeletedUsers. No such user, or one already deleted,
+// is ErrNotFound.
+func SoftDeleteUser(ctx context.Context, username string) (err error) {
+	// data modifying CTEs all run, whether the final SELECT reads them or not
+	const query = `WITH deleted AS (
+			UPDATE USERS SET deleted_at = now() WHERE username = $1 AND deleted_at IS NULL RETURNING id
+		), ended AS (
+			DELETE FROM tokens WHERE user_id IN (SELECT id FROM deleted)
+		)
+		SELECT count(*) FROM deleted`
+	ctx, end := startQuery(ctx, "db.SoftDeleteUser", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	var deleted int
+	err = stmt.QueryRowContext(ctx, username).Scan(&deleted)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteUser removes a user for good, their sessions and login history with
+// them (on delete cascade).
+func DeleteUser(ctx context.Context, username string) (err error) {
+	const query = "DELETE FROM USERS WHERE username = $1"
+	ctx, end := startQuery(ctx, "db.DeleteUser", query)
+	defer func() { end(err) }()
+
+	return execAffectingOne(ctx, query, ErrNotFound, username)
+}
+
+// PurgeDeletedUsers removes the users soft deleted more than grace ago and
+// returns how many there were.
+func PurgeDeletedUsers(ctx context.Context, grace time.Duration) (_ int64, err error) {
+	const query = "DELETE FROM USERS WHERE deleted_at < now() - $1 * interval '1 second'"
+	ctx, end := startQuery(ctx, "db.PurgeDeletedUsers", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, int64(grace.Seconds()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge deleted users: %w", err)
+	}
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	return purged, nil
+}
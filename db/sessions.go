@@ -0,0 +1,182 @@
+package db
+
+import (
+	"auth-api/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSessionNotFound is returned when a session doesn't exist, has expired,
+// or belongs to someone else. It is an ErrNotFound.
+var ErrSessionNotFound = fmt.Errorf("session %w", ErrNotFound)
+
+const sessionColumns = `t.session_id, u.username, COALESCE(t.user_agent, ''), COALESCE(host(t.ip_addr), ''),
+	t.created_at, COALESCE(t.last_used_at, t.created_at), t.expires_at, t.audience, COALESCE(t.refresh_token_hash, ''),
+	COALESCE(t.previous_refresh_token_hash, '')`
+
+func scanSession(row rowScanner) (*models.Session, error) {
+	var s models.Session
+	err := row.Scan(
+		&s.ID, &s.Username, &s.UserAgent, &s.IP_addr,
+		&s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt, &s.Audience, &s.RefreshHash,
+		&s.PreviousRefreshHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// CreateSession stores a new session for session.Username, expiring after ttl.
+func CreateSession(ctx context.Context, session models.Session, ttl time.Duration) (err error) {
+	const query = `INSERT INTO tokens
+		(session_id, user_id, jwt_token, refresh_token_hash, user_agent, ip_addr, audience, created_at, last_used_at, expires_at)
+		SELECT $1, id, $2, $3, $4, NULLIF($5, '')::inet, $8, now(), now(), now() + $6 * interval '1 second'
+		FROM USERS WHERE USERNAME = $7`
+	ctx, end := startQuery(ctx, "db.CreateSession", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx,
+		session.ID, session.AccessHash, session.RefreshHash, session.UserAgent,
+		session.IP_addr, int64(ttl.Seconds()), session.Username, session.Audience,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("failed to save session: no user %q", session.Username)
+	}
+	return nil
+}
+
+// GetSession returns an unexpired session by id.
+func GetSession(ctx context.Context, id string) (_ *models.Session, err error) {
+	const query = "SELECT " + sessionColumns + ` FROM tokens t JOIN USERS u ON u.id = t.user_id
+		WHERE t.session_id = $1 AND t.expires_at > now()`
+	ctx, end := startQuery(ctx, "db.GetSession", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	session, err := scanSession(stmt.QueryRowContext(ctx, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+	return session, nil
+}
+
+// ListSessions returns the unexpired sessions of a user, most recently used first.
+func ListSessions(ctx context.Context, username string) (_ []models.Session, err error) {
+	const query = "SELECT " + sessionColumns + ` FROM tokens t JOIN USERS u ON u.id = t.user_id
+		WHERE u.username = $1 AND t.expires_at > now()
+		ORDER BY COALESCE(t.last_used_at, t.created_at) DESC`
+	ctx, end := startQuery(ctx, "db.ListSessions", query)
+	defer func() { end(err) }()
+
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, *session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// DeleteSession removes one of username's sessions. Tokens issued for it stop
+// validating immediately.
+func DeleteSession(ctx context.Context, username, id string) (err error) {
+	const query = `DELETE FROM tokens t USING USERS u
+		WHERE t.user_id = u.id AND u.username = $1 AND t.session_id = $2`
+	ctx, end := startQuery(ctx, "db.DeleteSession", query)
+	defer func() { end(err) }()
+
+	return execAffectingOne(ctx, query, ErrSessionNotFound, username, id)
+}
+
+// TouchSession records that a session was just used.
+func TouchSession(ctx context.Context, id string) (err error) {
+	const query = "UPDATE tokens SET last_used_at = now() WHERE session_id = $1"
+	ctx, end := startQuery(ctx, "db.TouchSession", query)
+	defer func() { end(err) }()
+
+	return execAffectingOne(ctx, query, ErrSessionNotFound, id)
+}
+
+// RotateSessionTokens swaps in a new refresh token (and access token hash)
+// for a session, but only if oldRefreshHash is still the current one, so a
+// refresh token can be redeemed once. The spent one is kept as the previous
+// refresh token to recognize its reuse. The session now expires ttl from now.
+func RotateSessionTokens(ctx context.Context, id, oldRefreshHash, newRefreshHash, accessHash string, ttl time.Duration) (err error) {
+	const query = `UPDATE tokens SET previous_refresh_token_hash = refresh_token_hash,
+		refresh_token_hash = $3, jwt_token = $4, last_used_at = now(),
+		expires_at = now() + $5 * interval '1 second'
+		WHERE session_id = $1 AND refresh_token_hash = $2 AND expires_at > now()`
+	ctx, end := startQuery(ctx, "db.RotateSessionTokens", query)
+	defer func() { end(err) }()
+
+	return execAffectingOne(ctx, query, ErrSessionNotFound, id, oldRefreshHash, newRefreshHash, accessHash, int64(ttl.Seconds()))
+}
+
+// execAffectingOne runs a write that must hit a row, returning notFound when
+// it matched nothing.
+func execAffectingOne(ctx context.Context, query string, notFound error, args ...any) error {
+	db := GetDB()
+	stmt, err := prepare(ctx, db, query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return fmt.Errorf("failed to execute statement: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	if rows == 0 {
+		return notFound
+	}
+	return nil
+}
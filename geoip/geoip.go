@@ -0,0 +1,132 @@
+// Package geoip turns client IPs into a rough location ("Berlin, Germany")
+// using a local MaxMind format database.
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Unknown is the location of an IP the database has nothing on, or of
+// every IP when no database is loaded.
+const Unknown = "Internet"
+
+// Place is where the database puts an IP.
+type Place struct {
+	City        string
+	Country     string
+	CountryCode string // ISO 3166-1 alpha-2
+	Latitude    float64
+	Longitude   float64
+	HasCoords   bool // city databases only, and not for every IP
+}
+
+// String is "City, Country", just the country, or Unknown.
+func (p Place) String() string {
+	switch {
+	case p.Country == "":
+		return Unknown
+	case p.City == "":
+		return p.Country
+	}
+	return p.City + ", " + p.Country
+}
+
+// locator is the database behind Lookup, swapped for a fake in tests.
+type locator interface {
+	Locate(ip net.IP) (Place, error)
+	Close() error
+}
+
+var (
+	mu      sync.RWMutex
+	current locator
+)
+
+// Open loads the .mmdb file at path for Lookup, replacing (and closing) the
+// one loaded before. City and country databases both work, GeoLite2 or
+// GeoIP2. An empty path unloads the database.
+func Open(path string) error {
+	var next locator
+	if path != "" {
+		reader, err := geoip2.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open geoip database: %w", err)
+		}
+		next = &mmdb{Reader: reader, cities: strings.Contains(reader.Metadata().DatabaseType, "City")}
+	}
+	return swap(next)
+}
+
+// Close unloads the database.
+func Close() error {
+	return swap(nil)
+}
+
+func swap(next locator) error {
+	mu.Lock()
+	previous := current
+	current = next
+	mu.Unlock()
+
+	if previous != nil {
+		return previous.Close()
+	}
+	return nil
+}
+
+// Lookup is the location of ip: "City, Country", just the country, or
+// Unknown.
+func Lookup(ip string) string {
+	return Locate(ip).String()
+}
+
+// Locate is everything the database knows about ip, the zero Place when
+// that's nothing.
+func Locate(ip string) Place {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	parsed := net.ParseIP(ip)
+	if current == nil || parsed == nil {
+		return Place{}
+	}
+	place, err := current.Locate(parsed)
+	if err != nil {
+		return Place{}
+	}
+	return place
+}
+
+// mmdb is a locator over a MaxMind database file.
+type mmdb struct {
+	*geoip2.Reader
+	cities bool // a city database, country ones have no City records
+}
+
+func (m *mmdb) Locate(ip net.IP) (Place, error) {
+	if !m.cities {
+		record, err := m.Country(ip)
+		if err != nil {
+			return Place{}, err
+		}
+		return Place{Country: record.Country.Names["en"], CountryCode: record.Country.IsoCode}, nil
+	}
+	record, err := m.City(ip)
+	if err != nil {
+		return Place{}, err
+	}
+	return Place{
+		City:        record.City.Names["en"],
+		Country:     record.Country.Names["en"],
+		CountryCode: record.Country.IsoCode,
+		Latitude:    record.Location.Latitude,
+		Longitude:   record.Location.Longitude,
+		// 0,0 is what a record without a location decodes to
+		HasCoords: record.Location.Latitude != 0 || record.Location.Longitude != 0,
+	}, nil
+}
@@ -0,0 +1,75 @@
+package geoip
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeLocator answers from a map keyed by IP.
+type fakeLocator struct {
+	places map[string]Place
+	err    error
+	closed bool
+}
+
+func (f *fakeLocator) Locate(ip net.IP) (Place, error) {
+	return f.places[ip.String()], f.err
+}
+
+func (f *fakeLocator) Close() error {
+	f.closed = true
+	return nil
+}
+
+// TestLookup formats what the database knows, falling back to Unknown.
+func TestLookup(t *testing.T) {
+	berlin := Place{City: "Berlin", Country: "Germany", CountryCode: "DE", Latitude: 52.5, Longitude: 13.4, HasCoords: true}
+	fake := &fakeLocator{places: map[string]Place{
+		"198.51.100.1": berlin,
+		"198.51.100.2": {Country: "France", CountryCode: "FR"},
+	}}
+	swap(fake)
+	t.Cleanup(func() {
+		Close()
+	})
+
+	cases := map[string]string{
+		"198.51.100.1": "Berlin, Germany",
+		"198.51.100.2": "France",
+		"203.0.113.9":  Unknown,
+		"not an ip":    Unknown,
+	}
+	for ip, want := range cases {
+		if got := Lookup(ip); got != want {
+			t.Errorf("Lookup(%q) = %q, want %q", ip, got, want)
+		}
+	}
+
+	if got := Locate("198.51.100.1"); got != berlin {
+		t.Errorf("Locate = %+v, want %+v", got, berlin)
+	}
+
+	fake.err = errors.New("corrupt database")
+	if got := Lookup("198.51.100.1"); got != Unknown {
+		t.Errorf("Lookup with a failing database = %q, want %q", got, Unknown)
+	}
+
+	Close()
+	if !fake.closed {
+		t.Fatalf("expected Close to close the database")
+	}
+	if got := Lookup("198.51.100.1"); got != Unknown {
+		t.Fatalf("Lookup without a database = %q, want %q", got, Unknown)
+	}
+}
+
+// TestOpenMissingFile surfaces a bad GEOIP_DB path instead of running without.
+func TestOpenMissingFile(t *testing.T) {
+	if err := Open(t.TempDir() + "/missing.mmdb"); err == nil {
+		t.Fatalf("expected an error for a missing file")
+	}
+	if err := Open(""); err != nil {
+		t.Fatalf("Open(\"\") = %v, want nil", err)
+	}
+}
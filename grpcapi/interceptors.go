@@ -0,0 +1,121 @@
+package grpcapi
+
+import (
+	"auth-api/auth"
+	"auth-api/grpcapi/authpb"
+	"auth-api/logging"
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// requestIDKey is the metadata twin of middleware.RequestIDHeader.
+const requestIDKey = "x-request-id"
+
+// PublicMethods are the AuthService methods callable without a bearer
+// token: they take their credentials in the message.
+var PublicMethods = []string{
+	authpb.AuthService_Register_FullMethodName,
+	authpb.AuthService_Login_FullMethodName,
+	authpb.AuthService_Refresh_FullMethodName,
+	authpb.AuthService_Validate_FullMethodName,
+}
+
+// Interceptors returns a unary and a stream interceptor, the gRPC
+// counterparts of CheckJwt plus the request id and access log middleware.
+// Every method needs a valid bearer token, except those listed in public
+// (full method names, "/package.Service/Method"). Forgetting one locks it
+// down instead of opening it up.
+func Interceptors(public ...string) (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	open := make(map[string]bool, len(public))
+	for _, method := range public {
+		open[method] = true
+	}
+
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		ctx = withRequestID(ctx)
+
+		var err error
+		if !open[info.FullMethod] {
+			ctx, err = authorize(ctx)
+		}
+		var resp any
+		if err == nil {
+			resp, err = handler(ctx, req)
+		}
+		logCall(ctx, info.FullMethod, start, err)
+		return resp, err
+	}
+
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		ctx := withRequestID(ss.Context())
+
+		var err error
+		if !open[info.FullMethod] {
+			ctx, err = authorize(ctx)
+		}
+		if err == nil {
+			err = handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+		}
+		logCall(ctx, info.FullMethod, start, err)
+		return err
+	}
+	return unary, stream
+}
+
+// contextStream swaps the context of a ServerStream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// authorize checks the call's bearer token and puts the user and session in
+// the context.
+func authorize(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return ctx, status.Error(codes.Unauthenticated, "no auth token")
+	}
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok {
+		return ctx, status.Error(codes.Unauthenticated, "corrupt token format")
+	}
+
+	claims, err := authenticate(ctx, token)
+	if err != nil {
+		return ctx, err
+	}
+	ctx = auth.WithUser(ctx, claims.Subject)
+	return auth.WithSessionID(ctx, claims.SessionID), nil
+}
+
+// withRequestID keeps the caller's x-request-id if the HTTP middleware would
+// accept it, or makes one up.
+func withRequestID(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(requestIDKey); len(values) > 0 && logging.ValidRequestID(values[0]) {
+		return logging.WithRequestID(ctx, values[0])
+	}
+	return logging.WithRequestID(ctx, logging.NewRequestID())
+}
+
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	slog.InfoContext(ctx, "grpc request",
+		"method", method,
+		"code", status.Code(err).String(),
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+}
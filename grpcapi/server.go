@@ -0,0 +1,355 @@
+// Package grpcapi serves the auth API over gRPC: register, login, refresh,
+// validate and revoke, backed by the same users, sessions and tokens as the
+// HTTP handlers.
+package grpcapi
+
+//go:generate sh -c "cd .. && buf generate"
+
+import (
+	"auth-api/audit"
+	"auth-api/auth"
+	"auth-api/clientip"
+	"auth-api/config"
+	"auth-api/db"
+	"auth-api/geoip"
+	"auth-api/grpcapi/authpb"
+	"auth-api/logging"
+	"auth-api/logins"
+	"auth-api/metrics"
+	"auth-api/models"
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// storage and token functions, overridden in tests
+	getUserByName       = db.GetUserByName
+	confusableUsername  = db.ConfusableUsername
+	registerUser        = db.RegisterUser
+	createSession       = db.CreateSession
+	updatePasswordHash  = db.UpdatePasswordHash
+	getSession          = db.GetSession
+	deleteSession       = db.DeleteSession
+	rotateSessionTokens = db.RotateSessionTokens
+	createJWT           = auth.CreateJWT
+	parseJWT            = auth.ParseJWT
+	assessRisk          = logins.Assess
+	recordLogin         = logins.Record
+)
+
+// Server implements authpb.AuthServiceServer.
+type Server struct {
+	authpb.UnimplementedAuthServiceServer
+}
+
+// NewServer returns a gRPC server with the auth service and our
+// interceptors registered.
+func NewServer(opts ...grpc.ServerOption) *grpc.Server {
+	unary, stream := Interceptors(PublicMethods...)
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(unary),
+		grpc.ChainStreamInterceptor(stream),
+	)
+	server := grpc.NewServer(opts...)
+	authpb.RegisterAuthServiceServer(server, &Server{})
+	return server
+}
+
+// Register creates an account.
+func (s *Server) Register(ctx context.Context, req *authpb.RegisterRequest) (_ *authpb.RegisterResponse, err error) {
+	username := auth.NormalizeUsername(req.GetUsername())
+	reason := "ok"
+	defer func() {
+		outcome := outcomeOf(reason)
+		metrics.Registrations.WithLabelValues(outcome, reason).Inc()
+		event := newEvent(ctx, audit.EventRegister)
+		event.Actor = username
+		event.Outcome = outcome
+		if outcome == metrics.OutcomeFailure {
+			event.Reason = reason
+		}
+		audit.Record(ctx, event)
+	}()
+
+	if username == "" || req.GetPassword() == "" {
+		reason = "bad_request"
+		return nil, status.Error(codes.InvalidArgument, "username and password required")
+	}
+	if err := auth.ValidateUsername(username); err != nil {
+		reason = "bad_request"
+		return nil, status.Error(codes.InvalidArgument, "username "+err.Error())
+	}
+
+	// hash first, like the HTTP handler, so taken and free names cost the same
+	hashed, err := auth.HashPassword(ctx, req.GetPassword())
+	if err != nil {
+		reason = "hash_error"
+		return nil, internal(ctx, "error hashing password", err)
+	}
+
+	concealed := &authpb.RegisterResponse{Message: "registration received. if the username was available you can now log in"}
+	existing, err := getUserByName(ctx, username)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		reason = "db_error"
+		return nil, internal(ctx, "failed to check username", err)
+	}
+	if existing == nil {
+		lookalike, err := confusableUsername(ctx, username)
+		if err != nil {
+			reason = "db_error"
+			return nil, internal(ctx, "failed to check username", err)
+		}
+		if lookalike != "" {
+			existing = &models.ServiceUser{Username: lookalike}
+		}
+	}
+	// the insert has the final say: a concurrent registration can still win
+	if existing == nil {
+		ip := peerIP(ctx)
+		err = registerUser(ctx, models.ServiceUser{
+			Username: username,
+			Password: hashed,
+			IP_addr:  ip,
+			Location: geoip.Lookup(ip),
+		})
+	}
+	if existing != nil || errors.Is(err, db.ErrUsernameTaken) {
+		reason = "username_taken"
+		if config.RegisterConcealExisting {
+			return concealed, nil
+		}
+		return nil, status.Error(codes.AlreadyExists, "username taken. pick another")
+	}
+	if err != nil {
+		reason = "db_error"
+		return nil, internal(ctx, "failed to register user", err)
+	}
+	if config.RegisterConcealExisting {
+		return concealed, nil
+	}
+	return &authpb.RegisterResponse{Message: "user created successfully. proceed to login"}, nil
+}
+
+// Login checks credentials and starts a session, through the same flow as
+// the HTTP handler. Unknown users and wrong passwords get the same answer
+// after the same amount of work.
+func (s *Server) Login(ctx context.Context, req *authpb.LoginRequest) (*authpb.TokenResponse, error) {
+	attempt := logins.Attempt{
+		Store: logins.Store{
+			GetUserByName:      getUserByName,
+			UpdatePasswordHash: updatePasswordHash,
+			CreateSession:      createSession,
+			CreateJWT:          createJWT,
+			Assess:             assessRisk,
+			Record:             recordLogin,
+		},
+		Username:  auth.NormalizeUsername(req.GetUsername()),
+		Password:  req.GetPassword(),
+		Audience:  req.GetAudience(),
+		IP:        peerIP(ctx),
+		UserAgent: userAgent(ctx),
+	}
+	defer attempt.Finish(ctx)
+
+	tokens, err := attempt.Run(ctx)
+	switch {
+	case err == nil:
+		return tokenResponse(tokens), nil
+	case errors.Is(err, auth.ErrUnknownAudience):
+		return nil, status.Error(codes.InvalidArgument, "unknown audience")
+	case errors.Is(err, logins.ErrInvalidCredentials):
+		return nil, status.Error(codes.Unauthenticated, "invalid username or password")
+	case errors.Is(err, logins.ErrStepUpRequired):
+		return nil, status.Error(codes.Unauthenticated, "login needs additional verification")
+	case attempt.Reason == "token_error":
+		return nil, internal(ctx, "failed to create jwt", err)
+	default:
+		return nil, internal(ctx, "failed to log in", err)
+	}
+}
+
+// Refresh trades a refresh token for a new pair. The refresh token spent by
+// the last refresh ends the session, any other wrong one is just refused, as
+// over HTTP.
+func (s *Server) Refresh(ctx context.Context, req *authpb.RefreshRequest) (*authpb.TokenResponse, error) {
+	invalid := status.Error(codes.Unauthenticated, "invalid refresh token")
+
+	sessionID, ok := auth.SessionIDFromRefreshToken(req.GetRefreshToken())
+	if !ok {
+		return nil, invalid
+	}
+	session, err := getSession(ctx, sessionID)
+	if errors.Is(err, db.ErrSessionNotFound) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, internal(ctx, "failed to refresh token", err)
+	}
+
+	switch auth.CheckRefreshToken(req.GetRefreshToken(), session.RefreshHash, session.PreviousRefreshHash) {
+	case auth.RefreshReused:
+		revokeSession(ctx, session.Username, session.ID, "refresh_token_reuse")
+		return nil, invalid
+	case auth.RefreshUnknown:
+		return nil, invalid
+	}
+	oldHash := session.RefreshHash
+
+	jwtResp, err := createJWT(ctx, session.Username, session.ID, session.Audience)
+	if err == nil {
+		jwtResp.RefreshToken, err = auth.NewRefreshToken(session.ID)
+	}
+	if err != nil {
+		return nil, internal(ctx, "failed to refresh token", err)
+	}
+
+	err = rotateSessionTokens(ctx, session.ID, oldHash,
+		auth.HashToken(jwtResp.RefreshToken), auth.HashToken(jwtResp.AccessToken), config.RefreshTokenTTL)
+	if errors.Is(err, db.ErrSessionNotFound) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, internal(ctx, "failed to refresh token", err)
+	}
+	return tokenResponse(jwtResp), nil
+}
+
+// Validate checks an access token the same way CheckJwt does, session
+// included.
+func (s *Server) Validate(ctx context.Context, req *authpb.ValidateRequest) (*authpb.ValidateResponse, error) {
+	claims, err := authenticate(ctx, req.GetAccessToken())
+	if err != nil {
+		return nil, err
+	}
+	resp := &authpb.ValidateResponse{
+		Subject:   claims.Subject,
+		SessionId: claims.SessionID,
+		Audience:  claims.Audience,
+	}
+	if claims.ExpiresAt != nil {
+		resp.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	return resp, nil
+}
+
+// Revoke ends one of the caller's sessions.
+func (s *Server) Revoke(ctx context.Context, req *authpb.RevokeRequest) (*authpb.RevokeResponse, error) {
+	username := auth.UserFromContext(ctx)
+	sessionID := req.GetSessionId()
+	reason := ""
+	if sessionID == "" {
+		sessionID = auth.SessionIDFromContext(ctx)
+		reason = "logout"
+	}
+
+	err := revokeSession(ctx, username, sessionID, reason)
+	if errors.Is(err, db.ErrSessionNotFound) {
+		return nil, status.Error(codes.NotFound, "session not found")
+	}
+	if err != nil {
+		return nil, internal(ctx, "failed to revoke session", err)
+	}
+	return &authpb.RevokeResponse{}, nil
+}
+
+// revokeSession deletes a session and audits it.
+func revokeSession(ctx context.Context, username, sessionID, reason string) error {
+	err := deleteSession(ctx, username, sessionID)
+
+	event := newEvent(ctx, audit.EventTokenRevoked)
+	event.Actor = username
+	event.Target = sessionID
+	event.Reason = reason
+	event.Outcome = audit.OutcomeSuccess
+	if err != nil {
+		event.Outcome = audit.OutcomeFailure
+	}
+	audit.Record(ctx, event)
+	return err
+}
+
+// authenticate validates token and its session, returning gRPC status errors.
+func authenticate(ctx context.Context, token string) (*auth.Claims, error) {
+	claims, err := parseJWT(ctx, token)
+	if errors.Is(err, auth.ErrTokenExpired) {
+		return nil, status.Error(codes.Unauthenticated, "token expired")
+	}
+	if errors.Is(err, auth.ErrInvalidToken) {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	if err != nil {
+		return nil, internal(ctx, "failed to validate auth token", err)
+	}
+
+	if claims.SessionID == "" {
+		return nil, status.Error(codes.Unauthenticated, "session revoked or expired")
+	}
+	session, err := getSession(ctx, claims.SessionID)
+	if errors.Is(err, db.ErrSessionNotFound) || (err == nil && session.Username != claims.Subject) {
+		return nil, status.Error(codes.Unauthenticated, "session revoked or expired")
+	}
+	if err != nil {
+		return nil, internal(ctx, "failed to validate auth token", err)
+	}
+	return claims, nil
+}
+
+// internal logs err and hides it behind a generic Internal status.
+func internal(ctx context.Context, msg string, err error) error {
+	slog.ErrorContext(ctx, msg, "error", err)
+	return status.Error(codes.Internal, msg)
+}
+
+func tokenResponse(resp auth.JWTResponse) *authpb.TokenResponse {
+	return &authpb.TokenResponse{
+		AccessToken:  resp.AccessToken,
+		TokenType:    resp.TokenType,
+		ExpiresIn:    int64(resp.ExpiresIn),
+		RefreshToken: resp.RefreshToken,
+	}
+}
+
+func outcomeOf(reason string) string {
+	if reason == "ok" {
+		return metrics.OutcomeSuccess
+	}
+	return metrics.OutcomeFailure
+}
+
+// newEvent is audit.FromRequest for gRPC calls.
+func newEvent(ctx context.Context, eventType string) models.AuditEvent {
+	return models.AuditEvent{
+		Time:      time.Now().UTC(),
+		Type:      eventType,
+		IP_addr:   peerIP(ctx),
+		UserAgent: userAgent(ctx),
+		RequestID: logging.RequestID(ctx),
+	}
+}
+
+// peerIP is the caller's address without the port. Behind a trusted proxy
+// it is the client's, taken from the forwarding metadata, see clientip.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	return clientip.Resolve(p.Addr.String(), md.Get(clientip.ProxyHeader()))
+}
+
+func userAgent(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("user-agent"); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,335 @@
+package grpcapi
+
+import (
+	"auth-api/auth"
+	"auth-api/db"
+	"auth-api/grpcapi/authpb"
+	"auth-api/logging"
+	"auth-api/logins"
+	"auth-api/models"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeStore keeps users and sessions in memory in place of the db.
+type fakeStore struct {
+	users    map[string]models.ServiceUser
+	sessions map[string]models.Session
+	logins   []models.LoginRecord
+	stepUp   bool // what the risk rules say about every login
+}
+
+// newTestClient starts the service on an in-memory listener with the store
+// and token functions stubbed.
+func newTestClient(t *testing.T) (authpb.AuthServiceClient, *fakeStore) {
+	t.Helper()
+	hashed, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	store := &fakeStore{
+		users:    map[string]models.ServiceUser{"alice": {Username: "alice", Password: string(hashed)}},
+		sessions: map[string]models.Session{},
+	}
+
+	origGetUser, origRegister, origCreate, origGet := getUserByName, registerUser, createSession, getSession
+	origDelete, origRotate, origCreateJWT, origParseJWT := deleteSession, rotateSessionTokens, createJWT, parseJWT
+	origConfusable, origAssess, origRecord, origUpdate := confusableUsername, assessRisk, recordLogin, updatePasswordHash
+	getUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		if user, ok := store.users[username]; ok {
+			return &user, nil
+		}
+		return nil, db.ErrNotFound
+	}
+	confusableUsername = func(ctx context.Context, username string) (string, error) {
+		for name := range store.users {
+			if auth.UsernameSkeleton(name) == auth.UsernameSkeleton(username) {
+				return name, nil
+			}
+		}
+		return "", nil
+	}
+	registerUser = func(ctx context.Context, user models.ServiceUser) error {
+		store.users[user.Username] = user
+		return nil
+	}
+	updatePasswordHash = func(ctx context.Context, username, hashed string) error {
+		user := store.users[username]
+		user.Password = hashed
+		store.users[username] = user
+		return nil
+	}
+	createSession = func(ctx context.Context, session models.Session, ttl time.Duration) error {
+		store.sessions[session.ID] = session
+		return nil
+	}
+	getSession = func(ctx context.Context, id string) (*models.Session, error) {
+		if session, ok := store.sessions[id]; ok {
+			return &session, nil
+		}
+		return nil, db.ErrSessionNotFound
+	}
+	deleteSession = func(ctx context.Context, username, id string) error {
+		if session, ok := store.sessions[id]; ok && session.Username == username {
+			delete(store.sessions, id)
+			return nil
+		}
+		return db.ErrSessionNotFound
+	}
+	rotateSessionTokens = func(ctx context.Context, id, oldHash, newHash, accessHash string, ttl time.Duration) error {
+		session, ok := store.sessions[id]
+		if !ok || session.RefreshHash != oldHash {
+			return db.ErrSessionNotFound
+		}
+		session.PreviousRefreshHash, session.RefreshHash = session.RefreshHash, newHash
+		store.sessions[id] = session
+		return nil
+	}
+	assessRisk = func(ctx context.Context, rec *models.LoginRecord) bool {
+		if store.stepUp {
+			rec.Risk = []string{logins.RuleNewDevice}
+		}
+		return store.stepUp
+	}
+	recordLogin = func(ctx context.Context, rec models.LoginRecord) {
+		store.logins = append(store.logins, rec)
+	}
+	// tokens are "<user>|<session>" so the test needs no signing secret
+	createJWT = func(ctx context.Context, username, sessionID, audience string) (auth.JWTResponse, error) {
+		return auth.JWTResponse{AccessToken: username + "|" + sessionID, TokenType: "bearer", ExpiresIn: 900}, nil
+	}
+	parseJWT = func(ctx context.Context, token string) (*auth.Claims, error) {
+		username, sessionID, ok := strings.Cut(token, "|")
+		if !ok {
+			return nil, auth.ErrTokenMalformed
+		}
+		return &auth.Claims{SessionID: sessionID, RegisteredClaims: jwt.RegisteredClaims{Subject: username}}, nil
+	}
+
+	listener := bufconn.Listen(1 << 20)
+	server := NewServer()
+	go server.Serve(listener)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+		getUserByName, registerUser, createSession, getSession = origGetUser, origRegister, origCreate, origGet
+		deleteSession, rotateSessionTokens, createJWT, parseJWT = origDelete, origRotate, origCreateJWT, origParseJWT
+		confusableUsername, assessRisk, recordLogin, updatePasswordHash = origConfusable, origAssess, origRecord, origUpdate
+	})
+	return authpb.NewAuthServiceClient(conn), store
+}
+
+// TestRegisterAndLogin covers account creation, the uniform login failure
+// and a successful login.
+func TestRegisterAndLogin(t *testing.T) {
+	client, store := newTestClient(t)
+	ctx := context.Background()
+
+	if _, err := client.Register(ctx, &authpb.RegisterRequest{Username: "bob", Password: "pw"}); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if _, ok := store.users["bob"]; !ok {
+		t.Fatalf("expected bob to be stored")
+	}
+	for _, name := range []string{"bob", "BOB", "b0b"} {
+		_, err := client.Register(ctx, &authpb.RegisterRequest{Username: name, Password: "pw"})
+		if status.Code(err) != codes.AlreadyExists {
+			t.Fatalf("%s: expected AlreadyExists, got %v", name, err)
+		}
+	}
+	_, err := client.Register(ctx, &authpb.RegisterRequest{Username: "carol"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+
+	_, wrongPassword := client.Login(ctx, &authpb.LoginRequest{Username: "alice", Password: "nope"})
+	_, unknownUser := client.Login(ctx, &authpb.LoginRequest{Username: "mallory", Password: "nope"})
+	if status.Code(wrongPassword) != codes.Unauthenticated || status.Convert(wrongPassword).Message() != status.Convert(unknownUser).Message() {
+		t.Fatalf("expected identical Unauthenticated errors, got %v and %v", wrongPassword, unknownUser)
+	}
+
+	tokens, err := client.Login(ctx, &authpb.LoginRequest{Username: "alice", Password: "password123"})
+	if err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+	if tokens.GetRefreshToken() == "" || tokens.GetExpiresIn() != 900 || len(store.sessions) != 1 {
+		t.Fatalf("unexpected tokens %+v with %d sessions", tokens, len(store.sessions))
+	}
+	// alice's two attempts are in her history, mallory has none
+	if len(store.logins) != 2 || store.logins[0].Reason != "invalid_password" || !store.logins[1].Success {
+		t.Fatalf("unexpected login history: %+v", store.logins)
+	}
+}
+
+// TestLoginStepUp checks a login the risk rules want stepped up is refused
+// without a session.
+func TestLoginStepUp(t *testing.T) {
+	client, store := newTestClient(t)
+	store.stepUp = true
+
+	_, err := client.Login(context.Background(), &authpb.LoginRequest{Username: "alice", Password: "password123"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated, got %v", err)
+	}
+	if len(store.sessions) != 0 {
+		t.Fatalf("expected no session, got %d", len(store.sessions))
+	}
+	if len(store.logins) != 1 || store.logins[0].Reason != "step_up_required" || len(store.logins[0].Risk) != 1 {
+		t.Fatalf("unexpected login history: %+v", store.logins)
+	}
+}
+
+// TestLoginRehash checks a login upgrades a hash below the configured cost,
+// as over HTTP.
+func TestLoginRehash(t *testing.T) {
+	client, store := newTestClient(t)
+	old := store.users["alice"].Password
+
+	if _, err := client.Login(context.Background(), &authpb.LoginRequest{Username: "alice", Password: "password123"}); err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+	upgraded := store.users["alice"].Password
+	if upgraded == old || auth.NeedsRehash(upgraded) {
+		t.Fatalf("expected the MinCost hash to be upgraded, got %q", upgraded)
+	}
+	if err := auth.ComparePassword(context.Background(), upgraded, "password123"); err != nil {
+		t.Fatalf("upgraded hash does not match the password: %v", err)
+	}
+}
+
+// TestRefreshValidateRevoke covers the session lifecycle, including the
+// bearer check of the interceptor.
+func TestRefreshValidateRevoke(t *testing.T) {
+	client, store := newTestClient(t)
+	ctx := context.Background()
+
+	tokens, err := client.Login(ctx, &authpb.LoginRequest{Username: "alice", Password: "password123"})
+	if err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+
+	refreshed, err := client.Refresh(ctx, &authpb.RefreshRequest{RefreshToken: tokens.GetRefreshToken()})
+	if err != nil || refreshed.GetRefreshToken() == tokens.GetRefreshToken() {
+		t.Fatalf("expected a new refresh token, got %+v (%v)", refreshed, err)
+	}
+
+	claims, err := client.Validate(ctx, &authpb.ValidateRequest{AccessToken: refreshed.GetAccessToken()})
+	if err != nil || claims.GetSubject() != "alice" {
+		t.Fatalf("expected alice's token to validate, got %+v (%v)", claims, err)
+	}
+
+	if _, err := client.Revoke(ctx, &authpb.RevokeRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Revoke without a token to be refused, got %v", err)
+	}
+	authed := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+refreshed.GetAccessToken())
+	if _, err := client.Revoke(authed, &authpb.RevokeRequest{}); err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	if len(store.sessions) != 0 {
+		t.Fatalf("expected the session to be gone, got %v", store.sessions)
+	}
+
+	if _, err := client.Validate(ctx, &authpb.ValidateRequest{AccessToken: refreshed.GetAccessToken()}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected a revoked session's token to be refused, got %v", err)
+	}
+}
+
+// TestRefreshReuse checks a spent refresh token ends the session.
+func TestRefreshReuse(t *testing.T) {
+	client, store := newTestClient(t)
+	ctx := context.Background()
+
+	tokens, err := client.Login(ctx, &authpb.LoginRequest{Username: "alice", Password: "password123"})
+	if err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+	if _, err := client.Refresh(ctx, &authpb.RefreshRequest{RefreshToken: tokens.GetRefreshToken()}); err != nil {
+		t.Fatalf("Refresh returned error: %v", err)
+	}
+	if _, err := client.Refresh(ctx, &authpb.RefreshRequest{RefreshToken: tokens.GetRefreshToken()}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected the spent token to be refused, got %v", err)
+	}
+	if len(store.sessions) != 0 {
+		t.Fatalf("expected reuse to end the session")
+	}
+}
+
+// TestRefreshForged checks a made up refresh token for a known session id is
+// refused without ending the session.
+func TestRefreshForged(t *testing.T) {
+	client, store := newTestClient(t)
+	ctx := context.Background()
+
+	tokens, err := client.Login(ctx, &authpb.LoginRequest{Username: "alice", Password: "password123"})
+	if err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+	sessionID, _ := auth.SessionIDFromRefreshToken(tokens.GetRefreshToken())
+	if _, err := client.Refresh(ctx, &authpb.RefreshRequest{RefreshToken: sessionID + ".x"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected the forged token to be refused, got %v", err)
+	}
+	if len(store.sessions) != 1 {
+		t.Fatalf("expected the session to survive a forged token")
+	}
+	if _, err := client.Refresh(ctx, &authpb.RefreshRequest{RefreshToken: tokens.GetRefreshToken()}); err != nil {
+		t.Fatalf("expected the real token to still refresh, got %v", err)
+	}
+}
+
+// TestInterceptorsDenyByDefault checks a method the interceptors weren't
+// told is public needs a token, whichever service it belongs to.
+func TestInterceptorsDenyByDefault(t *testing.T) {
+	unary, _ := Interceptors("/other.v1.Service/Public")
+	called := false
+	handler := func(ctx context.Context, req any) (any, error) {
+		called = true
+		return "ok", nil
+	}
+
+	_, err := unary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/other.v1.Service/Private"}, handler)
+	if status.Code(err) != codes.Unauthenticated || called {
+		t.Fatalf("expected an unlisted method to need a token, got %v", err)
+	}
+	if _, err := unary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/other.v1.Service/Public"}, handler); err != nil || !called {
+		t.Fatalf("expected the public method to go through, got %v", err)
+	}
+}
+
+// TestWithRequestID keeps a usable x-request-id and replaces one the HTTP
+// middleware would refuse.
+func TestWithRequestID(t *testing.T) {
+	for incoming, keep := range map[string]bool{
+		"abc-123":                true,
+		"abc\x1b[31m":            false,
+		"line\nbreak":            false,
+		strings.Repeat("a", 129): false,
+	} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDKey, incoming))
+		got := logging.RequestID(withRequestID(ctx))
+		if (got == incoming) != keep || got == "" {
+			t.Errorf("%q: got request id %q", incoming, got)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"auth-api/audit"
+	"auth-api/auth"
+	"auth-api/db"
+	"auth-api/models"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// queryAuditEvents is overridden in tests.
+var queryAuditEvents = db.QueryAuditEvents
+
+// AuditResponse is the body returned by GET /admin/audit.
+type AuditResponse struct {
+	Count  int                 `json:"count"`
+	Events []models.AuditEvent `json:"events"`
+}
+
+// AuditHandler serves GET /admin/audit for admins. Optional query params:
+// type, actor, outcome, since and until (RFC 3339) and limit.
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+
+	resp := Response{Status: http.StatusBadRequest, Code: CodeInvalidRequest}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		resp.Message = err.Error()
+		WriteResponse(w, &resp)
+		return
+	}
+
+	events, err := queryAuditEvents(r.Context(), filter)
+
+	// looking at the audit log is itself an admin action worth recording
+	event := audit.FromRequest(r, audit.EventAdminAction)
+	event.Actor = auth.UserFromContext(r.Context())
+	event.Target = "audit_events"
+	event.Outcome = audit.OutcomeSuccess
+	if err != nil {
+		event.Outcome = audit.OutcomeFailure
+		event.Reason = "db_error"
+	}
+	audit.Record(r.Context(), event)
+
+	if err != nil {
+		resp.Message = "failed to query audit events"
+		resp.Status = http.StatusInternalServerError
+		resp.Code = CodeInternal
+		resp.Error = err
+		logFailure(r, &resp)
+		WriteResponse(w, &resp)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, AuditResponse{Count: len(events), Events: events})
+}
+
+func parseAuditFilter(r *http.Request) (models.AuditFilter, error) {
+	q := r.URL.Query()
+	filter := models.AuditFilter{
+		Type:    q.Get("type"),
+		Actor:   q.Get("actor"),
+		Outcome: q.Get("outcome"),
+	}
+
+	var err error
+	if v := q.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, fmt.Errorf("since must be an RFC 3339 timestamp")
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, fmt.Errorf("until must be an RFC 3339 timestamp")
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 {
+			return filter, fmt.Errorf("limit must be a positive integer")
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"auth-api/auth"
+	"auth-api/config"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Cookie session mode: /login?mode=cookie hands the tokens out as cookies
+// the page's scripts can't read. Since the browser then sends them on its
+// own, state changing requests also have to echo the (readable) CSRF cookie
+// in the X-CSRF-Token header, which a foreign site can't do.
+const (
+	AccessCookie  = "access_token"
+	RefreshCookie = "refresh_token"
+	CSRFCookie    = "csrf_token"
+	CSRFHeader    = "X-CSRF-Token"
+
+	// the refresh token is only ever needed by /refresh
+	refreshCookiePath = "/refresh"
+)
+
+// CookieSession is what /login and /refresh return in cookie mode instead of
+// the tokens. The CSRF token is repeated here for frontends on another
+// origin, which can't read our cookies.
+type CookieSession struct {
+	ExpiresIn int    `json:"expires_in"`
+	CSRFToken string `json:"csrf_token"`
+}
+
+// setSessionCookies sets tokens as cookies along with a fresh CSRF token.
+func setSessionCookies(w http.ResponseWriter, tokens auth.JWTResponse) (CookieSession, error) {
+	csrf, err := auth.NewCSRFToken()
+	if err != nil {
+		return CookieSession{}, err
+	}
+
+	accessTTL := time.Duration(tokens.ExpiresIn) * time.Second
+	http.SetCookie(w, sessionCookie(AccessCookie, tokens.AccessToken, "/", accessTTL, true))
+	http.SetCookie(w, sessionCookie(RefreshCookie, tokens.RefreshToken, refreshCookiePath, config.RefreshTokenTTL, true))
+	http.SetCookie(w, sessionCookie(CSRFCookie, csrf, "/", config.RefreshTokenTTL, false))
+	return CookieSession{ExpiresIn: tokens.ExpiresIn, CSRFToken: csrf}, nil
+}
+
+// clearSessionCookies tells the browser to drop the session cookies.
+func clearSessionCookies(w http.ResponseWriter) {
+	http.SetCookie(w, sessionCookie(AccessCookie, "", "/", -1, true))
+	http.SetCookie(w, sessionCookie(RefreshCookie, "", refreshCookiePath, -1, true))
+	http.SetCookie(w, sessionCookie(CSRFCookie, "", "/", -1, false))
+}
+
+// sessionCookie builds one of our cookies. A negative ttl deletes it.
+func sessionCookie(name, value, path string, ttl time.Duration, httpOnly bool) *http.Cookie {
+	maxAge := int(ttl.Seconds())
+	if ttl < 0 {
+		maxAge = -1
+	}
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   config.CookieDomain,
+		MaxAge:   maxAge,
+		HttpOnly: httpOnly,
+		Secure:   config.CookieSecure,
+		SameSite: cookieSameSite(),
+	}
+}
+
+// cookieSameSite maps config.CookieSameSite, strict for anything unknown.
+func cookieSameSite() http.SameSite {
+	switch strings.ToLower(config.CookieSameSite) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteStrictMode
+}
+
+// SafeMethod reports whether method can't change state, so needs no CSRF token.
+func SafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// ValidCSRF reports whether r carries the CSRF token of its cookie session
+// in the X-CSRF-Token header.
+func ValidCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(CSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(CSRFHeader)
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
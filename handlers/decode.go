@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"auth-api/auth"
+	"auth-api/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// errEmptyBody is returned by decodeJSON for a request without a body.
+var errEmptyBody = errors.New("request body required")
+
+// credentials is the body of /register and /login.
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// RequestError is a request decodeJSON or a validator refused. It carries
+// everything the problem response needs.
+type RequestError struct {
+	Status  int
+	Code    string
+	Message string
+	Fields  []FieldError
+	Err     error
+}
+
+func (e *RequestError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// badRequest fills resp with the problem for a decodeJSON or validation
+// error.
+func badRequest(resp *Response, err error) {
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) {
+		reqErr = &RequestError{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: "invalid request body", Err: err}
+	}
+	resp.Status = reqErr.Status
+	resp.Code = reqErr.Code
+	resp.Message = reqErr.Message
+	resp.Fields = reqErr.Fields
+	resp.Error = reqErr
+}
+
+// decodeJSON decodes the body of r into dst, strictly: it has to be
+// application/json, at most config.MaxBodyBytes, a single JSON value and
+// have no fields dst doesn't know. A missing body is errEmptyBody, any
+// other failure a *RequestError.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return decodeError(io.EOF)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return &RequestError{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    CodeUnsupportedMedia,
+			Message: "Content-Type must be application/json",
+			Err:     err,
+		}
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, config.MaxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return decodeError(err)
+	}
+	// exactly one value: `{...}{...}` or `{...} junk` is a client bug
+	if err := dec.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return decodeError(err)
+		}
+		return &RequestError{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: "unexpected data after the JSON body", Err: err}
+	}
+	return nil
+}
+
+// decodeError explains a json.Decoder failure, pointing at the field where
+// there is one.
+func decodeError(err error) *RequestError {
+	var (
+		maxErr    *http.MaxBytesError
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &maxErr):
+		return &RequestError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    CodeBodyTooLarge,
+			Message: fmt.Sprintf("request body larger than %d bytes", maxErr.Limit),
+			Err:     err,
+		}
+	case errors.As(err, &syntaxErr):
+		return &RequestError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeInvalidRequest,
+			Message: fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset),
+			Err:     err,
+		}
+	case err == io.EOF:
+		// nothing at all, not even a chunked empty body
+		return &RequestError{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: errEmptyBody.Error(), Err: errEmptyBody}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &RequestError{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: "malformed JSON: unexpected end of body", Err: err}
+	case errors.As(err, &typeErr):
+		return &RequestError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeValidationFailed,
+			Message: "invalid request body",
+			Fields:  []FieldError{{Field: typeErr.Field, Message: "must be a " + typeErr.Type.String()}},
+			Err:     err,
+		}
+	}
+	// encoding/json has no type for this one
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &RequestError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeValidationFailed,
+			Message: "invalid request body",
+			Fields:  []FieldError{{Field: strings.Trim(field, `"`), Message: "unknown field"}},
+			Err:     err,
+		}
+	}
+	return &RequestError{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: "invalid JSON body", Err: err}
+}
+
+// validationFailed is the RequestError for fields that decoded fine but
+// aren't acceptable, nil when there are none.
+func validationFailed(fields []FieldError) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	return &RequestError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "invalid request body", Fields: fields}
+}
+
+// requireField adds a "required" error for name to fields when value is empty.
+func requireField(fields []FieldError, name, value string) []FieldError {
+	if value == "" {
+		fields = append(fields, FieldError{Field: name, Message: "required"})
+	}
+	return fields
+}
+
+// validateUsername reports a new username that breaks auth.ValidateUsername's
+// rules. Only registration checks them, logins must keep working for
+// existing names.
+func validateUsername(username string) []FieldError {
+	if err := auth.ValidateUsername(username); err != nil {
+		return []FieldError{{Field: "username", Message: err.Error()}}
+	}
+	return nil
+}
@@ -2,14 +2,22 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"auth-api/audit"
 	"auth-api/auth"
+	"auth-api/config"
+	"auth-api/db"
+	"auth-api/logins"
 	"auth-api/models"
 
 	"golang.org/x/crypto/bcrypt"
@@ -26,6 +34,7 @@ func newJSONRequest(t *testing.T, method, target string, body any) *http.Request
 		}
 	}
 	req := httptest.NewRequest(method, target, &buf)
+	req.Header.Set("Content-Type", "application/json")
 	req.RemoteAddr = "127.0.0.1:12345"
 	return req
 }
@@ -43,12 +52,13 @@ func readBody(t *testing.T, res *http.Response) string {
 // TestRegisterHandlerSuccess checks that a valid registration request succeeds
 // and persists the transformed user payload.
 func TestRegisterHandlerSuccess(t *testing.T) {
+	stubConfusable(t, "")
 	originalGet := registerGetUserByName
 	originalRegister := registerUserFunc
-	registerGetUserByName = func(username string) (*models.ServiceUser, error) {
-		return nil, errors.New("not found")
+	registerGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		return nil, db.ErrNotFound
 	}
-	registerUserFunc = func(user models.ServiceUser) error {
+	registerUserFunc = func(ctx context.Context, user models.ServiceUser) error {
 		if user.Username != "alice" || user.Location != "Internet" || user.IP_addr == "" {
 			t.Fatalf("unexpected user payload: %+v", user)
 		}
@@ -80,11 +90,24 @@ func TestRegisterHandlerSuccess(t *testing.T) {
 	}
 }
 
+// stubConfusable makes the look-alike username check report existing for
+// every name, "" meaning no look-alike.
+func stubConfusable(t *testing.T, existing string) {
+	t.Helper()
+	original := registerConfusableUsername
+	registerConfusableUsername = func(ctx context.Context, username string) (string, error) {
+		return existing, nil
+	}
+	t.Cleanup(func() {
+		registerConfusableUsername = original
+	})
+}
+
 // TestRegisterHandlerUsernameTaken ensures an existing username results in a
 // user-friendly error.
 func TestRegisterHandlerUsernameTaken(t *testing.T) {
 	originalGet := registerGetUserByName
-	registerGetUserByName = func(username string) (*models.ServiceUser, error) {
+	registerGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
 		return &models.ServiceUser{Username: username}, nil
 	}
 	t.Cleanup(func() {
@@ -113,6 +136,7 @@ func TestRegisterHandlerUsernameTaken(t *testing.T) {
 // request processing.
 func TestRegisterHandlerInvalidJSON(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewBufferString("not-json"))
+	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 
 	RegisterHandler(rr, req)
@@ -138,12 +162,13 @@ func TestRegisterHandlerMissingFields(t *testing.T) {
 // TestRegisterHandlerPersistenceError makes sure database failures are
 // translated to a 500 response.
 func TestRegisterHandlerPersistenceError(t *testing.T) {
+	stubConfusable(t, "")
 	originalGet := registerGetUserByName
 	originalRegister := registerUserFunc
-	registerGetUserByName = func(username string) (*models.ServiceUser, error) {
-		return nil, errors.New("not found")
+	registerGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		return nil, db.ErrNotFound
 	}
-	registerUserFunc = func(user models.ServiceUser) error {
+	registerUserFunc = func(ctx context.Context, user models.ServiceUser) error {
 		return errors.New("db down")
 	}
 	t.Cleanup(func() {
@@ -167,18 +192,20 @@ func TestRegisterHandlerPersistenceError(t *testing.T) {
 // TestLoginHandlerSuccess covers the happy path including password validation
 // and JWT issuance.
 func TestLoginHandlerSuccess(t *testing.T) {
+	stubLoginHistory(t)
 	originalGet := loginGetUserByName
 	originalCreate := createJWTFunc
 	hashed, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
 	if err != nil {
 		t.Fatalf("failed to hash password: %v", err)
 	}
-	loginGetUserByName = func(username string) (*models.ServiceUser, error) {
+	loginGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
 		return &models.ServiceUser{Username: username, Password: string(hashed)}, nil
 	}
-	createJWTFunc = func(username string) (auth.JWTResponse, error) {
+	createJWTFunc = func(ctx context.Context, username, sessionID, audience string) (auth.JWTResponse, error) {
 		return auth.JWTResponse{AccessToken: "token", TokenType: "bearer"}, nil
 	}
+	sessions := stubCreateSession(t)
 	t.Cleanup(func() {
 		loginGetUserByName = originalGet
 		createJWTFunc = originalCreate
@@ -188,6 +215,7 @@ func TestLoginHandlerSuccess(t *testing.T) {
 		"username": "alice",
 		"password": "password123",
 	})
+	req.Header.Set("User-Agent", "test-agent")
 	rr := httptest.NewRecorder()
 
 	LoginHandler(rr, req)
@@ -200,11 +228,63 @@ func TestLoginHandlerSuccess(t *testing.T) {
 	if !bytes.Contains([]byte(body), []byte("login successful")) {
 		t.Fatalf("unexpected body: %s", body)
 	}
+
+	if len(*sessions) != 1 {
+		t.Fatalf("expected one session to be created, got %d", len(*sessions))
+	}
+	session := (*sessions)[0]
+	if session.Username != "alice" || session.UserAgent != "test-agent" || session.IP_addr != "127.0.0.1" {
+		t.Fatalf("unexpected session: %+v", session)
+	}
+	var payload struct {
+		Auth auth.JWTResponse `json:"auth"`
+	}
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if payload.Auth.RefreshToken == "" || auth.HashToken(payload.Auth.RefreshToken) != session.RefreshHash {
+		t.Fatalf("refresh token does not match the stored session: %+v", payload.Auth)
+	}
+}
+
+// stubCreateSession replaces session storage at login and collects the
+// sessions that would have been saved.
+func stubCreateSession(t *testing.T) *[]models.Session {
+	t.Helper()
+	original := loginCreateSession
+	var sessions []models.Session
+	loginCreateSession = func(ctx context.Context, session models.Session, ttl time.Duration) error {
+		sessions = append(sessions, session)
+		return nil
+	}
+	t.Cleanup(func() {
+		loginCreateSession = original
+	})
+	return &sessions
+}
+
+// stubLoginHistory replaces the login history store for LoginHandler with
+// one that has nothing risky to say, and collects the recorded attempts.
+func stubLoginHistory(t *testing.T) *[]models.LoginRecord {
+	t.Helper()
+	originalAssess, originalRecord := loginAssessRisk, loginRecordAttempt
+	var records []models.LoginRecord
+	loginAssessRisk = func(ctx context.Context, rec *models.LoginRecord) bool {
+		return false
+	}
+	loginRecordAttempt = func(ctx context.Context, rec models.LoginRecord) {
+		records = append(records, rec)
+	}
+	t.Cleanup(func() {
+		loginAssessRisk, loginRecordAttempt = originalAssess, originalRecord
+	})
+	return &records
 }
 
 // TestLoginHandlerInvalidJSON validates malformed JSON is rejected.
 func TestLoginHandlerInvalidJSON(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewBufferString("not-json"))
+	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 
 	LoginHandler(rr, req)
@@ -218,8 +298,8 @@ func TestLoginHandlerInvalidJSON(t *testing.T) {
 // bad-request error.
 func TestLoginHandlerUserNotFound(t *testing.T) {
 	originalGet := loginGetUserByName
-	loginGetUserByName = func(username string) (*models.ServiceUser, error) {
-		return nil, errors.New("not found")
+	loginGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		return nil, db.ErrNotFound
 	}
 	t.Cleanup(func() {
 		loginGetUserByName = originalGet
@@ -233,20 +313,21 @@ func TestLoginHandlerUserNotFound(t *testing.T) {
 
 	LoginHandler(rr, req)
 
-	if rr.Result().StatusCode != http.StatusBadRequest {
-		t.Fatalf("expected 400 for missing user, got %d", rr.Result().StatusCode)
+	if rr.Result().StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for missing user, got %d", rr.Result().StatusCode)
 	}
 }
 
 // TestLoginHandlerInvalidPassword checks that incorrect credentials are
 // rejected with a 400 response.
 func TestLoginHandlerInvalidPassword(t *testing.T) {
+	stubLoginHistory(t)
 	originalGet := loginGetUserByName
 	hashed, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
 	if err != nil {
 		t.Fatalf("failed to hash password: %v", err)
 	}
-	loginGetUserByName = func(username string) (*models.ServiceUser, error) {
+	loginGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
 		return &models.ServiceUser{Username: username, Password: string(hashed)}, nil
 	}
 	t.Cleanup(func() {
@@ -261,24 +342,36 @@ func TestLoginHandlerInvalidPassword(t *testing.T) {
 
 	LoginHandler(rr, req)
 
-	if rr.Result().StatusCode != http.StatusBadRequest {
-		t.Fatalf("expected 400 for bad password, got %d", rr.Result().StatusCode)
+	res := rr.Result()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for bad password, got %d", res.StatusCode)
+	}
+	if res.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected a WWW-Authenticate challenge on 401")
+	}
+	var problem Problem
+	if err := json.NewDecoder(res.Body).Decode(&problem); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	if problem.Code != CodeInvalidCredentials || problem.Status != http.StatusUnauthorized {
+		t.Fatalf("unexpected problem: %+v", problem)
 	}
 }
 
 // TestLoginHandlerTokenFailure verifies JWT creation errors surface as a 500
 // response.
 func TestLoginHandlerTokenFailure(t *testing.T) {
+	stubLoginHistory(t)
 	originalGet := loginGetUserByName
 	originalCreate := createJWTFunc
 	hashed, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
 	if err != nil {
 		t.Fatalf("failed to hash password: %v", err)
 	}
-	loginGetUserByName = func(username string) (*models.ServiceUser, error) {
+	loginGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
 		return &models.ServiceUser{Username: username, Password: string(hashed)}, nil
 	}
-	createJWTFunc = func(username string) (auth.JWTResponse, error) {
+	createJWTFunc = func(ctx context.Context, username, sessionID, audience string) (auth.JWTResponse, error) {
 		return auth.JWTResponse{}, errors.New("fail")
 	}
 	t.Cleanup(func() {
@@ -315,3 +408,969 @@ func TestSecretHandler(t *testing.T) {
 		t.Fatalf("expected gif content type, got %s", ct)
 	}
 }
+
+// stubReadiness replaces the readiness dependencies for the duration of a test.
+func stubReadiness(t *testing.T, pingErr, keyErr error, version int) {
+	t.Helper()
+	originalPing := readyPingDB
+	originalKey := readyGetSecretKey
+	originalVersion := readySchemaVersion
+	readyPingDB = func(ctx context.Context) error {
+		return pingErr
+	}
+	readyGetSecretKey = func(ctx context.Context) ([]byte, error) {
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		return []byte("secret"), nil
+	}
+	readySchemaVersion = func(ctx context.Context) (int, error) {
+		return version, nil
+	}
+	t.Cleanup(func() {
+		readyPingDB = originalPing
+		readyGetSecretKey = originalKey
+		readySchemaVersion = originalVersion
+	})
+}
+
+// TestReadyzHandlerReady checks all passing dependencies yield a 200 with
+// per-check details.
+func TestReadyzHandlerReady(t *testing.T) {
+	stubReadiness(t, nil, nil, db.ExpectedSchemaVersion)
+
+	rr := httptest.NewRecorder()
+	ReadyzHandler(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	res := rr.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	var body ReadyResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	for _, name := range []string{"database", "signing_key", "migrations"} {
+		if body.Checks[name].Status != "ok" {
+			t.Fatalf("expected check %s to pass, got %+v", name, body.Checks[name])
+		}
+	}
+}
+
+// TestReadyzHandlerNotReady ensures any failing dependency turns the probe
+// into a 503 and names the failing check.
+func TestReadyzHandlerNotReady(t *testing.T) {
+	stubReadiness(t, errors.New("connection refused"), nil, db.ExpectedSchemaVersion-1)
+
+	rr := httptest.NewRecorder()
+	ReadyzHandler(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	res := rr.Result()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", res.StatusCode)
+	}
+	var body ReadyResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if body.Checks["database"].Status != "fail" || body.Checks["migrations"].Status != "fail" {
+		t.Fatalf("expected database and migrations to fail, got %+v", body.Checks)
+	}
+	if body.Checks["signing_key"].Status != "ok" {
+		t.Fatalf("expected signing_key to pass, got %+v", body.Checks["signing_key"])
+	}
+}
+
+// auditCapture collects audit events recorded during a test.
+type auditCapture struct {
+	events []models.AuditEvent
+}
+
+func (a *auditCapture) Write(ctx context.Context, event models.AuditEvent) error {
+	a.events = append(a.events, event)
+	return nil
+}
+
+func captureAudit(t *testing.T) *auditCapture {
+	t.Helper()
+	capture := &auditCapture{}
+	audit.SetSinks(capture)
+	t.Cleanup(func() {
+		audit.SetSinks()
+	})
+	return capture
+}
+
+// TestLoginHandlerAudit checks failed and successful logins are both recorded
+// with the attempted username and the failure reason.
+func TestLoginHandlerAudit(t *testing.T) {
+	capture := captureAudit(t)
+	originalGet := loginGetUserByName
+	loginGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		return nil, db.ErrNotFound
+	}
+	t.Cleanup(func() {
+		loginGetUserByName = originalGet
+	})
+
+	req := newJSONRequest(t, http.MethodPost, "/login", map[string]string{
+		"username": "mallory",
+		"password": "guess",
+	})
+	LoginHandler(httptest.NewRecorder(), req)
+
+	if len(capture.events) != 1 {
+		t.Fatalf("expected one audit event, got %+v", capture.events)
+	}
+	event := capture.events[0]
+	if event.Type != audit.EventLogin || event.Actor != "mallory" || event.Outcome != audit.OutcomeFailure || event.Reason != "user_not_found" || event.IP_addr != "127.0.0.1" {
+		t.Fatalf("unexpected audit event: %+v", event)
+	}
+}
+
+// TestAuditHandler covers filter parsing and the response shape of the admin
+// audit query.
+func TestAuditHandler(t *testing.T) {
+	capture := captureAudit(t)
+	original := queryAuditEvents
+	var captured models.AuditFilter
+	queryAuditEvents = func(ctx context.Context, filter models.AuditFilter) ([]models.AuditEvent, error) {
+		captured = filter
+		return []models.AuditEvent{{ID: 1, Type: audit.EventLogin, Actor: "alice"}}, nil
+	}
+	t.Cleanup(func() {
+		queryAuditEvents = original
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/audit?actor=alice&outcome=failure&since=2026-01-01T00:00:00Z&limit=5", nil)
+	req = req.WithContext(auth.WithUser(req.Context(), "root"))
+	rr := httptest.NewRecorder()
+	AuditHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if captured.Actor != "alice" || captured.Outcome != "failure" || captured.Limit != 5 || captured.Since.IsZero() {
+		t.Fatalf("unexpected filter: %+v", captured)
+	}
+	var body AuditResponse
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil || body.Count != 1 {
+		t.Fatalf("unexpected body: %+v (%v)", body, err)
+	}
+	if len(capture.events) != 1 || capture.events[0].Actor != "root" || capture.events[0].Type != audit.EventAdminAction {
+		t.Fatalf("expected the query to be audited, got %+v", capture.events)
+	}
+
+	rr = httptest.NewRecorder()
+	AuditHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/audit?since=yesterday", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad since, got %d", rr.Code)
+	}
+}
+
+// TestWriteResponseProblem checks error statuses are rendered as RFC 7807
+// problem documents with a stable code.
+func TestWriteResponseProblem(t *testing.T) {
+	rr := httptest.NewRecorder()
+	WriteResponse(rr, &Response{Status: http.StatusConflict, Code: CodeUsernameTaken, Message: "username taken. pick another"})
+
+	res := rr.Result()
+	if ct := res.Header.Get("Content-Type"); ct != ProblemContentType {
+		t.Fatalf("expected %s, got %s", ProblemContentType, ct)
+	}
+	var problem Problem
+	if err := json.NewDecoder(res.Body).Decode(&problem); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	want := Problem{
+		Type:   "urn:auth-api:problem:username_taken",
+		Title:  "Conflict",
+		Status: http.StatusConflict,
+		Detail: "username taken. pick another",
+		Code:   CodeUsernameTaken,
+	}
+	if !reflect.DeepEqual(problem, want) {
+		t.Fatalf("unexpected problem: %+v", problem)
+	}
+
+	rr = httptest.NewRecorder()
+	WriteResponse(rr, &Response{Status: http.StatusInternalServerError, Message: "boom"})
+	if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil || problem.Code != CodeInternal {
+		t.Fatalf("expected default internal_error code, got %+v (%v)", problem, err)
+	}
+}
+
+// TestLoginHandlerUniformFailure ensures unknown usernames and wrong passwords
+// are indistinguishable to the client.
+func TestLoginHandlerUniformFailure(t *testing.T) {
+	stubLoginHistory(t)
+	originalGet := loginGetUserByName
+	hashed, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	t.Cleanup(func() {
+		loginGetUserByName = originalGet
+	})
+
+	attempt := func(lookup func(ctx context.Context, username string) (*models.ServiceUser, error)) (int, string) {
+		loginGetUserByName = lookup
+		req := newJSONRequest(t, http.MethodPost, "/login", map[string]string{
+			"username": "alice",
+			"password": "wrong",
+		})
+		rr := httptest.NewRecorder()
+		LoginHandler(rr, req)
+		return rr.Code, rr.Body.String()
+	}
+
+	unknownStatus, unknownBody := attempt(func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		return nil, db.ErrNotFound
+	})
+	wrongStatus, wrongBody := attempt(func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		return &models.ServiceUser{Username: username, Password: string(hashed)}, nil
+	})
+
+	if unknownStatus != wrongStatus || unknownBody != wrongBody {
+		t.Fatalf("responses differ:\nunknown user: %d %s\nwrong password: %d %s", unknownStatus, unknownBody, wrongStatus, wrongBody)
+	}
+}
+
+// TestRegisterHandlerConcealExisting checks that with concealment on, a taken
+// username gets the same answer as a fresh one and nothing is inserted.
+func TestRegisterHandlerConcealExisting(t *testing.T) {
+	stubConfusable(t, "")
+	originalGet := registerGetUserByName
+	originalRegister := registerUserFunc
+	originalConceal := config.RegisterConcealExisting
+	config.RegisterConcealExisting = true
+	inserted := 0
+	registerUserFunc = func(ctx context.Context, user models.ServiceUser) error {
+		inserted++
+		return nil
+	}
+	t.Cleanup(func() {
+		registerGetUserByName = originalGet
+		registerUserFunc = originalRegister
+		config.RegisterConcealExisting = originalConceal
+	})
+
+	attempt := func(existing *models.ServiceUser) (int, string) {
+		registerGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
+			if existing == nil {
+				return nil, db.ErrNotFound
+			}
+			return existing, nil
+		}
+		req := newJSONRequest(t, http.MethodPost, "/register", map[string]string{
+			"username": "alice",
+			"password": "password123",
+		})
+		rr := httptest.NewRecorder()
+		RegisterHandler(rr, req)
+		return rr.Code, rr.Body.String()
+	}
+
+	freeStatus, freeBody := attempt(nil)
+	takenStatus, takenBody := attempt(&models.ServiceUser{Username: "alice"})
+
+	if freeStatus != http.StatusAccepted || freeStatus != takenStatus || freeBody != takenBody {
+		t.Fatalf("responses differ:\nfree: %d %s\ntaken: %d %s", freeStatus, freeBody, takenStatus, takenBody)
+	}
+	if inserted != 1 {
+		t.Fatalf("expected only the free username to be inserted, got %d inserts", inserted)
+	}
+}
+
+// TestLoginHandlerRehash checks a successful login with an outdated hash
+// stores a fresh one, and that a failing update doesn't block the login.
+func TestLoginHandlerRehash(t *testing.T) {
+	stubLoginHistory(t)
+	originalGet := loginGetUserByName
+	originalCreate := createJWTFunc
+	originalUpdate := loginUpdatePassword
+	weak, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	loginGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		return &models.ServiceUser{Username: username, Password: string(weak)}, nil
+	}
+	createJWTFunc = func(ctx context.Context, username, sessionID, audience string) (auth.JWTResponse, error) {
+		return auth.JWTResponse{AccessToken: "token", TokenType: "bearer"}, nil
+	}
+	stubCreateSession(t)
+	var stored string
+	loginUpdatePassword = func(ctx context.Context, username, hashed string) error {
+		stored = hashed
+		return errors.New("db down")
+	}
+	t.Cleanup(func() {
+		loginGetUserByName = originalGet
+		createJWTFunc = originalCreate
+		loginUpdatePassword = originalUpdate
+	})
+
+	req := newJSONRequest(t, http.MethodPost, "/login", map[string]string{
+		"username": "alice",
+		"password": "password123",
+	})
+	rr := httptest.NewRecorder()
+	LoginHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected login to succeed despite the failed update, got %d", rr.Code)
+	}
+	if stored == "" || auth.NeedsRehash(stored) {
+		t.Fatalf("expected an upgraded hash to be stored, got %q", stored)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte("password123")); err != nil {
+		t.Fatalf("stored hash does not match the password: %v", err)
+	}
+}
+
+// TestSessionsHandler checks the caller's sessions are listed with the
+// current one flagged.
+func TestSessionsHandler(t *testing.T) {
+	original := listSessions
+	var queried string
+	listSessions = func(ctx context.Context, username string) ([]models.Session, error) {
+		queried = username
+		return []models.Session{{ID: "s1"}, {ID: "s2"}}, nil
+	}
+	t.Cleanup(func() {
+		listSessions = original
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	ctx := auth.WithSessionID(auth.WithUser(req.Context(), "alice"), "s2")
+	rr := httptest.NewRecorder()
+	SessionsHandler(rr, req.WithContext(ctx))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if queried != "alice" {
+		t.Fatalf("expected sessions of alice, got %q", queried)
+	}
+	var body SessionsResponse
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if body.Count != 2 || body.Sessions[0].Current || !body.Sessions[1].Current {
+		t.Fatalf("unexpected sessions: %+v", body)
+	}
+}
+
+// TestDeleteSessionHandler checks a revoked session is audited and an
+// unknown one is a 404.
+func TestDeleteSessionHandler(t *testing.T) {
+	capture := captureAudit(t)
+	original := deleteSession
+	deleteSession = func(ctx context.Context, username, id string) error {
+		if username == "alice" && id == "s1" {
+			return nil
+		}
+		return db.ErrSessionNotFound
+	}
+	t.Cleanup(func() {
+		deleteSession = original
+	})
+
+	for id, want := range map[string]int{"s1": http.StatusOK, "other": http.StatusNotFound} {
+		req := httptest.NewRequest(http.MethodDelete, "/sessions/"+id, nil)
+		req.SetPathValue("id", id)
+		rr := httptest.NewRecorder()
+		DeleteSessionHandler(rr, req.WithContext(auth.WithUser(req.Context(), "alice")))
+		if rr.Code != want {
+			t.Fatalf("deleting %s: expected %d, got %d", id, want, rr.Code)
+		}
+	}
+	if len(capture.events) != 2 || capture.events[0].Type != audit.EventTokenRevoked {
+		t.Fatalf("unexpected audit events: %+v", capture.events)
+	}
+}
+
+// stubRefresh serves a single session holding refreshToken, rotated from
+// "s1.spent", to RefreshHandler and reports what happened to it.
+type stubRefresh struct {
+	rotated bool
+	deleted bool
+}
+
+func newStubRefresh(t *testing.T, refreshToken string) *stubRefresh {
+	t.Helper()
+	stub := &stubRefresh{}
+	originalGet, originalRotate, originalDelete, originalCreate := getSession, rotateSessionTokens, deleteSession, createJWTFunc
+	getSession = func(ctx context.Context, id string) (*models.Session, error) {
+		if id != "s1" {
+			return nil, db.ErrSessionNotFound
+		}
+		return &models.Session{
+			ID: "s1", Username: "alice",
+			RefreshHash:         auth.HashToken(refreshToken),
+			PreviousRefreshHash: auth.HashToken("s1.spent"),
+		}, nil
+	}
+	rotateSessionTokens = func(ctx context.Context, id, oldHash, newHash, accessHash string, ttl time.Duration) error {
+		stub.rotated = true
+		return nil
+	}
+	deleteSession = func(ctx context.Context, username, id string) error {
+		stub.deleted = true
+		return nil
+	}
+	createJWTFunc = func(ctx context.Context, username, sessionID, audience string) (auth.JWTResponse, error) {
+		return auth.JWTResponse{AccessToken: "token", TokenType: "bearer"}, nil
+	}
+	t.Cleanup(func() {
+		getSession, rotateSessionTokens, deleteSession, createJWTFunc = originalGet, originalRotate, originalDelete, originalCreate
+	})
+	return stub
+}
+
+// TestRefreshHandlerRotates checks a current refresh token is exchanged for
+// a new pair.
+func TestRefreshHandlerRotates(t *testing.T) {
+	stub := newStubRefresh(t, "s1.current")
+
+	req := newJSONRequest(t, http.MethodPost, "/refresh", map[string]string{"refresh_token": "s1.current"})
+	rr := httptest.NewRecorder()
+	RefreshHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !stub.rotated || stub.deleted {
+		t.Fatalf("expected the session to be rotated, got %+v", stub)
+	}
+	if !bytes.Contains(rr.Body.Bytes(), []byte(`"refresh_token":"s1.`)) {
+		t.Fatalf("expected a new refresh token, got %s", rr.Body.String())
+	}
+}
+
+// TestRefreshHandlerReuse checks a spent refresh token is refused and ends
+// the session.
+func TestRefreshHandlerReuse(t *testing.T) {
+	stub := newStubRefresh(t, "s1.current")
+
+	req := newJSONRequest(t, http.MethodPost, "/refresh", map[string]string{"refresh_token": "s1.spent"})
+	rr := httptest.NewRecorder()
+	RefreshHandler(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rr.Code)
+	}
+	if stub.rotated || !stub.deleted {
+		t.Fatalf("expected the session to be revoked, got %+v", stub)
+	}
+}
+
+// TestRefreshHandlerForged checks a made up refresh token for a known session
+// id is refused without ending that session: session ids aren't secret.
+func TestRefreshHandlerForged(t *testing.T) {
+	stub := newStubRefresh(t, "s1.current")
+
+	req := newJSONRequest(t, http.MethodPost, "/refresh", map[string]string{"refresh_token": "s1.garbage"})
+	rr := httptest.NewRecorder()
+	RefreshHandler(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rr.Code)
+	}
+	if stub.rotated || stub.deleted {
+		t.Fatalf("expected the session left alone, got %+v", stub)
+	}
+}
+
+// TestLoginHandlerUnknownAudience checks ?audience= must name a token profile.
+func TestLoginHandlerUnknownAudience(t *testing.T) {
+	req := newJSONRequest(t, http.MethodPost, "/login?audience=nope", map[string]string{
+		"username": "alice",
+		"password": "password123",
+	})
+	rr := httptest.NewRecorder()
+	LoginHandler(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+	if !bytes.Contains(rr.Body.Bytes(), []byte(CodeInvalidRequest)) {
+		t.Fatalf("unexpected body: %s", rr.Body.String())
+	}
+}
+
+// TestRefreshHandlerCookieMode checks a cookie session refreshes from its
+// cookie, only with the CSRF header, and gets the new pair back as cookies.
+func TestRefreshHandlerCookieMode(t *testing.T) {
+	stub := newStubRefresh(t, "s1.current")
+	original := config.CookieSessions
+	config.CookieSessions = true
+	t.Cleanup(func() {
+		config.CookieSessions = original
+	})
+
+	newRequest := func(csrfHeader string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+		req.AddCookie(&http.Cookie{Name: RefreshCookie, Value: "s1.current"})
+		req.AddCookie(&http.Cookie{Name: CSRFCookie, Value: "csrf"})
+		if csrfHeader != "" {
+			req.Header.Set(CSRFHeader, csrfHeader)
+		}
+		return req
+	}
+
+	for _, header := range []string{"", "forged"} {
+		rr := httptest.NewRecorder()
+		RefreshHandler(rr, newRequest(header))
+		if rr.Code != http.StatusForbidden || !bytes.Contains(rr.Body.Bytes(), []byte(CodeCSRF)) {
+			t.Fatalf("header %q: expected 403 %s, got %d %s", header, CodeCSRF, rr.Code, rr.Body.String())
+		}
+	}
+	if stub.rotated {
+		t.Fatalf("expected no rotation without the CSRF token")
+	}
+
+	rr := httptest.NewRecorder()
+	RefreshHandler(rr, newRequest("csrf"))
+	if rr.Code != http.StatusOK || !stub.rotated {
+		t.Fatalf("expected 200 and a rotation, got %d %s", rr.Code, rr.Body.String())
+	}
+	if bytes.Contains(rr.Body.Bytes(), []byte("refresh_token")) || !bytes.Contains(rr.Body.Bytes(), []byte("csrf_token")) {
+		t.Fatalf("expected the tokens kept out of the body, got %s", rr.Body.String())
+	}
+	cookies := map[string]*http.Cookie{}
+	for _, cookie := range rr.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	access, refresh := cookies[AccessCookie], cookies[RefreshCookie]
+	if access == nil || access.Value != "token" || !access.HttpOnly || !access.Secure || access.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("unexpected access cookie: %+v", access)
+	}
+	if refresh == nil || !strings.HasPrefix(refresh.Value, "s1.") || refresh.Path != "/refresh" || !refresh.HttpOnly {
+		t.Fatalf("unexpected refresh cookie: %+v", refresh)
+	}
+	if csrf := cookies[CSRFCookie]; csrf == nil || csrf.HttpOnly || csrf.Value == "csrf" {
+		t.Fatalf("expected a new script readable csrf cookie, got %+v", csrf)
+	}
+}
+
+// TestLoginHandlerCookieModeDisabled checks ?mode=cookie is refused unless
+// cookie sessions are turned on.
+func TestLoginHandlerCookieModeDisabled(t *testing.T) {
+	req := newJSONRequest(t, http.MethodPost, "/login?mode=cookie", map[string]string{
+		"username": "alice",
+		"password": "password123",
+	})
+	rr := httptest.NewRecorder()
+	LoginHandler(rr, req)
+
+	if rr.Code != http.StatusBadRequest || len(rr.Result().Cookies()) != 0 {
+		t.Fatalf("expected 400 without cookies, got %d %v", rr.Code, rr.Result().Cookies())
+	}
+}
+
+// TestRegisterHandlerStrictDecoding checks bodies are held to size, media
+// type and shape, and rejections name the offending field.
+func TestRegisterHandlerStrictDecoding(t *testing.T) {
+	original := config.MaxBodyBytes
+	config.MaxBodyBytes = 128
+	t.Cleanup(func() {
+		config.MaxBodyBytes = original
+	})
+
+	cases := map[string]struct {
+		contentType, body string
+		status            int
+		code, field       string
+	}{
+		"too large":     {"application/json", `{"username":"` + strings.Repeat("a", 200) + `"}`, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, ""},
+		"not json":      {"text/plain", `{"username":"alice","password":"pw"}`, http.StatusUnsupportedMediaType, CodeUnsupportedMedia, ""},
+		"unknown field": {"application/json", `{"username":"alice","passwrd":"pw"}`, http.StatusBadRequest, CodeValidationFailed, "passwrd"},
+		"trailing data": {"application/json", `{"username":"alice","password":"pw"} {}`, http.StatusBadRequest, CodeInvalidRequest, ""},
+		"wrong type":    {"application/json", `{"username":5,"password":"pw"}`, http.StatusBadRequest, CodeValidationFailed, "username"},
+		"bad username":  {"application/json", `{"username":"-alice","password":"pw"}`, http.StatusBadRequest, CodeValidationFailed, "username"},
+		"no password":   {"application/json; charset=utf-8", `{"username":"alice"}`, http.StatusBadRequest, CodeValidationFailed, "password"},
+	}
+	for name, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		rr := httptest.NewRecorder()
+		RegisterHandler(rr, req)
+
+		var problem Problem
+		if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil || rr.Code != tc.status || problem.Code != tc.code {
+			t.Fatalf("%s: expected %d %s, got %d %+v (%v)", name, tc.status, tc.code, rr.Code, problem, err)
+		}
+		if tc.field != "" && (len(problem.Errors) != 1 || problem.Errors[0].Field != tc.field) {
+			t.Fatalf("%s: expected an error for field %s, got %+v", name, tc.field, problem.Errors)
+		}
+	}
+}
+
+// TestRegisterHandlerNormalizes checks usernames are normalized before they
+// are validated and stored, and that look-alikes and reserved names are
+// refused.
+func TestRegisterHandlerNormalizes(t *testing.T) {
+	originalGet, originalRegister := registerGetUserByName, registerUserFunc
+	registerGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		return nil, db.ErrNotFound
+	}
+	var stored string
+	registerUserFunc = func(ctx context.Context, user models.ServiceUser) error {
+		stored = user.Username
+		return nil
+	}
+	t.Cleanup(func() {
+		registerGetUserByName, registerUserFunc = originalGet, originalRegister
+	})
+
+	register := func(username string) int {
+		req := newJSONRequest(t, http.MethodPost, "/register", map[string]string{"username": username, "password": "password123"})
+		rr := httptest.NewRecorder()
+		RegisterHandler(rr, req)
+		return rr.Code
+	}
+
+	stubConfusable(t, "")
+	if code := register("  Ａlice "); code != http.StatusCreated || stored != "alice" {
+		t.Fatalf("expected full width Alice stored as alice, got %d %q", code, stored)
+	}
+	if code := register("Adm1n"); code != http.StatusBadRequest {
+		t.Fatalf("expected a reserved name look-alike refused, got %d", code)
+	}
+
+	stubConfusable(t, "alice")
+	if code := register("a1ice"); code != http.StatusConflict {
+		t.Fatalf("expected a look-alike of an existing name refused, got %d", code)
+	}
+}
+
+// TestRegisterHandlerLostRace checks a registration that passes the lookup
+// but loses the insert to a concurrent one gets a 409, not a 500.
+func TestRegisterHandlerLostRace(t *testing.T) {
+	stubConfusable(t, "")
+	originalGet, originalRegister := registerGetUserByName, registerUserFunc
+	registerGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		return nil, db.ErrNotFound
+	}
+	registerUserFunc = func(ctx context.Context, user models.ServiceUser) error {
+		return db.ErrUsernameTaken
+	}
+	t.Cleanup(func() {
+		registerGetUserByName, registerUserFunc = originalGet, originalRegister
+	})
+
+	req := newJSONRequest(t, http.MethodPost, "/register", map[string]string{"username": "alice", "password": "password123"})
+	rr := httptest.NewRecorder()
+	RegisterHandler(rr, req)
+
+	if rr.Code != http.StatusConflict || !bytes.Contains(rr.Body.Bytes(), []byte(CodeUsernameTaken)) {
+		t.Fatalf("expected 409 %s, got %d %s", CodeUsernameTaken, rr.Code, rr.Body.String())
+	}
+}
+
+// TestLoginHandlerLookupError checks a failing user lookup is a 500, not
+// passed off as bad credentials.
+func TestLoginHandlerLookupError(t *testing.T) {
+	original := loginGetUserByName
+	loginGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		return nil, errors.New("connection refused")
+	}
+	t.Cleanup(func() {
+		loginGetUserByName = original
+	})
+
+	req := newJSONRequest(t, http.MethodPost, "/login", map[string]string{"username": "alice", "password": "password123"})
+	rr := httptest.NewRecorder()
+	LoginHandler(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", rr.Code)
+	}
+}
+
+// stubLoginUser makes alice (password123) the only account LoginHandler knows.
+func stubLoginUser(t *testing.T) {
+	t.Helper()
+	original := loginGetUserByName
+	hashed, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	loginGetUserByName = func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		if username != "alice" {
+			return nil, db.ErrNotFound
+		}
+		return &models.ServiceUser{Username: "alice", Password: string(hashed)}, nil
+	}
+	t.Cleanup(func() {
+		loginGetUserByName = original
+	})
+}
+
+// TestLoginHandlerRecordsHistory checks attempts on an existing account land
+// in its login history, failed ones with the reason, and that attempts on
+// unknown usernames don't.
+func TestLoginHandlerRecordsHistory(t *testing.T) {
+	records := stubLoginHistory(t)
+	stubLoginUser(t)
+	stubCreateSession(t)
+	originalCreate := createJWTFunc
+	createJWTFunc = func(ctx context.Context, username, sessionID, audience string) (auth.JWTResponse, error) {
+		return auth.JWTResponse{AccessToken: "token", TokenType: "bearer"}, nil
+	}
+	t.Cleanup(func() {
+		createJWTFunc = originalCreate
+	})
+
+	for _, password := range []string{"wrong", "password123"} {
+		req := newJSONRequest(t, http.MethodPost, "/login", map[string]string{"username": "alice", "password": password})
+		req.Header.Set("User-Agent", "test-agent")
+		LoginHandler(httptest.NewRecorder(), req)
+	}
+	req := newJSONRequest(t, http.MethodPost, "/login", map[string]string{"username": "mallory", "password": "guess"})
+	LoginHandler(httptest.NewRecorder(), req)
+
+	if len(*records) != 2 {
+		t.Fatalf("expected two recorded attempts, got %+v", *records)
+	}
+	failed, succeeded := (*records)[0], (*records)[1]
+	if failed.Username != "alice" || failed.Success || failed.Reason != "invalid_password" {
+		t.Fatalf("unexpected failed attempt: %+v", failed)
+	}
+	if !succeeded.Success || succeeded.Reason != "" || succeeded.IP_addr != "127.0.0.1" || succeeded.UserAgent != "test-agent" {
+		t.Fatalf("unexpected successful attempt: %+v", succeeded)
+	}
+}
+
+// TestLoginHandlerStepUp checks a login whose risk rules ask for a step up
+// is refused with its own code and challenge, audited, and starts no session.
+func TestLoginHandlerStepUp(t *testing.T) {
+	records := stubLoginHistory(t)
+	stubLoginUser(t)
+	sessions := stubCreateSession(t)
+	capture := captureAudit(t)
+	loginAssessRisk = func(ctx context.Context, rec *models.LoginRecord) bool {
+		rec.Risk = []string{logins.RuleNewCountry, logins.RuleImpossibleTravel}
+		return true
+	}
+
+	req := newJSONRequest(t, http.MethodPost, "/login", map[string]string{"username": "alice", "password": "password123"})
+	rr := httptest.NewRecorder()
+	LoginHandler(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rr.Code)
+	}
+	var problem Problem
+	if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil || problem.Code != CodeStepUpRequired {
+		t.Fatalf("unexpected problem: %+v (%v)", problem, err)
+	}
+	if challenge := rr.Header().Get("WWW-Authenticate"); !strings.Contains(challenge, `error="insufficient_user_authentication"`) {
+		t.Fatalf("unexpected challenge: %q", challenge)
+	}
+	if len(*sessions) != 0 {
+		t.Fatalf("expected no session, got %+v", *sessions)
+	}
+	if len(*records) != 1 || (*records)[0].Reason != "step_up_required" || len((*records)[0].Risk) != 2 {
+		t.Fatalf("unexpected login history: %+v", *records)
+	}
+	var risky *models.AuditEvent
+	for i, event := range capture.events {
+		if event.Type == audit.EventLoginRisk {
+			risky = &capture.events[i]
+		}
+	}
+	if risky == nil || risky.Reason != "new_country,impossible_travel" || risky.Outcome != audit.OutcomeFailure {
+		t.Fatalf("expected a failed login.risk event, got %+v", capture.events)
+	}
+}
+
+// TestMyLoginsHandler checks the caller gets their own history, and that a
+// bad limit is refused.
+func TestMyLoginsHandler(t *testing.T) {
+	original := listLogins
+	var queried string
+	var limit int
+	listLogins = func(ctx context.Context, username string, n int) ([]models.LoginRecord, error) {
+		queried, limit = username, n
+		return []models.LoginRecord{{ID: 2, Success: true}, {ID: 1, Reason: "invalid_password"}}, nil
+	}
+	t.Cleanup(func() {
+		listLogins = original
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/me/logins?limit=10", nil)
+	rr := httptest.NewRecorder()
+	MyLoginsHandler(rr, req.WithContext(auth.WithUser(req.Context(), "alice")))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if queried != "alice" || limit != 10 {
+		t.Fatalf("expected 10 logins of alice, got %d of %q", limit, queried)
+	}
+	var body LoginsResponse
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil || body.Count != 2 || body.Logins[1].Reason != "invalid_password" {
+		t.Fatalf("unexpected body: %+v (%v)", body, err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/me/logins?limit=0", nil)
+	rr = httptest.NewRecorder()
+	MyLoginsHandler(rr, req.WithContext(auth.WithUser(req.Context(), "alice")))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for limit=0, got %d", rr.Code)
+	}
+}
+
+// TestUpdateProfileHandler checks PATCH /me validates the fields, passes null
+// on as a clear, leaves out what wasn't sent and audits the change.
+func TestUpdateProfileHandler(t *testing.T) {
+	capture := captureAudit(t)
+	original := updateProfile
+	var got models.ProfileUpdate
+	updateProfile = func(ctx context.Context, username string, update models.ProfileUpdate) (*models.Profile, error) {
+		got = update
+		return &models.Profile{Username: username, Metadata: json.RawMessage("{}")}, nil
+	}
+	t.Cleanup(func() {
+		updateProfile = original
+	})
+
+	req := newJSONRequest(t, http.MethodPatch, "/me", map[string]any{
+		"display_name": " Alice ",
+		"email":        nil,
+		"metadata":     map[string]any{"theme": "dark"},
+	})
+	rr := httptest.NewRecorder()
+	UpdateProfileHandler(rr, req.WithContext(auth.WithUser(req.Context(), "alice")))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got.DisplayName == nil || *got.DisplayName != "Alice" {
+		t.Fatalf("expected the trimmed display name, got %v", got.DisplayName)
+	}
+	if got.Email == nil || *got.Email != "" {
+		t.Fatalf("expected null to clear the email, got %v", got.Email)
+	}
+	if string(got.Metadata) != `{"theme":"dark"}` {
+		t.Fatalf("unexpected metadata: %s", got.Metadata)
+	}
+	if len(capture.events) != 1 || capture.events[0].Type != audit.EventProfileUpdate || capture.events[0].Reason != "display_name,email,metadata" {
+		t.Fatalf("unexpected audit events: %+v", capture.events)
+	}
+
+	cases := []struct {
+		name  string
+		body  map[string]any
+		field string
+	}{
+		{"email with a name", map[string]any{"email": "Alice <alice@example.com>"}, "email"},
+		{"not an email", map[string]any{"email": "alice"}, "email"},
+		{"metadata array", map[string]any{"metadata": []string{"a"}}, "metadata"},
+		{"metadata too large", map[string]any{"metadata": map[string]string{"a": strings.Repeat("x", maxMetadataBytes)}}, "metadata"},
+		{"display name too long", map[string]any{"display_name": strings.Repeat("a", maxDisplayNameLen+1)}, "display_name"},
+		{"display name with a newline", map[string]any{"display_name": "a\nb"}, "display_name"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newJSONRequest(t, http.MethodPatch, "/me", tc.body)
+			rr := httptest.NewRecorder()
+			UpdateProfileHandler(rr, req.WithContext(auth.WithUser(req.Context(), "alice")))
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d", rr.Code)
+			}
+			var problem Problem
+			if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+				t.Fatalf("failed to decode problem: %v", err)
+			}
+			if len(problem.Errors) != 1 || problem.Errors[0].Field != tc.field {
+				t.Fatalf("expected a %s field error, got %+v", tc.field, problem.Errors)
+			}
+		})
+	}
+}
+
+// TestProfileHandlerDeletedAccount checks a token outliving its account gets
+// a 404 rather than a 500.
+func TestProfileHandlerDeletedAccount(t *testing.T) {
+	original := getProfile
+	getProfile = func(ctx context.Context, username string) (*models.Profile, error) {
+		return nil, db.ErrNotFound
+	}
+	t.Cleanup(func() {
+		getProfile = original
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	rr := httptest.NewRecorder()
+	ProfileHandler(rr, req.WithContext(auth.WithUser(req.Context(), "alice")))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rr.Code)
+	}
+}
+
+// TestDeleteAccountHandler checks DELETE /me wants the password, soft deletes
+// during a grace period and deletes for good without one.
+func TestDeleteAccountHandler(t *testing.T) {
+	capture := captureAudit(t)
+	hashed, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	originalGet, originalSoft, originalHard := deleteGetUser, softDeleteUser, deleteUserForGood
+	originalGrace := config.AccountDeleteGrace
+	deleteGetUser = func(ctx context.Context, username string) (*models.ServiceUser, error) {
+		return &models.ServiceUser{Username: username, Password: string(hashed)}, nil
+	}
+	var softDeleted, hardDeleted string
+	softDeleteUser = func(ctx context.Context, username string) error {
+		softDeleted = username
+		return nil
+	}
+	deleteUserForGood = func(ctx context.Context, username string) error {
+		hardDeleted = username
+		return nil
+	}
+	t.Cleanup(func() {
+		deleteGetUser, softDeleteUser, deleteUserForGood = originalGet, originalSoft, originalHard
+		config.AccountDeleteGrace = originalGrace
+	})
+
+	del := func(password string) *httptest.ResponseRecorder {
+		req := newJSONRequest(t, http.MethodDelete, "/me", map[string]string{"password": password})
+		rr := httptest.NewRecorder()
+		DeleteAccountHandler(rr, req.WithContext(auth.WithUser(req.Context(), "alice")))
+		return rr
+	}
+
+	if rr := del("wrong"); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a wrong password, got %d", rr.Code)
+	}
+	if softDeleted != "" || hardDeleted != "" {
+		t.Fatalf("expected nothing deleted on a wrong password")
+	}
+
+	config.AccountDeleteGrace = 24 * time.Hour
+	if rr := del("password123"); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 during a grace period, got %d", rr.Code)
+	}
+	if softDeleted != "alice" || hardDeleted != "" {
+		t.Fatalf("expected a soft delete, got soft=%q hard=%q", softDeleted, hardDeleted)
+	}
+
+	config.AccountDeleteGrace = 0
+	if rr := del("password123"); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 without a grace period, got %d", rr.Code)
+	}
+	if hardDeleted != "alice" {
+		t.Fatalf("expected alice deleted for good")
+	}
+
+	if len(capture.events) != 3 || capture.events[0].Reason != "invalid_password" || capture.events[2].Outcome != audit.OutcomeSuccess {
+		t.Fatalf("unexpected audit events: %+v", capture.events)
+	}
+}
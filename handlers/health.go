@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"auth-api/config"
+	"auth-api/db"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	// readiness dependencies, swapped out in tests
+	readyPingDB        = db.Ping
+	readyGetSecretKey  = db.GetSecretKey
+	readySchemaVersion = db.SchemaVersion
+)
+
+// CheckResult is the outcome of a single readiness check.
+type CheckResult struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// ReadyResponse is the body returned by /readyz.
+type ReadyResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Simple healths check handler
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	WriteResponse(w, &Response{
+		Message: "alive and well",
+		Status:  http.StatusOK,
+	})
+}
+
+// HealthzHandler is the liveness probe. It only reports that the process is
+// up and serving; dependencies are /readyz's job.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	HealthHandler(w, r)
+}
+
+// ReadyzHandler is the readiness probe. It checks the database, the signing
+// secret and the schema version, each bounded by config.ReadyTimeout, and
+// answers 503 if any of them fail.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+
+	checks := map[string]func(ctx context.Context) error{
+		"database": readyPingDB,
+		"signing_key": func(ctx context.Context) error {
+			secretKey, err := readyGetSecretKey(ctx)
+			if err != nil {
+				return err
+			}
+			if len(secretKey) == 0 {
+				return fmt.Errorf("secret key is empty")
+			}
+			return nil
+		},
+		"migrations": func(ctx context.Context) error {
+			version, err := readySchemaVersion(ctx)
+			if err != nil {
+				return err
+			}
+			if version < db.ExpectedSchemaVersion {
+				return fmt.Errorf("schema at version %d, expected %d", version, db.ExpectedSchemaVersion)
+			}
+			return nil
+		},
+	}
+
+	resp := ReadyResponse{Status: "ready", Checks: make(map[string]CheckResult, len(checks))}
+	status := http.StatusOK
+
+	for name, check := range checks {
+		result := runCheck(r.Context(), check)
+		if result.Status != "ok" {
+			resp.Status = "not ready"
+			status = http.StatusServiceUnavailable
+		}
+		resp.Checks[name] = result
+	}
+
+	writeJSON(w, status, resp)
+}
+
+// runCheck runs a single check with the configured timeout. Checks that are
+// not context aware still get abandoned once the deadline passes.
+func runCheck(parent context.Context, check func(ctx context.Context) error) CheckResult {
+	ctx, cancel := context.WithTimeout(parent, config.ReadyTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %v", config.ReadyTimeout)
+	}
+
+	result := CheckResult{Status: "ok", DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Status = "fail"
+		result.Error = err.Error()
+	}
+	return result
+}
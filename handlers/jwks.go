@@ -0,0 +1,15 @@
+package handlers
+
+import (
+	"auth-api/auth"
+	"net/http"
+)
+
+// JWKSHandler serves GET /.well-known/jwks.json: the public keys other
+// services verify our access tokens with, see pkg/verifier.NewWithJWKS. The
+// set is empty while tokens are signed with the shared secret.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	// verifiers refetch on an unknown kid, a short cache is enough
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, auth.PublicKeys())
+}
@@ -2,21 +2,38 @@ package handlers
 
 import (
 	"auth-api/auth"
+	"auth-api/clientip"
+	"auth-api/config"
 	"auth-api/db"
-	"auth-api/models"
-	"encoding/json"
+	"auth-api/logins"
+	"errors"
 	"net/http"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	// loginGetUserByName and createJWTFunc are overridden in tests to avoid
 	// hitting external dependencies.
-	loginGetUserByName = db.GetUserByName
-	createJWTFunc      = auth.CreateJWT
+	loginGetUserByName  = db.GetUserByName
+	createJWTFunc       = auth.CreateJWT
+	loginUpdatePassword = db.UpdatePasswordHash
+	loginCreateSession  = db.CreateSession
+	loginAssessRisk     = logins.Assess
+	loginRecordAttempt  = logins.Record
 )
 
+// loginStore hands the login flow our storage and token functions, read at
+// call time so tests can stub them.
+func loginStore() logins.Store {
+	return logins.Store{
+		GetUserByName:      loginGetUserByName,
+		UpdatePasswordHash: loginUpdatePassword,
+		CreateSession:      loginCreateSession,
+		CreateJWT:          createJWTFunc,
+		Assess:             loginAssessRisk,
+		Record:             loginRecordAttempt,
+	}
+}
+
 // LoginHandler processes POST /login requests and returns a JWT when the
 // provided credentials are valid.
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -28,52 +45,74 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defer WriteResponse(w, &resp)
+	defer logFailure(r, &resp)
 
-	var loginUserData models.ServiceUser
-	err := json.NewDecoder(r.Body).Decode(&loginUserData)
-	if err != nil {
-		resp.Message = "request denied"
-		resp.Status = http.StatusBadRequest
-		resp.Error = err
-		return
+	// the flow is shared with gRPC, see logins.Attempt. Reason feeds the
+	// login_attempts metric and the audit trail, updated as checks fail
+	attempt := logins.Attempt{
+		Store:     loginStore(),
+		Audience:  r.URL.Query().Get("audience"), // token profile, the default audience when absent
+		IP:        clientip.FromRequest(r),
+		UserAgent: r.UserAgent(),
 	}
+	defer attempt.Finish(r.Context())
 
-	// check for user existence in db/mem
-	userData, err := loginGetUserByName(loginUserData.Username)
-	if err != nil {
-		resp.Message = "username not found. register first"
-		resp.Error = err
-		resp.Status = http.StatusNotFound
-		// return
+	var body credentials
+	err := decodeJSON(w, r, &body)
+	if err == nil {
+		attempt.Username, attempt.Password = auth.NormalizeUsername(body.Username), body.Password
+		err = validationFailed(requireField(requireField(nil, "username", body.Username), "password", body.Password))
 	}
-
-	// just in case check...
-	if userData == nil {
-		userData = &models.ServiceUser{
-			Password: "123",
-		}
+	if err != nil {
+		badRequest(&resp, err)
+		attempt.Reason = "bad_request"
+		return
 	}
 
-	// if user exists, validate password
-	err = bcrypt.CompareHashAndPassword([]byte(userData.Password), []byte(loginUserData.Password))
-	if err != nil {
-		resp.Message = "password is incorrect"
-		resp.Error = err
+	// ?mode=cookie: browser clients get the tokens as cookies, see cookies.go
+	cookieMode := r.URL.Query().Get("mode") == "cookie"
+	if cookieMode && !config.CookieSessions {
+		resp.Message = "cookie sessions are disabled"
 		resp.Status = http.StatusBadRequest
+		resp.Code = CodeInvalidRequest
+		attempt.Reason = "cookie_mode_disabled"
 		return
 	}
 
-	jwtResp, err := createJWTFunc(userData.Username)
-	if err != nil {
+	jwtResp, err := attempt.Run(r.Context())
+	var data any = jwtResp
+	if err == nil && cookieMode {
+		data, err = setSessionCookies(w, jwtResp)
+		if err != nil {
+			attempt.Reason = "token_error"
+		}
+	}
+	resp.Error = err
+	switch {
+	case err == nil:
+		resp.Message = "login successful"
+		resp.Status = http.StatusOK
+		resp.Data = data
+	case errors.Is(err, auth.ErrUnknownAudience):
+		resp.Message = "unknown audience"
+		resp.Status = http.StatusBadRequest
+		resp.Code = CodeInvalidRequest
+	case errors.Is(err, logins.ErrInvalidCredentials):
+		resp.Message = "invalid username or password"
+		resp.Status = http.StatusUnauthorized
+		resp.Code = CodeInvalidCredentials
+	case errors.Is(err, logins.ErrStepUpRequired):
+		resp.Message = "login needs additional verification"
+		resp.Status = http.StatusUnauthorized
+		resp.Code = CodeStepUpRequired
+		w.Header().Set("WWW-Authenticate", BearerChallenge("insufficient_user_authentication", resp.Message))
+	case attempt.Reason == "token_error":
 		resp.Message = "failed to create jwt"
 		resp.Status = http.StatusInternalServerError
-		resp.Error = err
-		return
+		resp.Code = CodeInternal
+	default:
+		resp.Message = "failed to log in"
+		resp.Status = http.StatusInternalServerError
+		resp.Code = CodeInternal
 	}
-
-	resp.Message = "login successful"
-	resp.Status = http.StatusOK
-	resp.Error = nil
-	resp.Data = jwtResp
-
 }
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"auth-api/auth"
+	"auth-api/db"
+	"auth-api/models"
+	"net/http"
+	"strconv"
+)
+
+// listLogins is overridden in tests.
+var listLogins = db.ListLogins
+
+// defaultLoginsLimit is how many logins GET /me/logins returns without ?limit.
+const defaultLoginsLimit = 50
+
+// LoginsResponse is the body returned by GET /me/logins.
+type LoginsResponse struct {
+	Count  int                  `json:"count"`
+	Logins []models.LoginRecord `json:"logins"`
+}
+
+// MyLoginsHandler serves GET /me/logins: the caller's recent login attempts,
+// failed ones included, newest first. Optional ?limit.
+func MyLoginsHandler(w http.ResponseWriter, r *http.Request) {
+
+	resp := Response{Status: http.StatusBadRequest, Code: CodeInvalidRequest}
+
+	limit := defaultLoginsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			resp.Message = "limit must be a positive integer"
+			WriteResponse(w, &resp)
+			return
+		}
+		limit = n
+	}
+
+	records, err := listLogins(r.Context(), auth.UserFromContext(r.Context()), limit)
+	if err != nil {
+		resp.Message = "failed to list logins"
+		resp.Status = http.StatusInternalServerError
+		resp.Code = CodeInternal
+		resp.Error = err
+		logFailure(r, &resp)
+		WriteResponse(w, &resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, LoginsResponse{Count: len(records), Logins: records})
+}
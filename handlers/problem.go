@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"auth-api/pkg/verifier"
+	"encoding/json"
+	"net/http"
+)
+
+// Stable machine readable error codes. Clients branch on these, so never
+// rename one; add a new code instead.
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeValidationFailed   = "validation_failed"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeStepUpRequired     = "step_up_required"
+	CodeUsernameTaken      = "username_taken"
+	CodeTokenMissing       = "token_missing"
+	CodeTokenMalformed     = "token_malformed"
+	CodeTokenInvalid       = "token_invalid"
+	CodeTokenExpired       = "token_expired"
+	CodeTokenNotYetValid   = "token_not_yet_valid"
+	CodeTokenSignature     = "token_bad_signature"
+	CodeTokenAudience      = "token_wrong_audience"
+	CodeForbidden          = "forbidden"
+	CodeCSRF               = "csrf_failed"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeBodyTooLarge       = "body_too_large"
+	CodeUnsupportedMedia   = "unsupported_media_type"
+	CodeInternal           = "internal_error"
+)
+
+// problemTypePrefix namespaces our problem types. Append the code to get the type URI.
+const problemTypePrefix = "urn:auth-api:problem:"
+
+// ProblemContentType is the media type of RFC 7807 error bodies.
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 error body. Code repeats the last segment of Type so
+// clients don't have to parse the URI. Errors lists what was wrong with
+// which field of a rejected request body.
+type Problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Code   string       `json:"code"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is one problem with one field of a request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// defaultCode picks a code for error responses that didn't set one.
+func defaultCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeInvalidRequest
+	case http.StatusUnauthorized:
+		return CodeInvalidCredentials
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusRequestEntityTooLarge:
+		return CodeBodyTooLarge
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMedia
+	}
+	if status >= http.StatusInternalServerError {
+		return CodeInternal
+	}
+	return CodeInvalidRequest
+}
+
+// writeProblem sends resp as application/problem+json. A 401 without an
+// explicit challenge gets a plain Bearer one, since RFC 7235 requires it.
+func writeProblem(w http.ResponseWriter, resp *Response) {
+	code := resp.Code
+	if code == "" {
+		code = defaultCode(resp.Status)
+	}
+	if resp.Status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+		w.Header().Set("WWW-Authenticate", BearerChallenge("", ""))
+	}
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(resp.Status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:   problemTypePrefix + code,
+		Title:  http.StatusText(resp.Status),
+		Status: resp.Status,
+		Detail: resp.Message,
+		Code:   code,
+		Errors: resp.Fields,
+	})
+}
+
+// BearerChallenge builds an RFC 6750 WWW-Authenticate value. errCode is one of
+// invalid_request, invalid_token, insufficient_scope, or "" when the client
+// sent no credentials at all. pkg/verifier sends the very same challenges.
+func BearerChallenge(errCode, description string) string {
+	return verifier.BearerChallenge(errCode, description)
+}
@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"auth-api/audit"
+	"auth-api/auth"
+	"auth-api/config"
+	"auth-api/db"
+	"auth-api/models"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	// profile storage, overridden in tests
+	getProfile        = db.GetProfile
+	updateProfile     = db.UpdateProfile
+	deleteGetUser     = db.GetUserByName
+	softDeleteUser    = db.SoftDeleteUser
+	deleteUserForGood = db.DeleteUser
+)
+
+// limits on what PATCH /me accepts
+const (
+	maxDisplayNameLen = 64
+	maxEmailLen       = 254
+	maxMetadataBytes  = 4096
+)
+
+// optionalString tells a field sent as null (Set, Value "") from one that
+// wasn't sent at all.
+type optionalString struct {
+	Set   bool
+	Value string
+}
+
+func (o *optionalString) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if string(data) == "null" {
+		return nil
+	}
+	return json.Unmarshal(data, &o.Value)
+}
+
+// profilePatch is the body of PATCH /me. Fields left out stay as they are,
+// null clears one. Metadata is replaced as a whole.
+type profilePatch struct {
+	DisplayName optionalString  `json:"display_name"`
+	Email       optionalString  `json:"email"`
+	Metadata    json.RawMessage `json:"metadata"`
+}
+
+// accountDeletion is the body of DELETE /me.
+type accountDeletion struct {
+	Password string `json:"password"`
+}
+
+// ProfileHandler serves GET /me, the caller's profile.
+func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	profile, err := getProfile(r.Context(), auth.UserFromContext(r.Context()))
+	if err != nil {
+		resp := profileError(err, "failed to read profile")
+		logFailure(r, &resp)
+		WriteResponse(w, &resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+// UpdateProfileHandler serves PATCH /me: display_name, email and metadata
+// (any JSON object), answering with the updated profile.
+func UpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	username := auth.UserFromContext(r.Context())
+
+	var body profilePatch
+	err := decodeJSON(w, r, &body)
+	var update models.ProfileUpdate
+	if err == nil {
+		update, err = body.validate()
+	}
+	if err != nil {
+		var resp Response
+		badRequest(&resp, err)
+		logFailure(r, &resp)
+		WriteResponse(w, &resp)
+		return
+	}
+
+	var profile *models.Profile
+	if update.DisplayName == nil && update.Email == nil && update.Metadata == nil {
+		// nothing to change
+		profile, err = getProfile(r.Context(), username)
+	} else {
+		profile, err = updateProfile(r.Context(), username, update)
+
+		event := audit.FromRequest(r, audit.EventProfileUpdate)
+		event.Actor = username
+		event.Reason = changedFields(update)
+		event.Outcome = audit.OutcomeSuccess
+		if err != nil {
+			event.Outcome = audit.OutcomeFailure
+		}
+		audit.Record(r.Context(), event)
+	}
+	if err != nil {
+		resp := profileError(err, "failed to update profile")
+		logFailure(r, &resp)
+		WriteResponse(w, &resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+// validate checks the patch and turns it into the update to store.
+func (p profilePatch) validate() (models.ProfileUpdate, error) {
+	var (
+		update models.ProfileUpdate
+		fields []FieldError
+	)
+	if p.DisplayName.Set {
+		name := strings.TrimSpace(p.DisplayName.Value)
+		switch {
+		case utf8.RuneCountInString(name) > maxDisplayNameLen:
+			fields = append(fields, FieldError{Field: "display_name", Message: fmt.Sprintf("at most %d characters", maxDisplayNameLen)})
+		case strings.IndexFunc(name, unicode.IsControl) >= 0:
+			fields = append(fields, FieldError{Field: "display_name", Message: "must not contain control characters"})
+		}
+		update.DisplayName = &name
+	}
+	if p.Email.Set {
+		email := strings.TrimSpace(p.Email.Value)
+		if email != "" && !validEmail(email) {
+			fields = append(fields, FieldError{Field: "email", Message: "must be a plain email address"})
+		}
+		update.Email = &email
+	}
+	if p.Metadata != nil {
+		metadata := bytes.TrimSpace(p.Metadata)
+		switch {
+		case string(metadata) == "null":
+			update.Metadata = json.RawMessage("{}")
+		case len(metadata) == 0 || metadata[0] != '{':
+			fields = append(fields, FieldError{Field: "metadata", Message: "must be a JSON object"})
+		case len(metadata) > maxMetadataBytes:
+			fields = append(fields, FieldError{Field: "metadata", Message: fmt.Sprintf("larger than %d bytes", maxMetadataBytes)})
+		default:
+			update.Metadata = json.RawMessage(metadata)
+		}
+	}
+	return update, validationFailed(fields)
+}
+
+// validEmail accepts a bare address ("a@example.com"), no display name and
+// no angle brackets.
+func validEmail(email string) bool {
+	if len(email) > maxEmailLen {
+		return false
+	}
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Name == "" && addr.Address == email
+}
+
+// DeleteAccountHandler serves DELETE /me. The caller has to send their
+// password again. With config.AccountDeleteGrace the account is only marked
+// deleted: it can't be used and its username stays taken until the purge
+// removes it. Either way every session ends right away.
+func DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var resp = Response{Status: http.StatusOK, Message: "account deleted"}
+	defer WriteResponse(w, &resp)
+	defer logFailure(r, &resp)
+
+	username := auth.UserFromContext(r.Context())
+	reason := "ok"
+	defer func() {
+		event := audit.FromRequest(r, audit.EventAccountDelete)
+		event.Actor = username
+		event.Outcome = audit.OutcomeSuccess
+		if reason != "ok" {
+			event.Outcome = audit.OutcomeFailure
+			event.Reason = reason
+		}
+		audit.Record(r.Context(), event)
+	}()
+
+	var body accountDeletion
+	err := decodeJSON(w, r, &body)
+	if err == nil {
+		err = validationFailed(requireField(nil, "password", body.Password))
+	}
+	if err != nil {
+		badRequest(&resp, err)
+		reason = "bad_request"
+		return
+	}
+
+	user, err := deleteGetUser(r.Context(), username)
+	if err != nil {
+		resp = profileError(err, "failed to delete account")
+		reason = "db_error"
+		if resp.Status == http.StatusNotFound {
+			reason = "user_not_found"
+		}
+		return
+	}
+	if err := auth.ComparePassword(r.Context(), user.Password, body.Password); err != nil {
+		resp.Message = "wrong password"
+		resp.Status = http.StatusForbidden
+		resp.Code = CodeInvalidCredentials
+		resp.Error = err
+		reason = "invalid_password"
+		return
+	}
+
+	if config.AccountDeleteGrace > 0 {
+		err = softDeleteUser(r.Context(), user.Username)
+		resp.Status = http.StatusAccepted
+		resp.Message = "account deleted. it is purged for good after " +
+			time.Now().Add(config.AccountDeleteGrace).UTC().Format(time.RFC3339)
+	} else {
+		err = deleteUserForGood(r.Context(), user.Username)
+	}
+	if err != nil {
+		resp = profileError(err, "failed to delete account")
+		reason = "db_error"
+		return
+	}
+
+	if config.CookieSessions {
+		clearSessionCookies(w)
+	}
+}
+
+// profileError is the response for a failed profile lookup or change. The
+// account being gone is a 404: it was deleted after the token was issued.
+func profileError(err error, message string) Response {
+	if errors.Is(err, db.ErrNotFound) {
+		return Response{Message: "account not found", Status: http.StatusNotFound, Code: CodeNotFound, Error: err}
+	}
+	return Response{Message: message, Status: http.StatusInternalServerError, Code: CodeInternal, Error: err}
+}
+
+// changedFields lists the fields update sets, for the audit log.
+func changedFields(update models.ProfileUpdate) string {
+	var fields []string
+	if update.DisplayName != nil {
+		fields = append(fields, "display_name")
+	}
+	if update.Email != nil {
+		fields = append(fields, "email")
+	}
+	if update.Metadata != nil {
+		fields = append(fields, "metadata")
+	}
+	return strings.Join(fields, ",")
+}
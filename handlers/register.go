@@ -1,20 +1,24 @@
 package handlers
 
 import (
+	"auth-api/audit"
+	"auth-api/auth"
+	"auth-api/clientip"
+	"auth-api/config"
 	"auth-api/db"
+	"auth-api/geoip"
+	"auth-api/metrics"
 	"auth-api/models"
-	"encoding/json"
-	"net"
+	"errors"
 	"net/http"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	// registerGetUserByName and registerUserFunc allow tests to substitute
 	// database access during handler execution.
-	registerGetUserByName = db.GetUserByName
-	registerUserFunc      = db.RegisterUser
+	registerGetUserByName      = db.GetUserByName
+	registerConfusableUsername = db.ConfusableUsername
+	registerUserFunc           = db.RegisterUser
 )
 
 // RegisterHandler handles POST /register requests and creates new user
@@ -28,59 +32,127 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defer WriteResponse(w, &resp)
+	defer logFailure(r, &resp)
 
 	var user models.ServiceUser
 
-	err := json.NewDecoder(r.Body).Decode(&user)
-	if err != nil {
-		resp.Error = err
-		resp.Message = "invalid json"
-		resp.Status = http.StatusBadRequest
-		return
+	// reason feeds the registrations metric and the audit trail, updated as checks fail
+	reason := "ok"
+	defer func() {
+		outcome := metrics.OutcomeFailure
+		if reason == "ok" {
+			outcome = metrics.OutcomeSuccess
+		}
+		metrics.Registrations.WithLabelValues(outcome, reason).Inc()
+
+		event := audit.FromRequest(r, audit.EventRegister)
+		event.Actor = user.Username
+		event.Outcome = outcome
+		if outcome == metrics.OutcomeFailure {
+			event.Reason = reason
+		}
+		audit.Record(r.Context(), event)
+	}()
+
+	var body credentials
+	err := decodeJSON(w, r, &body)
+	if err == nil {
+		user.Username, user.Password = auth.NormalizeUsername(body.Username), body.Password
+		err = validationFailed(requireField(validateUsername(user.Username), "password", body.Password))
 	}
-	if user.Username == "" || user.Password == "" {
-		resp.Message = "username and password required"
-		resp.Status = http.StatusBadRequest
+	if err != nil {
+		badRequest(&resp, err)
+		reason = "bad_request"
 		return
 	}
 
-	// check if username exists in database
-	// service user should be nil for an non-existent user
-	serviceUser, err := registerGetUserByName(user.Username)
-	if serviceUser != nil {
-		resp.Message = "username taken. pick another"
+	// hash before looking the name up, so a taken name costs the same time as a free one
+	hashedPass, err := auth.HashPassword(r.Context(), user.Password)
+	if err != nil {
+		resp.Message = "error hashing password"
 		resp.Error = err
-		resp.Status = http.StatusConflict
+		resp.Status = http.StatusInternalServerError
+		resp.Code = CodeInternal
+		reason = "hash_error"
 		return
 	}
 
-	hashedPass, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-	if err != nil {
-		resp.Message = "error hashing password"
+	// check if username exists in database, in any case or a look-alike spelling.
+	// the insert below has the final say, this catches look-alikes and spares
+	// the common case a failed insert
+	serviceUser, err := registerGetUserByName(r.Context(), user.Username)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		resp.Message = "failed to check username"
 		resp.Error = err
 		resp.Status = http.StatusInternalServerError
+		resp.Code = CodeInternal
+		reason = "db_error"
 		return
 	}
-
-	user.Password = string(hashedPass)
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		ip = r.RemoteAddr
+	if serviceUser == nil {
+		var lookalike string
+		lookalike, err = registerConfusableUsername(r.Context(), user.Username)
+		if err != nil {
+			resp.Message = "failed to check username"
+			resp.Error = err
+			resp.Status = http.StatusInternalServerError
+			resp.Code = CodeInternal
+			reason = "db_error"
+			return
+		}
+		if lookalike != "" {
+			serviceUser = &models.ServiceUser{Username: lookalike}
+		}
+	}
+	if serviceUser != nil {
+		reason = "username_taken"
+		usernameTakenResponse(&resp)
+		return
 	}
-	user.IP_addr = ip
-	user.Location = getLocation()
 
-	err = registerUserFunc(user)
+	user.Password = hashedPass
+	user.IP_addr = clientip.FromRequest(r)
+	user.Location = geoip.Lookup(user.IP_addr)
+
+	err = registerUserFunc(r.Context(), user)
+	if errors.Is(err, db.ErrUsernameTaken) {
+		// a concurrent registration of the same name got in first
+		reason = "username_taken"
+		usernameTakenResponse(&resp)
+		return
+	}
 	if err != nil {
 		resp.Error = err
 		resp.Message = "failed to register user"
 		resp.Status = http.StatusInternalServerError
+		resp.Code = CodeInternal
+		reason = "db_error"
+		return
+	}
+	if config.RegisterConcealExisting {
+		concealedRegisterResponse(&resp)
 		return
 	}
 	resp.Message = "user created successfully. proceed to login"
 	resp.Status = http.StatusCreated
 }
 
-func getLocation() string {
-	return "Internet"
+// usernameTakenResponse is the answer for a taken username: a 409, or the
+// concealed answer when config.RegisterConcealExisting is on.
+func usernameTakenResponse(resp *Response) {
+	if config.RegisterConcealExisting {
+		concealedRegisterResponse(resp)
+		return
+	}
+	resp.Message = "username taken. pick another"
+	resp.Status = http.StatusConflict
+	resp.Code = CodeUsernameTaken
+}
+
+// concealedRegisterResponse is the one answer /register gives for both new
+// and taken usernames when config.RegisterConcealExisting is on.
+func concealedRegisterResponse(resp *Response) {
+	resp.Message = "registration received. if the username was available you can now log in"
+	resp.Status = http.StatusAccepted
+	resp.Error = nil
 }
@@ -2,11 +2,17 @@ package handlers
 
 import (
 	"encoding/json"
+	"log/slog"
 	"net/http"
 )
 
 // Helper function to handle early exists (in middleware, etc)
+// Error statuses (4xx/5xx) go out as RFC 7807 problem+json instead.
 func WriteResponse(w http.ResponseWriter, resp *Response) {
+	if resp.Status >= http.StatusBadRequest {
+		writeProblem(w, resp)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(resp.Status)
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
@@ -15,10 +21,33 @@ func WriteResponse(w http.ResponseWriter, resp *Response) {
 	}
 }
 
+// writeJSON sends any value as a JSON body, for responses that don't fit the
+// Response envelope.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// logFailure records resp.Error, which never reaches the client. Server side
+// failures are logged as errors, client mistakes only at debug level.
+func logFailure(r *http.Request, resp *Response) {
+	if resp.Error == nil {
+		return
+	}
+	level := slog.LevelDebug
+	if resp.Status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	slog.Log(r.Context(), level, resp.Message, "status", resp.Status, "error", resp.Error)
+}
+
 // Response structs carries some often needed fields for middleware
 type Response struct {
-	Message string `json:"message"`
-	Error   error  `json:"-"`	// could get rid of this field.
-	Status  int    `json:"-"` // http status of the response
-	Data    any    `json:"auth,omitempty"`
+	Message string       `json:"message"`
+	Error   error        `json:"-"` // could get rid of this field.
+	Status  int          `json:"-"` // http status of the response
+	Code    string       `json:"-"` // stable error code for problem responses, see problem.go
+	Fields  []FieldError `json:"-"` // field level details for problem responses
+	Data    any          `json:"auth,omitempty"`
 }
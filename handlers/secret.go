@@ -33,11 +33,3 @@ func SecretHandlerTest(w http.ResponseWriter, r *http.Request) {
 		Status: http.StatusOK,
 	})
 }
-
-// Simple healths check handler
-func HealthHandler(w http.ResponseWriter, r *http.Request) {
-	WriteResponse(w, &Response{
-		Message: "alive and well",
-		Status:  http.StatusOK,
-	})
-}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"auth-api/audit"
+	"auth-api/auth"
+	"auth-api/config"
+	"auth-api/db"
+	"auth-api/models"
+	"errors"
+	"net/http"
+)
+
+var (
+	// session storage, overridden in tests
+	listSessions        = db.ListSessions
+	getSession          = db.GetSession
+	deleteSession       = db.DeleteSession
+	rotateSessionTokens = db.RotateSessionTokens
+)
+
+// SessionView is a session as shown to its owner.
+type SessionView struct {
+	models.Session
+	Current bool `json:"current"`
+}
+
+// SessionsResponse is the body returned by GET /sessions.
+type SessionsResponse struct {
+	Count    int           `json:"count"`
+	Sessions []SessionView `json:"sessions"`
+}
+
+// refreshRequest is the body of POST /refresh.
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// SessionsHandler serves GET /sessions: the caller's active sessions, with
+// the one making the request flagged as current.
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	username := auth.UserFromContext(r.Context())
+	sessions, err := listSessions(r.Context(), username)
+	if err != nil {
+		resp := Response{
+			Message: "failed to list sessions",
+			Status:  http.StatusInternalServerError,
+			Code:    CodeInternal,
+			Error:   err,
+		}
+		logFailure(r, &resp)
+		WriteResponse(w, &resp)
+		return
+	}
+
+	current := auth.SessionIDFromContext(r.Context())
+	views := make([]SessionView, 0, len(sessions))
+	for _, s := range sessions {
+		views = append(views, SessionView{Session: s, Current: s.ID == current})
+	}
+	writeJSON(w, http.StatusOK, SessionsResponse{Count: len(views), Sessions: views})
+}
+
+// DeleteSessionHandler serves DELETE /sessions/{id}. The session's tokens
+// stop working right away, including the refresh token.
+func DeleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	var resp = Response{Status: http.StatusOK, Message: "session revoked"}
+	defer WriteResponse(w, &resp)
+	defer logFailure(r, &resp)
+
+	username := auth.UserFromContext(r.Context())
+	err := revokeSession(r, username, r.PathValue("id"), "")
+	switch {
+	case errors.Is(err, db.ErrSessionNotFound):
+		resp.Message = "session not found"
+		resp.Status = http.StatusNotFound
+		resp.Code = CodeNotFound
+	case err != nil:
+		resp.Message = "failed to revoke session"
+		resp.Status = http.StatusInternalServerError
+		resp.Code = CodeInternal
+		resp.Error = err
+	}
+}
+
+// LogoutHandler serves POST /logout, ending the session of the presented token.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	var resp = Response{Status: http.StatusOK, Message: "logged out"}
+	defer WriteResponse(w, &resp)
+	defer logFailure(r, &resp)
+
+	if config.CookieSessions {
+		clearSessionCookies(w)
+	}
+
+	username := auth.UserFromContext(r.Context())
+	err := revokeSession(r, username, auth.SessionIDFromContext(r.Context()), "logout")
+	if err != nil && !errors.Is(err, db.ErrSessionNotFound) {
+		resp.Message = "failed to log out"
+		resp.Status = http.StatusInternalServerError
+		resp.Code = CodeInternal
+		resp.Error = err
+	}
+}
+
+// RefreshHandler serves POST /refresh. It trades a refresh token for a new
+// access token and a new refresh token; the old refresh token is spent.
+// Presenting the refresh token spent by the last refresh again ends the whole
+// session, since one of the two parties holding it isn't the user. Any other
+// wrong token is only refused.
+// In cookie mode the refresh token comes from its cookie instead of the body,
+// and the new pair goes back as cookies.
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var resp = Response{
+		Status:  http.StatusUnauthorized,
+		Message: "invalid refresh token",
+		Code:    CodeTokenInvalid,
+	}
+	defer WriteResponse(w, &resp)
+	defer logFailure(r, &resp)
+
+	// cookie sessions send no body at all
+	var body refreshRequest
+	err := decodeJSON(w, r, &body)
+	if errors.Is(err, errEmptyBody) {
+		err = nil
+	}
+	if err != nil {
+		badRequest(&resp, err)
+		return
+	}
+	cookieMode := false
+	if body.RefreshToken == "" && config.CookieSessions {
+		if cookie, cookieErr := r.Cookie(RefreshCookie); cookieErr == nil && cookie.Value != "" {
+			body.RefreshToken, cookieMode = cookie.Value, true
+		}
+	}
+	if cookieMode && !ValidCSRF(r) {
+		resp.Message = "missing or wrong " + CSRFHeader + " header"
+		resp.Status = http.StatusForbidden
+		resp.Code = CodeCSRF
+		return
+	}
+	if body.RefreshToken == "" {
+		badRequest(&resp, validationFailed(requireField(nil, "refresh_token", "")))
+		return
+	}
+
+	sessionID, ok := auth.SessionIDFromRefreshToken(body.RefreshToken)
+	if !ok {
+		return
+	}
+	session, err := getSession(r.Context(), sessionID)
+	if err != nil {
+		if !errors.Is(err, db.ErrSessionNotFound) {
+			resp.Message = "failed to refresh token"
+			resp.Status = http.StatusInternalServerError
+			resp.Code = CodeInternal
+		}
+		resp.Error = err
+		return
+	}
+
+	switch auth.CheckRefreshToken(body.RefreshToken, session.RefreshHash, session.PreviousRefreshHash) {
+	case auth.RefreshReused:
+		resp.Error = revokeSession(r, session.Username, session.ID, "refresh_token_reuse")
+		return
+	case auth.RefreshUnknown:
+		return
+	}
+	oldHash := session.RefreshHash
+
+	jwtResp, err := createJWTFunc(r.Context(), session.Username, session.ID, session.Audience)
+	if err == nil {
+		jwtResp.RefreshToken, err = auth.NewRefreshToken(session.ID)
+	}
+	if err != nil {
+		resp.Message = "failed to refresh token"
+		resp.Status = http.StatusInternalServerError
+		resp.Code = CodeInternal
+		resp.Error = err
+		return
+	}
+
+	err = rotateSessionTokens(r.Context(), session.ID, oldHash,
+		auth.HashToken(jwtResp.RefreshToken), auth.HashToken(jwtResp.AccessToken), config.RefreshTokenTTL)
+	if err != nil {
+		// lost a race with another refresh of the same token
+		if !errors.Is(err, db.ErrSessionNotFound) {
+			resp.Message = "failed to refresh token"
+			resp.Status = http.StatusInternalServerError
+			resp.Code = CodeInternal
+		}
+		resp.Error = err
+		return
+	}
+
+	var data any = jwtResp
+	if cookieMode {
+		data, err = setSessionCookies(w, jwtResp)
+		if err != nil {
+			resp.Message = "failed to refresh token"
+			resp.Status = http.StatusInternalServerError
+			resp.Code = CodeInternal
+			resp.Error = err
+			return
+		}
+	}
+
+	resp.Message = "token refreshed"
+	resp.Status = http.StatusOK
+	resp.Code = ""
+	resp.Data = data
+}
+
+// revokeSession deletes one of username's sessions and records it in the
+// audit log. reason is empty for a plain user initiated revocation.
+func revokeSession(r *http.Request, username, sessionID, reason string) error {
+	err := deleteSession(r.Context(), username, sessionID)
+
+	event := audit.FromRequest(r, audit.EventTokenRevoked)
+	event.Actor = username
+	event.Target = sessionID
+	event.Reason = reason
+	event.Outcome = audit.OutcomeSuccess
+	if err != nil {
+		event.Outcome = audit.OutcomeFailure
+	}
+	audit.Record(r.Context(), event)
+	return err
+}
@@ -0,0 +1,13 @@
+-- tracks which of the numbered init files have been applied.
+-- /readyz compares the highest version here against db.ExpectedSchemaVersion,
+-- so every new init file must insert its own number at the end.
+
+begin;
+create table if not exists jwt_auth.schema_migrations (
+    version integer primary key,
+    applied_at timestamp not null default now()
+);
+alter table jwt_auth.schema_migrations owner to token_master;
+
+insert into jwt_auth.schema_migrations (version) values (1), (2) on conflict do nothing;
+commit;
@@ -0,0 +1,35 @@
+-- append-only log of security events: registrations, logins, token issuance,
+-- revocations, password changes and admin actions.
+-- rows can be inserted and read, never changed. the trigger enforces that even for the owner.
+
+begin;
+create table if not exists jwt_auth.audit_events (
+    id bigserial primary key,
+    occurred_at timestamptz not null default now(),
+    event_type text not null,
+    actor text,
+    target text,
+    outcome text not null,
+    reason text,
+    ip_addr inet,
+    user_agent text,
+    request_id text
+);
+alter table jwt_auth.audit_events owner to token_master;
+
+create index if not exists audit_events_occurred_at_idx on jwt_auth.audit_events (occurred_at desc);
+create index if not exists audit_events_actor_idx on jwt_auth.audit_events (actor, occurred_at desc);
+
+create or replace function jwt_auth.audit_events_append_only() returns trigger as $$
+begin
+    raise exception 'audit_events is append-only';
+end;
+$$ language plpgsql;
+
+drop trigger if exists audit_events_append_only on jwt_auth.audit_events;
+create trigger audit_events_append_only
+    before update or delete on jwt_auth.audit_events
+    for each row execute function jwt_auth.audit_events_append_only();
+
+insert into jwt_auth.schema_migrations (version) values (3) on conflict do nothing;
+commit;
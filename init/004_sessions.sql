@@ -0,0 +1,19 @@
+-- every login is a session: one row in tokens per access/refresh token pair.
+-- the JWT carries the session id (sid claim), so deleting the row kills the tokens.
+-- jwt_token holds a sha256 of the latest access token, never the token itself.
+
+begin;
+alter table jwt_auth.tokens add column if not exists session_id text;
+update jwt_auth.tokens set session_id = md5(random()::text) where session_id is null;
+alter table jwt_auth.tokens alter column session_id set not null;
+alter table jwt_auth.tokens add primary key (session_id);
+
+alter table jwt_auth.tokens add column if not exists refresh_token_hash text;
+alter table jwt_auth.tokens add column if not exists user_agent text;
+alter table jwt_auth.tokens add column if not exists ip_addr inet;
+alter table jwt_auth.tokens add column if not exists last_used_at timestamp;
+
+create index if not exists tokens_user_id_idx on jwt_auth.tokens (user_id);
+
+insert into jwt_auth.schema_migrations (version) values (4) on conflict do nothing;
+commit;
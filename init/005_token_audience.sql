@@ -0,0 +1,8 @@
+-- sessions remember the audience their tokens were issued for, so a refresh
+-- keeps it. empty means the default audience.
+
+begin;
+alter table jwt_auth.tokens add column if not exists audience text not null default '';
+
+insert into jwt_auth.schema_migrations (version) values (5) on conflict do nothing;
+commit;
@@ -0,0 +1,31 @@
+-- usernames are unique regardless of case: "Alice" and "alice" are one account.
+-- new names are stored normalized (NFKC, lowercased) by the api, older rows
+-- keep their spelling and are matched with lower().
+-- username_skeleton() folds look-alike characters (0/o, 1/l/i, rn/m, vv/w) so
+-- registration can refuse "a1ice" next to "alice". auth.UsernameSkeleton has
+-- the same rules, keep the two in step.
+
+begin;
+do $$
+declare
+    dupes text;
+begin
+    select string_agg(names, '; ') into dupes from (
+        select string_agg(username, ', ') as names
+        from jwt_auth.users group by lower(username) having count(*) > 1
+    ) d;
+    if dupes is not null then
+        raise exception 'usernames differing only in case, rename or merge them first: %', dupes;
+    end if;
+end $$;
+
+create unique index if not exists users_username_lower_key on jwt_auth.users (lower(username));
+
+create or replace function jwt_auth.username_skeleton(name text) returns text
+    language sql immutable strict
+    as $$ select replace(replace(translate(lower(name), '01i', 'oll'), 'rn', 'm'), 'vv', 'w') $$;
+
+create index if not exists users_username_skeleton_idx on jwt_auth.users (jwt_auth.username_skeleton(username));
+
+insert into jwt_auth.schema_migrations (version) values (6) on conflict do nothing;
+commit;
@@ -0,0 +1,27 @@
+-- every login attempt on an existing account, successful or not, with where
+-- it came from. unknown usernames have no account to attach to, the audit log
+-- has those.
+-- country and coordinates are the geoip lookup at the time, the risk rules
+-- compare new logins against them. risk lists the rules a login tripped.
+
+begin;
+create table if not exists jwt_auth.login_history (
+    id bigserial primary key,
+    user_id integer not null references jwt_auth.users(id) on delete cascade,
+    occurred_at timestamptz not null default now(),
+    success boolean not null,
+    reason text,
+    ip_addr inet,
+    location text,
+    country text,
+    latitude double precision,
+    longitude double precision,
+    user_agent text,
+    risk text[] not null default '{}'
+);
+alter table jwt_auth.login_history owner to token_master;
+
+create index if not exists login_history_user_idx on jwt_auth.login_history (user_id, occurred_at desc);
+
+insert into jwt_auth.schema_migrations (version) values (7) on conflict do nothing;
+commit;
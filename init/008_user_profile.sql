@@ -0,0 +1,17 @@
+-- profile fields a user can change about themselves, and soft deletion.
+-- a deleted account keeps its row (and so its username) for the grace
+-- period, unusable: its sessions are gone and logins treat it as unknown.
+-- the api purges rows deleted longer ago than ACCOUNT_DELETE_GRACE, which
+-- cascades to tokens and login_history.
+
+begin;
+alter table jwt_auth.users add column if not exists display_name text;
+alter table jwt_auth.users add column if not exists email text;
+alter table jwt_auth.users add column if not exists metadata jsonb not null default '{}';
+alter table jwt_auth.users add column if not exists updated_at timestamptz;
+alter table jwt_auth.users add column if not exists deleted_at timestamptz;
+
+create index if not exists users_deleted_at_idx on jwt_auth.users (deleted_at) where deleted_at is not null;
+
+insert into jwt_auth.schema_migrations (version) values (8) on conflict do nothing;
+commit;
@@ -0,0 +1,9 @@
+-- a refresh keeps the hash of the refresh token it spent. presenting that one
+-- again is reuse and ends the session. any other wrong token is just refused:
+-- the session id in front of it is no secret.
+
+begin;
+alter table jwt_auth.tokens add column if not exists previous_refresh_token_hash text;
+
+insert into jwt_auth.schema_migrations (version) values (9) on conflict do nothing;
+commit;
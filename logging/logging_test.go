@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// TestNewAddsRequestID ensures log lines written with a request scoped context
+// carry the request id.
+func TestNewAddsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "info", "json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx := WithRequestID(context.Background(), "req-123")
+	logger.InfoContext(ctx, "hello", "user", "alice")
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected json output, got %q: %v", buf.String(), err)
+	}
+	if line["request_id"] != "req-123" || line["user"] != "alice" || line["msg"] != "hello" {
+		t.Fatalf("unexpected log line: %v", line)
+	}
+}
+
+// TestNewLevelAndFormat checks level filtering and rejects unknown settings.
+func TestNewLevelAndFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "warn", "text")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	logger.Info("dropped")
+	if buf.Len() != 0 {
+		t.Fatalf("expected info to be filtered at warn level, got %q", buf.String())
+	}
+	logger.With("user", "alice").WithGroup("g").Warn("kept")
+	if !bytes.Contains(buf.Bytes(), []byte("msg=kept")) {
+		t.Fatalf("expected text output, got %q", buf.String())
+	}
+
+	if _, err := New(&buf, "loud", "json"); err == nil {
+		t.Fatalf("expected invalid level to be rejected")
+	}
+	if _, err := New(&buf, "info", "xml"); err == nil {
+		t.Fatalf("expected invalid format to be rejected")
+	}
+}
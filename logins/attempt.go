@@ -0,0 +1,223 @@
+package logins
+
+import (
+	"auth-api/audit"
+	"auth-api/auth"
+	"auth-api/config"
+	"auth-api/db"
+	"auth-api/logging"
+	"auth-api/metrics"
+	"auth-api/models"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// What a login can fail with besides storage errors. The transports turn
+// them into their own statuses.
+var (
+	// ErrInvalidCredentials covers unknown users and wrong passwords alike.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrStepUpRequired means the password was right but a risk rule set to
+	// step_up tripped.
+	ErrStepUpRequired = errors.New("login needs additional verification")
+)
+
+// Store is what a login reads and writes. HTTP and gRPC each fill one from
+// their own package variables, which their tests stub.
+type Store struct {
+	GetUserByName      func(ctx context.Context, username string) (*models.ServiceUser, error)
+	UpdatePasswordHash func(ctx context.Context, username, hashed string) error
+	CreateSession      func(ctx context.Context, session models.Session, ttl time.Duration) error
+	CreateJWT          func(ctx context.Context, username, sessionID, audience string) (auth.JWTResponse, error)
+	Assess             func(ctx context.Context, rec *models.LoginRecord) bool
+	Record             func(ctx context.Context, rec models.LoginRecord)
+}
+
+// Attempt is one login, run the same way over HTTP and gRPC. Fill in the
+// exported fields, defer Finish, then Run.
+type Attempt struct {
+	Store Store
+
+	Username  string // already normalized, see auth.NormalizeUsername
+	Password  string
+	Audience  string // "" for the default audience
+	IP        string
+	UserAgent string
+
+	// Reason is "ok" or why the attempt failed, for the login_attempts
+	// metric, the audit log and login_history. Callers set it for failures
+	// Run doesn't see, like a body that doesn't parse.
+	Reason string
+
+	// record is the login_history entry, for usernames that have an account
+	record *models.LoginRecord
+}
+
+// Run checks the password and starts a session for audience. Unknown users
+// and wrong passwords must look identical from the outside: the same
+// ErrInvalidCredentials after a full password compare either way. Reason
+// keeps the real story.
+func (a *Attempt) Run(ctx context.Context) (auth.JWTResponse, error) {
+	a.Reason = "ok"
+	if _, err := auth.ProfileFor(a.Audience); err != nil {
+		a.Reason = "unknown_audience"
+		return auth.JWTResponse{}, err
+	}
+
+	user, err := a.Store.GetUserByName(ctx, a.Username)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		a.Reason = "db_error"
+		return auth.JWTResponse{}, err
+	}
+	if user == nil {
+		a.Reason = "user_not_found"
+		user = &models.ServiceUser{Password: auth.DummyPasswordHash()}
+	} else {
+		rec := NewRecord(user.Username, a.IP, a.UserAgent)
+		a.record = &rec
+	}
+
+	compareErr := auth.ComparePassword(ctx, user.Password, a.Password)
+	if a.Reason == "ok" && compareErr != nil {
+		a.Reason = "invalid_password"
+	}
+	if a.Reason != "ok" {
+		return auth.JWTResponse{}, errors.Join(ErrInvalidCredentials, compareErr)
+	}
+
+	// the password is right, but the risk rules may want more than that.
+	// saying so tells the caller the password was right: step up is opt-in
+	if a.assessRisk(ctx) {
+		a.Reason = "step_up_required"
+		return auth.JWTResponse{}, ErrStepUpRequired
+	}
+
+	// the only moment we hold the plaintext: move old hashes to the current algorithm/cost
+	if auth.NeedsRehash(user.Password) {
+		a.rehashPassword(ctx, user.Username)
+	}
+
+	tokens, err := a.startSession(ctx, user.Username)
+	if err != nil {
+		a.Reason = "token_error"
+		return auth.JWTResponse{}, err
+	}
+
+	issued := a.event(ctx, audit.EventTokenIssued)
+	issued.Actor = user.Username
+	issued.Outcome = audit.OutcomeSuccess
+	audit.Record(ctx, issued)
+	return tokens, nil
+}
+
+// Finish accounts for the attempt however it ended: the login_attempts
+// metric, the login audit event and, for an existing account, its
+// login_history entry.
+func (a *Attempt) Finish(ctx context.Context) {
+	outcome := metrics.OutcomeFailure
+	if a.Reason == "ok" {
+		outcome = metrics.OutcomeSuccess
+	}
+	metrics.LoginOutcomes.WithLabelValues(outcome, a.Reason).Inc()
+
+	event := a.event(ctx, audit.EventLogin)
+	event.Actor = a.Username
+	event.Outcome = outcome
+	if outcome == metrics.OutcomeFailure {
+		event.Reason = a.Reason
+	}
+	audit.Record(ctx, event)
+
+	if a.record != nil {
+		a.record.Success = outcome == metrics.OutcomeSuccess
+		if !a.record.Success {
+			a.record.Reason = a.Reason
+		}
+		a.Store.Record(ctx, *a.record)
+	}
+}
+
+// assessRisk runs the risk rules on a login with the right password and
+// audits what they found. It reports whether the login needs a step up.
+func (a *Attempt) assessRisk(ctx context.Context) bool {
+	stepUp := a.Store.Assess(ctx, a.record)
+	if len(a.record.Risk) == 0 {
+		return stepUp
+	}
+
+	event := a.event(ctx, audit.EventLoginRisk)
+	event.Actor = a.record.Username
+	event.Reason = strings.Join(a.record.Risk, ",")
+	event.Outcome = audit.OutcomeSuccess
+	if stepUp {
+		event.Outcome = audit.OutcomeFailure
+	}
+	audit.Record(ctx, event)
+	return stepUp
+}
+
+// rehashPassword stores a fresh hash of the password for username. Failing
+// here must not fail the login, the old hash still works.
+func (a *Attempt) rehashPassword(ctx context.Context, username string) {
+	outcome := metrics.OutcomeSuccess
+	defer func() {
+		metrics.PasswordRehashes.WithLabelValues(outcome).Inc()
+	}()
+
+	hashed, err := auth.HashPassword(ctx, a.Password)
+	if err == nil {
+		err = a.Store.UpdatePasswordHash(ctx, username, hashed)
+	}
+	if err != nil {
+		outcome = metrics.OutcomeFailure
+		slog.WarnContext(ctx, "failed to upgrade password hash", "username", username, "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "upgraded password hash", "username", username)
+}
+
+// startSession opens a new session for username and returns its access and
+// refresh tokens.
+func (a *Attempt) startSession(ctx context.Context, username string) (auth.JWTResponse, error) {
+	sessionID, err := auth.NewSessionID()
+	if err != nil {
+		return auth.JWTResponse{}, err
+	}
+	tokens, err := a.Store.CreateJWT(ctx, username, sessionID, a.Audience)
+	if err != nil {
+		return auth.JWTResponse{}, err
+	}
+	refreshToken, err := auth.NewRefreshToken(sessionID)
+	if err != nil {
+		return auth.JWTResponse{}, err
+	}
+
+	err = a.Store.CreateSession(ctx, models.Session{
+		ID:          sessionID,
+		Username:    username,
+		UserAgent:   a.UserAgent,
+		IP_addr:     a.IP,
+		Audience:    a.Audience,
+		AccessHash:  auth.HashToken(tokens.AccessToken),
+		RefreshHash: auth.HashToken(refreshToken),
+	}, config.RefreshTokenTTL)
+	if err != nil {
+		return auth.JWTResponse{}, err
+	}
+	tokens.RefreshToken = refreshToken
+	return tokens, nil
+}
+
+// event starts an audit event about the attempt, like audit.FromRequest.
+func (a *Attempt) event(ctx context.Context, eventType string) models.AuditEvent {
+	return models.AuditEvent{
+		Time:      time.Now().UTC(),
+		Type:      eventType,
+		IP_addr:   a.IP,
+		UserAgent: a.UserAgent,
+		RequestID: logging.RequestID(ctx),
+	}
+}
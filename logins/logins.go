@@ -0,0 +1,202 @@
+// Package logins keeps the login history of every account and runs the risk
+// rules over each login that got the password right: a country the account
+// never logged in from, travel faster than a plane since the last login, a
+// device (user agent) it hasn't seen before. Attempt is the login itself,
+// shared by the HTTP handler and the gRPC service.
+package logins
+
+import (
+	"auth-api/config"
+	"auth-api/db"
+	"auth-api/geoip"
+	"auth-api/models"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Risk rules. Keep these stable, they end up in login_history, the audit
+// log and LOGIN_RISK_ACTIONS.
+const (
+	RuleNewCountry       = "new_country"
+	RuleImpossibleTravel = "impossible_travel"
+	RuleNewDevice        = "new_device"
+)
+
+// What tripping a rule does to the login. ActionFlag lets it through,
+// recorded and audited. ActionStepUp refuses it until the user can prove
+// more than a password.
+const (
+	ActionFlag   = "flag"
+	ActionStepUp = "step_up"
+)
+
+const (
+	// historySize is how many earlier successful logins the rules look at.
+	historySize = 50
+	// minTravelKm is below geoip's accuracy, shorter hops are never
+	// impossible travel.
+	minTravelKm   = 100
+	earthRadiusKm = 6371
+)
+
+var (
+	// storage, overridden in tests
+	insertLogin     = db.InsertLogin
+	listKnownLogins = db.ListSuccessfulLogins
+
+	mu      sync.RWMutex
+	actions = map[string]string{}
+)
+
+// ParseActions reads rule=action pairs, see config.LoginRiskActions.
+func ParseActions(pairs []string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, pair := range pairs {
+		rule, action, _ := strings.Cut(pair, "=")
+		rule, action = strings.TrimSpace(rule), strings.TrimSpace(action)
+		switch rule {
+		case RuleNewCountry, RuleImpossibleTravel, RuleNewDevice:
+		default:
+			return nil, fmt.Errorf("unknown risk rule %q", rule)
+		}
+		if action != ActionFlag && action != ActionStepUp {
+			return nil, fmt.Errorf("unknown action %q for %s, want %s or %s", action, rule, ActionFlag, ActionStepUp)
+		}
+		out[rule] = action
+	}
+	return out, nil
+}
+
+// SetActions replaces what each rule does. Rules left out are flagged.
+func SetActions(a map[string]string) {
+	mu.Lock()
+	defer mu.Unlock()
+	actions = a
+}
+
+// NewRecord starts the login_history record of an attempt on username from
+// ip, placed with geoip.
+func NewRecord(username, ip, userAgent string) models.LoginRecord {
+	place := geoip.Locate(ip)
+	rec := models.LoginRecord{
+		Username:  username,
+		Time:      time.Now().UTC(),
+		IP_addr:   ip,
+		Location:  place.String(),
+		Country:   place.CountryCode,
+		UserAgent: userAgent,
+	}
+	if place.HasCoords {
+		rec.Latitude, rec.Longitude = &place.Latitude, &place.Longitude
+	}
+	return rec
+}
+
+// Assess runs the risk rules over rec, a login with the right password, and
+// sets rec.Risk. stepUp reports whether a tripped rule wants more than a
+// password. A history we can't read assesses as no risk: a database hiccup
+// must not lock everyone out.
+func Assess(ctx context.Context, rec *models.LoginRecord) (stepUp bool) {
+	// successful logins only: failed ones are free for anyone to add and
+	// would push the real ones out of the window
+	history, err := listKnownLogins(ctx, rec.Username, historySize)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to read login history, skipping risk rules", "username", rec.Username, "error", err)
+		return false
+	}
+	rec.Risk = Evaluate(*rec, history, float64(config.LoginRiskMaxSpeedKmh))
+	if len(rec.Risk) == 0 {
+		return false
+	}
+
+	mu.RLock()
+	for _, rule := range rec.Risk {
+		stepUp = stepUp || actions[rule] == ActionStepUp
+	}
+	mu.RUnlock()
+
+	slog.WarnContext(ctx, "risky login",
+		"username", rec.Username,
+		"risk", rec.Risk,
+		"step_up", stepUp,
+		"ip", rec.IP_addr,
+		"location", rec.Location,
+	)
+	return stepUp
+}
+
+// Evaluate returns the rules rec trips, given the account's earlier logins
+// newest first. Only successful logins count as known, failed ones may well
+// have been someone else. An account without any has nothing to compare
+// against, so its first login trips nothing.
+func Evaluate(rec models.LoginRecord, history []models.LoginRecord, maxSpeedKmh float64) []string {
+	var known []models.LoginRecord
+	for _, h := range history {
+		if h.Success {
+			known = append(known, h)
+		}
+	}
+	if len(known) == 0 {
+		return nil
+	}
+
+	var risk []string
+	hasCountry := func(h models.LoginRecord) bool { return h.Country != "" }
+	sameCountry := func(h models.LoginRecord) bool { return h.Country == rec.Country }
+	if rec.Country != "" && slices.ContainsFunc(known, hasCountry) && !slices.ContainsFunc(known, sameCountry) {
+		risk = append(risk, RuleNewCountry)
+	}
+	if impossibleTravel(rec, known, maxSpeedKmh) {
+		risk = append(risk, RuleImpossibleTravel)
+	}
+	sameDevice := func(h models.LoginRecord) bool { return h.UserAgent == rec.UserAgent }
+	if rec.UserAgent != "" && !slices.ContainsFunc(known, sameDevice) {
+		risk = append(risk, RuleNewDevice)
+	}
+	return risk
+}
+
+// impossibleTravel compares rec with the latest known login that has
+// coordinates: getting from there to here in the time between the two
+// would take more than maxSpeedKmh.
+func impossibleTravel(rec models.LoginRecord, known []models.LoginRecord, maxSpeedKmh float64) bool {
+	if rec.Latitude == nil || rec.Longitude == nil || maxSpeedKmh <= 0 {
+		return false
+	}
+	for _, h := range known {
+		if h.Latitude == nil || h.Longitude == nil {
+			continue
+		}
+		km := distanceKm(*h.Latitude, *h.Longitude, *rec.Latitude, *rec.Longitude)
+		if km < minTravelKm {
+			return false
+		}
+		hours := rec.Time.Sub(h.Time).Hours()
+		return hours <= 0 || km/hours > maxSpeedKmh
+	}
+	return false
+}
+
+// distanceKm is the great circle distance between two points (haversine).
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLon := rad(lat2-lat1), rad(lon2-lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// Record stores rec. Failing to is logged, not returned: by now the login
+// went the way it went. Like audit.Record it outlives a client that hung up.
+func Record(ctx context.Context, rec models.LoginRecord) {
+	ctx = context.WithoutCancel(ctx)
+	if err := insertLogin(ctx, rec); err != nil {
+		slog.ErrorContext(ctx, "failed to record login", "username", rec.Username, "error", err)
+	}
+}
@@ -0,0 +1,129 @@
+package logins
+
+import (
+	"auth-api/models"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func coords(lat, lon float64) (*float64, *float64) {
+	return &lat, &lon
+}
+
+// login builds a successful login from Berlin with Firefox, hoursAgo before now.
+func login(now time.Time, hoursAgo float64) models.LoginRecord {
+	rec := models.LoginRecord{
+		Time:      now.Add(-time.Duration(hoursAgo * float64(time.Hour))),
+		Success:   true,
+		Country:   "DE",
+		UserAgent: "Firefox",
+	}
+	rec.Latitude, rec.Longitude = coords(52.52, 13.40)
+	return rec
+}
+
+// TestEvaluate runs each rule against a history of logins from Berlin.
+func TestEvaluate(t *testing.T) {
+	now := time.Now()
+	history := []models.LoginRecord{login(now, 2), login(now, 48)}
+
+	newYork := login(now, 0)
+	newYork.Country = "US"
+	newYork.Latitude, newYork.Longitude = coords(40.71, -74.01)
+
+	newYorkLater := newYork
+	newYorkLater.Time = now.Add(10 * time.Hour)
+
+	potsdam := login(now, 0)
+	potsdam.Latitude, potsdam.Longitude = coords(52.39, 13.06)
+
+	chrome := login(now, 0)
+	chrome.UserAgent = "Chrome"
+
+	failedOnly := []models.LoginRecord{{Time: now.Add(-time.Hour), Country: "FR", UserAgent: "curl"}}
+
+	cases := []struct {
+		name    string
+		rec     models.LoginRecord
+		history []models.LoginRecord
+		want    []string
+	}{
+		{"usual", login(now, 0), history, nil},
+		{"first login", newYork, nil, nil},
+		{"only failed logins before", newYork, failedOnly, nil},
+		{"new country, too fast", newYork, history, []string{RuleNewCountry, RuleImpossibleTravel}},
+		{"new country, plausible flight", newYorkLater, history, []string{RuleNewCountry}},
+		{"short hop", potsdam, history, nil},
+		{"new device", chrome, history, []string{RuleNewDevice}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Evaluate(tc.rec, tc.history, 1000); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Evaluate = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestDistanceKm checks the haversine against a known distance.
+func TestDistanceKm(t *testing.T) {
+	// Berlin to New York is about 6385 km
+	if km := distanceKm(52.52, 13.40, 40.71, -74.01); km < 6300 || km > 6450 {
+		t.Fatalf("distanceKm = %.0f, want about 6385", km)
+	}
+}
+
+// TestParseActions accepts known rules and actions only.
+func TestParseActions(t *testing.T) {
+	got, err := ParseActions([]string{"impossible_travel=step_up", " new_device = flag "})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{RuleImpossibleTravel: ActionStepUp, RuleNewDevice: ActionFlag}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ParseActions = %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"teleport=flag", "new_device=block", "new_device"} {
+		if _, err := ParseActions([]string{bad}); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+// TestAssess checks the configured actions decide the step up, and that an
+// unreadable history lets the login through unflagged.
+func TestAssess(t *testing.T) {
+	original := listKnownLogins
+	history := []models.LoginRecord{{Time: time.Now().Add(-time.Hour), Success: true, UserAgent: "Firefox"}}
+	var listErr error
+	listKnownLogins = func(ctx context.Context, username string, limit int) ([]models.LoginRecord, error) {
+		return history, listErr
+	}
+	t.Cleanup(func() {
+		listKnownLogins = original
+		SetActions(map[string]string{})
+	})
+
+	rec := models.LoginRecord{Username: "alice", Time: time.Now(), UserAgent: "Chrome"}
+	if Assess(context.Background(), &rec) {
+		t.Fatalf("expected new_device to only flag by default")
+	}
+	if !reflect.DeepEqual(rec.Risk, []string{RuleNewDevice}) {
+		t.Fatalf("unexpected risk: %v", rec.Risk)
+	}
+
+	SetActions(map[string]string{RuleNewDevice: ActionStepUp})
+	if !Assess(context.Background(), &rec) {
+		t.Fatalf("expected a step up for new_device=step_up")
+	}
+
+	listErr = errors.New("db down")
+	rec = models.LoginRecord{Username: "alice", Time: time.Now(), UserAgent: "Chrome"}
+	if Assess(context.Background(), &rec) || len(rec.Risk) != 0 {
+		t.Fatalf("expected no risk without a history, got %v", rec.Risk)
+	}
+}
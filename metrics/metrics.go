@@ -0,0 +1,121 @@
+package metrics
+
+/*
+	- every prometheus collector the service exposes lives here, so handlers, auth and middleware
+	  record through one place and label names stay consistent
+	- served on /metrics via Handler()
+*/
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "auth_api"
+
+var (
+	// HTTPRequests counts finished requests per route pattern, method and status.
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	// HTTPDuration tracks request latency per route pattern, method and status.
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency, by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// LoginOutcomes counts login attempts by outcome (success/failure) and reason.
+	LoginOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_attempts_total",
+		Help:      "Login attempts, by outcome and reason.",
+	}, []string{"outcome", "reason"})
+
+	// Registrations counts registration attempts by outcome and reason.
+	Registrations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registrations_total",
+		Help:      "Registration attempts, by outcome and reason.",
+	}, []string{"outcome", "reason"})
+
+	// Tokens counts JWTs issued, validated and rejected.
+	Tokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "JWT operations, by result (issued, validated, rejected).",
+	}, []string{"result"})
+
+	// PasswordHashDuration tracks time spent hashing and verifying passwords.
+	PasswordHashDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "password_hash_duration_seconds",
+		Help:      "Time spent hashing passwords, by algorithm (bcrypt, argon2id) and operation (hash, verify).",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"algorithm", "op"})
+
+	// BcryptDuration is the bcrypt-only histogram PasswordHashDuration
+	// replaced, still fed for dashboards built on it.
+	//
+	// Deprecated: use PasswordHashDuration{algorithm="bcrypt"}.
+	BcryptDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bcrypt_duration_seconds",
+		Help:      "Time spent in bcrypt, by operation (hash, compare). Deprecated: use password_hash_duration_seconds.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"op"})
+
+	// PasswordRehashes counts stored hashes upgraded on login, by outcome.
+	PasswordRehashes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "password_rehashes_total",
+		Help:      "Stored password hashes upgraded on login, by outcome.",
+	}, []string{"outcome"})
+)
+
+// label values shared by the recording sites
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+
+	TokenIssued    = "issued"
+	TokenValidated = "validated"
+	TokenRejected  = "rejected"
+
+	PasswordHash   = "hash"
+	PasswordVerify = "verify"
+)
+
+// ObservePasswordHash records how long a password operation that began at start took.
+// Use it as: defer metrics.ObservePasswordHash("bcrypt", metrics.PasswordHash, time.Now())
+func ObservePasswordHash(algorithm, op string, start time.Time) {
+	elapsed := time.Since(start).Seconds()
+	PasswordHashDuration.WithLabelValues(algorithm, op).Observe(elapsed)
+	if algorithm == "bcrypt" {
+		// bcrypt_duration_seconds called verify "compare"
+		if op == PasswordVerify {
+			op = "compare"
+		}
+		BcryptDuration.WithLabelValues(op).Observe(elapsed)
+	}
+}
+
+// RegisterDBStats exposes the connection pool numbers from sql.DB.Stats().
+func RegisterDBStats(db *sql.DB) error {
+	return prometheus.Register(collectors.NewDBStatsCollector(db, "auth"))
+}
+
+// Handler serves the collected metrics in the prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
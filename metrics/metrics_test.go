@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestObservePasswordHash checks that timings are recorded under the requested
+// algorithm and operation labels.
+func TestObservePasswordHash(t *testing.T) {
+	before := testutil.CollectAndCount(PasswordHashDuration)
+	ObservePasswordHash("bcrypt", PasswordVerify, time.Now().Add(-50*time.Millisecond))
+	if after := testutil.CollectAndCount(PasswordHashDuration); after < before || after == 0 {
+		t.Fatalf("expected a verify series to exist, got %d series", after)
+	}
+	if n := testutil.CollectAndCount(BcryptDuration, "auth_api_bcrypt_duration_seconds"); n == 0 {
+		t.Fatalf("expected bcrypt timings under the old name too")
+	}
+}
+
+// TestRegisterDBStats ensures the pool collector can be registered once and a
+// second registration is rejected instead of silently duplicating series.
+func TestRegisterDBStats(t *testing.T) {
+	db := &sql.DB{}
+	if err := RegisterDBStats(db); err != nil {
+		t.Fatalf("unexpected error registering db stats: %v", err)
+	}
+	if err := RegisterDBStats(db); err == nil {
+		t.Fatalf("expected duplicate registration to fail")
+	}
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions configure CORS. No AllowedOrigins turns CORS off.
+type CORSOptions struct {
+	// AllowedOrigins are exact origins like https://app.example.com, or "*".
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	// AllowCredentials lets the listed origins send cookies. Never those
+	// only let in by "*": any site could read a logged in user's data.
+	AllowCredentials bool
+	// MaxAge lets browsers cache a preflight answer.
+	MaxAge time.Duration
+}
+
+// CORS answers preflight requests and adds the CORS response headers for
+// allowed origins. It has to sit in front of the router, since preflights
+// use OPTIONS, which no route is registered for.
+func CORS(opts CORSOptions) func(http.HandlerFunc) http.HandlerFunc {
+	anyOrigin := slices.Contains(opts.AllowedOrigins, "*")
+	methods := strings.Join(opts.AllowedMethods, ", ")
+	headers := strings.Join(opts.AllowedHeaders, ", ")
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if len(opts.AllowedOrigins) == 0 || origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// the answer depends on Origin, caches must not mix them up
+			w.Header().Add("Vary", "Origin")
+
+			listed := slices.Contains(opts.AllowedOrigins, origin)
+			allowed := anyOrigin || listed
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if !allowed {
+				if preflight {
+					// no CORS headers: the browser blocks the real request
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if listed {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				if opts.AllowCredentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+
+			if !preflight {
+				w.Header().Set("Access-Control-Expose-Headers", RequestIDHeader)
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			if opts.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// SecurityHeaders sets the browser hardening headers on every response.
+// hstsMaxAge of 0 leaves out Strict-Transport-Security.
+func SecurityHeaders(hstsMaxAge time.Duration) func(http.HandlerFunc) http.HandlerFunc {
+	hsts := ""
+	if hstsMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(int(hstsMaxAge.Seconds())) + "; includeSubDomains"
+	}
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			if hsts != "" {
+				h.Set("Strict-Transport-Security", hsts)
+			}
+			h.Set("X-Content-Type-Options", "nosniff")
+			// we serve data, not pages: nothing to load, nobody may frame us
+			h.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+			h.Set("X-Frame-Options", "DENY")
+			h.Set("Referrer-Policy", "no-referrer")
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NoStore keeps responses out of every cache. Token responses must use it
+// (RFC 6749 section 5.1).
+func NoStore(next http.HandlerFunc) http.HandlerFunc {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -2,19 +2,46 @@ package middleware
 
 import (
 	"auth-api/auth"
+	"auth-api/clientip"
+	"auth-api/config"
+	"auth-api/db"
 	"auth-api/handlers"
+	"auth-api/logging"
+	"auth-api/metrics"
+	"auth-api/models"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+var (
+	// getSession and touchSession let tests run CheckJwt without a database.
+	getSession   = db.GetSession
+	touchSession = db.TouchSession
 )
 
+// sessionTouchInterval limits how often a busy session's last_used_at gets
+// written back.
+const sessionTouchInterval = time.Minute
+
+// RequestIDHeader carries the request id in both directions.
+const RequestIDHeader = "X-Request-ID"
+
 // statusRecorder helps us bring back the response's http.status-code
+// and how many body bytes went out.
 // Exclusively for middleware logging
 // Embedding is awesome!
 type statusRecorder struct {
 	http.ResponseWriter
 	status int
+	bytes  int
 }
 
 // When WriteHeader is called, its updates both fields for statusRecorder
@@ -23,20 +50,89 @@ func (r *statusRecorder) WriteHeader(status int) {
 	r.ResponseWriter.WriteHeader(status)
 }
 
-// Log incoming Requests and outgoing responses
+// Write counts the body bytes passed through to the real writer
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// RequestID takes the caller's X-Request-ID (or makes one up), stores it in
+// the request context for logging and echoes it on the response.
+func RequestID(next http.HandlerFunc) http.HandlerFunc {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !logging.ValidRequestID(id) {
+			id = logging.NewRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// Log outgoing responses, one structured line per request
 func Logger(next http.HandlerFunc) http.HandlerFunc {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("REQUEST: %s, on %s, from %v", r.Method, r.URL.Path, r.RemoteAddr)
+		start := time.Now()
 
 		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
 		next.ServeHTTP(rec, r)
 
-		log.Printf("RESPONSE: %d on %s, on %s, from %v", rec.status, r.Method, r.URL.Path, r.RemoteAddr)
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+			"client_ip", clientip.FromRequest(r),
+			"user_agent", r.UserAgent(),
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
 	})
 }
 
-// Checks for an Authorization header and validates the token
+// Tracing opens a server span per request, continuing the caller's trace when
+// a W3C traceparent header is present. Spans are named after the mux pattern.
+func Tracing(next http.HandlerFunc) http.HandlerFunc {
+
+	handler := otelhttp.NewHandler(next, "http.request",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if r.Pattern != "" {
+				return r.Method + " " + r.Pattern
+			}
+			return r.Method + " " + r.URL.Path
+		}),
+	)
+	return handler.ServeHTTP
+}
+
+// Metrics records request counts and latency per route pattern and status.
+// The route label is the mux pattern, not the raw path, to keep cardinality bounded.
+func Metrics(next http.HandlerFunc) http.HandlerFunc {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(rec.status)
+		metrics.HTTPRequests.WithLabelValues(route, r.Method, status).Inc()
+		metrics.HTTPDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Checks for an Authorization header and validates the token.
+// Failures are 401s carrying an RFC 6750 WWW-Authenticate challenge.
+// With cookie sessions on, the access token cookie works too, but then
+// state changing requests must pass the CSRF check.
 func CheckJwt(next http.HandlerFunc) http.HandlerFunc {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -46,12 +142,29 @@ func CheckJwt(next http.HandlerFunc) http.HandlerFunc {
 			Message: "failed to validate auth token",
 		}
 
-		// retrieve header
+		// retrieve header, or the cookie of a browser session
 		authHeader := r.Header.Get("Authorization")
+		fromCookie := false
+		if authHeader == "" && config.CookieSessions {
+			if cookie, err := r.Cookie(handlers.AccessCookie); err == nil && cookie.Value != "" {
+				authHeader, fromCookie = "Bearer "+cookie.Value, true
+			}
+		}
+		if fromCookie && !handlers.SafeMethod(r.Method) && !handlers.ValidCSRF(r) {
+			// the browser attaches cookies to forged requests as well
+			resp.Error = fmt.Errorf("csrf check failed")
+			resp.Message = "missing or wrong " + handlers.CSRFHeader + " header"
+			resp.Status = http.StatusForbidden
+			resp.Code = handlers.CodeCSRF
+			handlers.WriteResponse(w, &resp)
+			return
+		}
 		if authHeader == "" {
+			// no credentials at all: challenge without an error code
 			resp.Error = fmt.Errorf("no auth token")
 			resp.Message = resp.Error.Error()
-			resp.Status = http.StatusBadRequest
+			resp.Code = handlers.CodeTokenMissing
+			w.Header().Set("WWW-Authenticate", handlers.BearerChallenge("", ""))
 			handlers.WriteResponse(w, &resp)
 			return
 		}
@@ -61,22 +174,111 @@ func CheckJwt(next http.HandlerFunc) http.HandlerFunc {
 		if !ok {
 			resp.Error = fmt.Errorf("corrupt token format")
 			resp.Message = resp.Error.Error()
-			resp.Status = http.StatusBadRequest
+			resp.Code = handlers.CodeTokenMalformed
+			w.Header().Set("WWW-Authenticate", handlers.BearerChallenge("invalid_request", "expected a Bearer token"))
 			handlers.WriteResponse(w, &resp)
 			return
 		}
 
 		// validate the token
-		err := auth.ValidateJWT(authHeader)
+		claims, err := auth.ParseJWT(r.Context(), authHeader)
 		if err != nil {
 			resp.Error = fmt.Errorf("error validating token: %w", err)
 			resp.Message = "error validating token" // gonna opt for the generic form
+			resp.Code = handlers.CodeTokenInvalid
+			slog.DebugContext(r.Context(), resp.Message, "error", resp.Error)
+
+			switch {
+			case !errors.Is(err, auth.ErrInvalidToken):
+				// the token never got looked at, most likely the secret lookup failed
+				resp.Message = "failed to validate auth token"
+				resp.Status = http.StatusInternalServerError
+				resp.Code = handlers.CodeInternal
+				slog.ErrorContext(r.Context(), resp.Message, "error", resp.Error)
+			case errors.Is(err, auth.ErrTokenExpired):
+				resp.Message = "token expired"
+				resp.Code = handlers.CodeTokenExpired
+				w.Header().Set("WWW-Authenticate", handlers.BearerChallenge("invalid_token", "the access token expired"))
+			case errors.Is(err, auth.ErrTokenNotYetValid):
+				resp.Message = "token not valid yet"
+				resp.Code = handlers.CodeTokenNotYetValid
+				w.Header().Set("WWW-Authenticate", handlers.BearerChallenge("invalid_token", "the access token is not valid yet"))
+			case errors.Is(err, auth.ErrTokenSignature):
+				resp.Message = "token signature invalid"
+				resp.Code = handlers.CodeTokenSignature
+				w.Header().Set("WWW-Authenticate", handlers.BearerChallenge("invalid_token", "the access token signature is invalid"))
+			case errors.Is(err, auth.ErrTokenAudience):
+				resp.Message = "token not issued for this service"
+				resp.Code = handlers.CodeTokenAudience
+				w.Header().Set("WWW-Authenticate", handlers.BearerChallenge("invalid_token", "the access token is for another audience"))
+			default:
+				w.Header().Set("WWW-Authenticate", handlers.BearerChallenge("invalid_token", "the access token is invalid"))
+			}
+			handlers.WriteResponse(w, &resp)
+			return
+		}
+
+		// a valid signature isn't enough, the session behind the token must still exist
+		session, err := sessionFor(r, claims)
+		if err != nil {
+			resp.Message = "session revoked or expired"
+			resp.Code = handlers.CodeTokenInvalid
+			resp.Error = err
+			if !errors.Is(err, db.ErrSessionNotFound) {
+				resp.Message = "failed to validate auth token"
+				resp.Status = http.StatusInternalServerError
+				resp.Code = handlers.CodeInternal
+				slog.ErrorContext(r.Context(), resp.Message, "error", resp.Error)
+			} else {
+				w.Header().Set("WWW-Authenticate", handlers.BearerChallenge("invalid_token", "the session was revoked"))
+			}
 			handlers.WriteResponse(w, &resp)
 			return
 		}
+		if time.Since(session.LastUsedAt) > sessionTouchInterval {
+			if err := touchSession(r.Context(), session.ID); err != nil {
+				slog.WarnContext(r.Context(), "failed to update session last use", "error", err)
+			}
+		}
 
 		// all checks cleared, server the desired path
-		next.ServeHTTP(w, r)
+		ctx := auth.WithUser(r.Context(), claims.Subject)
+		ctx = auth.WithSessionID(ctx, session.ID)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 
 }
+
+// sessionFor loads the live session a token was issued for. Tokens without a
+// session id, or whose session belongs to someone else, count as not found.
+func sessionFor(r *http.Request, claims *auth.Claims) (*models.Session, error) {
+	if claims.SessionID == "" {
+		return nil, db.ErrSessionNotFound
+	}
+	session, err := getSession(r.Context(), claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.Username != claims.Subject {
+		return nil, db.ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// RequireAdmin only lets through users listed in config.AdminUsers. It must
+// sit behind CheckJwt, which puts the username in the context.
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := auth.UserFromContext(r.Context())
+		if username == "" || !slices.Contains(config.AdminUsers, username) {
+			handlers.WriteResponse(w, &handlers.Response{
+				Status:  http.StatusForbidden,
+				Code:    handlers.CodeForbidden,
+				Message: "admin access required",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,477 @@
+package middleware
+
+import (
+	"auth-api/auth"
+	"auth-api/config"
+	"auth-api/db"
+	"auth-api/handlers"
+	"auth-api/logging"
+	"auth-api/models"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestRequestIDPassthrough checks a well formed client id is kept, stored in
+// the context and echoed on the response.
+func TestRequestIDPassthrough(t *testing.T) {
+	var seen string
+	handler := RequestID(func(w http.ResponseWriter, r *http.Request) {
+		seen = logging.RequestID(r.Context())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+
+	if seen != "abc-123" {
+		t.Fatalf("expected context id abc-123, got %q", seen)
+	}
+	if got := rr.Header().Get(RequestIDHeader); got != "abc-123" {
+		t.Fatalf("expected response header abc-123, got %q", got)
+	}
+}
+
+// TestRequestIDGenerated ensures missing or unusable ids are replaced.
+func TestRequestIDGenerated(t *testing.T) {
+	handler := RequestID(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, incoming := range []string{"", "has spaces", strings.Repeat("a", logging.MaxRequestIDLen+1)} {
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.Header.Set(RequestIDHeader, incoming)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		got := rr.Header().Get(RequestIDHeader)
+		if got == "" || got == incoming || len(got) != 32 {
+			t.Fatalf("expected a generated id for %q, got %q", incoming, got)
+		}
+	}
+}
+
+// TestLoggerAccessLine verifies the access log carries status, bytes and the
+// request id.
+func TestLoggerAccessLine(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, "info", "json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	original := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() {
+		slog.SetDefault(original)
+	})
+
+	handler := RequestID(Logger(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/teapot", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	handler(httptest.NewRecorder(), req)
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a json access line, got %q: %v", buf.String(), err)
+	}
+	if line["status"] != float64(http.StatusTeapot) || line["bytes"] != float64(15) || line["request_id"] != "req-1" {
+		t.Fatalf("unexpected access line: %v", line)
+	}
+	if _, ok := line["duration_ms"]; !ok {
+		t.Fatalf("expected duration_ms in access line: %v", line)
+	}
+}
+
+// TestRequireAdmin checks only configured admins get through.
+func TestRequireAdmin(t *testing.T) {
+	original := config.AdminUsers
+	config.AdminUsers = []string{"root"}
+	t.Cleanup(func() {
+		config.AdminUsers = original
+	})
+
+	handler := RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for user, want := range map[string]int{"root": http.StatusNoContent, "alice": http.StatusForbidden, "": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/audit", nil)
+		req = req.WithContext(auth.WithUser(req.Context(), user))
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Code != want {
+			t.Fatalf("user %q: expected %d, got %d", user, want, rr.Code)
+		}
+	}
+}
+
+// TestCheckJwtFailures verifies each kind of rejected request gets a 401, the
+// right error code and a Bearer challenge.
+func TestCheckJwtFailures(t *testing.T) {
+	handler := CheckJwt(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("protected handler should not run")
+	})
+
+	cases := map[string]struct {
+		header    string
+		code      string
+		challenge string
+	}{
+		"missing":    {header: "", code: handlers.CodeTokenMissing, challenge: `Bearer realm="auth-api"`},
+		"not bearer": {header: "Basic YWxpY2U6cHc=", code: handlers.CodeTokenMalformed, challenge: `error="invalid_request"`},
+	}
+	for name, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/secret", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401, got %d", name, rr.Code)
+		}
+		if got := rr.Header().Get("WWW-Authenticate"); !strings.Contains(got, tc.challenge) {
+			t.Fatalf("%s: expected challenge containing %q, got %q", name, tc.challenge, got)
+		}
+		var problem handlers.Problem
+		if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil || problem.Code != tc.code {
+			t.Fatalf("%s: expected code %s, got %+v (%v)", name, tc.code, problem, err)
+		}
+	}
+}
+
+// TestSessionFor checks a token only passes while its session exists and
+// belongs to the token's subject.
+func TestSessionFor(t *testing.T) {
+	original := getSession
+	getSession = func(ctx context.Context, id string) (*models.Session, error) {
+		if id != "s1" {
+			return nil, db.ErrSessionNotFound
+		}
+		return &models.Session{ID: "s1", Username: "alice"}, nil
+	}
+	t.Cleanup(func() {
+		getSession = original
+	})
+
+	cases := map[string]struct {
+		claims auth.Claims
+		ok     bool
+	}{
+		"live session":  {claims: auth.Claims{SessionID: "s1", RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"}}, ok: true},
+		"no session id": {claims: auth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"}}},
+		"revoked":       {claims: auth.Claims{SessionID: "s2", RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"}}},
+		"someone else":  {claims: auth.Claims{SessionID: "s1", RegisteredClaims: jwt.RegisteredClaims{Subject: "bob"}}},
+	}
+	for name, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/secret", nil)
+		session, err := sessionFor(req, &tc.claims)
+		if tc.ok && (err != nil || session.ID != "s1") {
+			t.Fatalf("%s: expected the session, got %v, %v", name, session, err)
+		}
+		if !tc.ok && !errors.Is(err, db.ErrSessionNotFound) {
+			t.Fatalf("%s: expected ErrSessionNotFound, got %v", name, err)
+		}
+	}
+}
+
+// TestCheckJwtTokenErrors checks each typed token rejection gets its own
+// error code, and a good token with a live session gets through.
+func TestCheckJwtTokenErrors(t *testing.T) {
+	key := []byte("secret")
+	auth.SetValidator(&auth.Validator{
+		Algorithms:     []string{"HS256"},
+		Audience:       "api",
+		RequiredClaims: []string{"sub", "exp"},
+		Key: func(ctx context.Context) ([]byte, error) {
+			return key, nil
+		},
+	})
+	original := getSession
+	getSession = func(ctx context.Context, id string) (*models.Session, error) {
+		return &models.Session{ID: id, Username: "alice", LastUsedAt: time.Now()}, nil
+	}
+	t.Cleanup(func() {
+		auth.SetValidator(auth.NewValidator())
+		getSession = original
+	})
+
+	now := time.Now()
+	sign := func(signKey []byte, claims jwt.MapClaims) string {
+		base := jwt.MapClaims{"sub": "alice", "aud": "api", "sid": "s1", "exp": now.Add(time.Hour).Unix()}
+		for name, value := range claims {
+			base[name] = value
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, base).SignedString(signKey)
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		return token
+	}
+
+	var seen string
+	handler := CheckJwt(func(w http.ResponseWriter, r *http.Request) {
+		seen = auth.UserFromContext(r.Context()) + "/" + auth.SessionIDFromContext(r.Context())
+	})
+
+	cases := map[string]struct {
+		token string
+		code  string
+	}{
+		"ok":            {sign(key, nil), ""},
+		"expired":       {sign(key, jwt.MapClaims{"exp": now.Add(-time.Hour).Unix()}), handlers.CodeTokenExpired},
+		"not yet valid": {sign(key, jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()}), handlers.CodeTokenNotYetValid},
+		"bad signature": {sign([]byte("other"), nil), handlers.CodeTokenSignature},
+		"audience":      {sign(key, jwt.MapClaims{"aud": "billing"}), handlers.CodeTokenAudience},
+		"missing claim": {sign(key, jwt.MapClaims{"sub": nil}), handlers.CodeTokenInvalid},
+	}
+	for name, tc := range cases {
+		seen = ""
+		req := httptest.NewRequest(http.MethodGet, "/secret", nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		if tc.code == "" {
+			if rr.Code != http.StatusOK || seen != "alice/s1" {
+				t.Fatalf("%s: expected the request through, got %d (%q)", name, rr.Code, seen)
+			}
+			continue
+		}
+		var problem handlers.Problem
+		if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil || rr.Code != http.StatusUnauthorized || problem.Code != tc.code {
+			t.Fatalf("%s: expected 401 %s, got %d %+v (%v)", name, tc.code, rr.Code, problem, err)
+		}
+	}
+}
+
+// TestValidateRequest checks bodies and parameters are held to the OpenAPI
+// document, and that the handler can still read a valid body.
+func TestValidateRequest(t *testing.T) {
+	var got string
+	handler := ValidateRequest(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		got = body["username"]
+	})
+
+	cases := map[string]struct {
+		method, target, body string
+		code                 string
+	}{
+		"valid":            {http.MethodPost, "/register", `{"username":"alice","password":"pw"}`, ""},
+		"missing password": {http.MethodPost, "/register", `{"username":"alice"}`, handlers.CodeValidationFailed},
+		"wrong type":       {http.MethodPost, "/login", `{"username":5,"password":"pw"}`, handlers.CodeValidationFailed},
+		"bad query":        {http.MethodGet, "/admin/audit?limit=lots", ``, handlers.CodeValidationFailed},
+		"unknown field":    {http.MethodPost, "/login", `{"username":"alice","passwrd":"pw"}`, handlers.CodeValidationFailed},
+		"empty username":   {http.MethodPost, "/register", `{"username":"","password":"pw"}`, handlers.CodeValidationFailed},
+		"not in the spec":  {http.MethodGet, "/nowhere", ``, ""},
+	}
+	for name, tc := range cases {
+		got = ""
+		req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		if tc.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		if tc.code == "" {
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s: expected the request through, got %d %s", name, rr.Code, rr.Body.String())
+			}
+			continue
+		}
+		var problem handlers.Problem
+		if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil || rr.Code != http.StatusBadRequest || problem.Code != tc.code {
+			t.Fatalf("%s: expected 400 %s, got %d %+v (%v)", name, tc.code, rr.Code, problem, err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"username":"alice","password":"pw"}`))
+	req.Header.Set("Content-Type", "application/json")
+	handler(httptest.NewRecorder(), req)
+	if got != "alice" {
+		t.Fatalf("expected the handler to read the body, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"username":"alice"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	var problem handlers.Problem
+	json.NewDecoder(rr.Body).Decode(&problem)
+	if len(problem.Errors) != 1 || problem.Errors[0] != (handlers.FieldError{Field: "password", Message: "required"}) {
+		t.Fatalf("expected a field error for password, got %+v", problem.Errors)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"alice","password":"pw","passwrd":"pw"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	problem = handlers.Problem{}
+	json.NewDecoder(rr.Body).Decode(&problem)
+	if len(problem.Errors) != 1 || problem.Errors[0] != (handlers.FieldError{Field: "passwrd", Message: "unknown field"}) {
+		t.Fatalf("expected a field error for passwrd, got %+v", problem.Errors)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"alice","password":"pw"}`))
+	req.Header.Set("Content-Type", "text/plain")
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 for a text body, got %d", rr.Code)
+	}
+}
+
+// TestCORS checks preflights are answered for allowed origins only, and that
+// credentials go to listed origins only, never to anyone "*" lets in.
+func TestCORS(t *testing.T) {
+	var reached bool
+	next := func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}
+	opts := CORSOptions{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"Authorization"},
+		MaxAge:         time.Minute,
+	}
+
+	preflight := func(handler http.HandlerFunc, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/login", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	reached = false
+	rr := preflight(CORS(opts)(next), "https://app.example.com")
+	if reached || rr.Code != http.StatusNoContent {
+		t.Fatalf("expected the preflight answered with 204, got %d (reached %v)", rr.Code, reached)
+	}
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		rr.Header().Get("Access-Control-Allow-Methods") != "GET, POST" ||
+		rr.Header().Get("Access-Control-Max-Age") != "60" {
+		t.Fatalf("unexpected preflight headers: %v", rr.Header())
+	}
+
+	rr = preflight(CORS(opts)(next), "https://evil.example.com")
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("expected no CORS headers for a foreign origin, got %v", rr.Header())
+	}
+
+	opts.AllowedOrigins = []string{"*", "https://app.example.com"}
+	opts.AllowCredentials = true
+	get := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.Header.Set("Origin", origin)
+		rr := httptest.NewRecorder()
+		reached = false
+		CORS(opts)(next)(rr, req)
+		return rr
+	}
+	rr = get("https://other.example.com")
+	if !reached || rr.Header().Get("Access-Control-Allow-Origin") != "*" ||
+		rr.Header().Get("Access-Control-Allow-Credentials") != "" || rr.Header().Get("Vary") != "Origin" {
+		t.Fatalf("expected * without credentials for an unlisted origin, got %v (reached %v)", rr.Header(), reached)
+	}
+	rr = get("https://app.example.com")
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		rr.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("expected the listed origin echoed with credentials, got %v", rr.Header())
+	}
+
+	rr = preflight(CORS(CORSOptions{})(next), "https://app.example.com")
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("expected CORS off without allowed origins, got %v", rr.Header())
+	}
+}
+
+// TestSecurityHeaders checks the hardening headers, and that HSTS can be
+// turned off.
+func TestSecurityHeaders(t *testing.T) {
+	next := func(w http.ResponseWriter, r *http.Request) {}
+
+	rr := httptest.NewRecorder()
+	SecurityHeaders(time.Hour)(next)(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+	want := map[string]string{
+		"Strict-Transport-Security": "max-age=3600; includeSubDomains",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           "no-referrer",
+	}
+	for name, value := range want {
+		if got := rr.Header().Get(name); got != value {
+			t.Fatalf("expected %s %q, got %q", name, value, got)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	SecurityHeaders(0)(next)(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if got := rr.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Fatalf("expected no HSTS header, got %q", got)
+	}
+}
+
+// TestCheckJwtCookieCSRF checks the access token cookie is accepted, and
+// that state changing requests made with it need the CSRF header.
+func TestCheckJwtCookieCSRF(t *testing.T) {
+	original := config.CookieSessions
+	config.CookieSessions = true
+	auth.SetValidator(&auth.Validator{
+		Algorithms: []string{"HS256"},
+		Key: func(ctx context.Context) ([]byte, error) {
+			return []byte("secret"), nil
+		},
+	})
+	t.Cleanup(func() {
+		config.CookieSessions = original
+		auth.SetValidator(auth.NewValidator())
+	})
+
+	handler := CheckJwt(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("protected handler should not run")
+	})
+
+	cases := map[string]struct {
+		method, csrf string
+		status       int
+		code         string
+	}{
+		// safe methods skip the CSRF check and fail on the bogus token instead
+		"get":          {http.MethodGet, "", http.StatusUnauthorized, handlers.CodeTokenInvalid},
+		"post no csrf": {http.MethodPost, "", http.StatusForbidden, handlers.CodeCSRF},
+		"post forged":  {http.MethodPost, "other", http.StatusForbidden, handlers.CodeCSRF},
+		"post csrf":    {http.MethodPost, "csrf", http.StatusUnauthorized, handlers.CodeTokenInvalid},
+	}
+	for name, tc := range cases {
+		req := httptest.NewRequest(tc.method, "/logout", nil)
+		req.AddCookie(&http.Cookie{Name: handlers.AccessCookie, Value: "not-a-jwt"})
+		req.AddCookie(&http.Cookie{Name: handlers.CSRFCookie, Value: "csrf"})
+		if tc.csrf != "" {
+			req.Header.Set(handlers.CSRFHeader, tc.csrf)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		var problem handlers.Problem
+		if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil || rr.Code != tc.status || problem.Code != tc.code {
+			t.Fatalf("%s: expected %d %s, got %d %+v (%v)", name, tc.status, tc.code, rr.Code, problem, err)
+		}
+	}
+}
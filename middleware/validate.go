@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"auth-api/config"
+	"auth-api/handlers"
+	"auth-api/openapi"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+// validationOptions leave authentication to CheckJwt, the spec's security
+// requirements are documentation only.
+var validationOptions = &openapi3filter.Options{
+	AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+	MultiError:         true,
+}
+
+// propertyReason matches kin-openapi's reasons for a missing or unknown property.
+var propertyReason = regexp.MustCompile(`^property "([^"]+)" is (missing|unsupported)$`)
+
+// ValidateRequest checks parameters and JSON bodies against the OpenAPI
+// document and answers 400 validation_failed when they don't fit, listing
+// the offending fields. Bodies over config.MaxBodyBytes get a 413. Requests
+// the document doesn't describe pass through untouched.
+func ValidateRequest(next http.HandlerFunc) http.HandlerFunc {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router, err := openapi.Router()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "openapi spec unavailable, skipping request validation", "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route, pathParams, err := router.FindRoute(r)
+		if errors.Is(err, routers.ErrPathNotFound) || errors.Is(err, routers.ErrMethodNotAllowed) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			slog.WarnContext(r.Context(), "failed to match request against the openapi spec", "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// the whole body is read here, cap it before that happens
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, config.MaxBodyBytes)
+		}
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    validationOptions,
+		}
+		// the body is read and put back, so handlers can decode it again
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			handlers.WriteResponse(w, validationResponse(err))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validationResponse turns kin-openapi's errors into the problem we send:
+// 413 for an oversized body, 415 for a body that isn't JSON, otherwise a 400
+// listing what was wrong with which field.
+func validationResponse(err error) *handlers.Response {
+	resp := &handlers.Response{
+		Status:  http.StatusBadRequest,
+		Code:    handlers.CodeValidationFailed,
+		Message: "request does not match the api description",
+		Error:   err,
+	}
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		resp.Status = http.StatusRequestEntityTooLarge
+		resp.Code = handlers.CodeBodyTooLarge
+		resp.Message = fmt.Sprintf("request body larger than %d bytes", maxErr.Limit)
+		return resp
+	}
+
+	var errs openapi3.MultiError
+	if !errors.As(err, &errs) {
+		errs = openapi3.MultiError{err}
+	}
+	for _, err := range errs {
+		var reqErr *openapi3filter.RequestError
+		if !errors.As(err, &reqErr) {
+			continue
+		}
+		switch {
+		case reqErr.Parameter != nil:
+			resp.Message = "invalid parameter " + reqErr.Parameter.Name
+			resp.Fields = append(resp.Fields, handlers.FieldError{Field: reqErr.Parameter.Name, Message: reqErr.Reason})
+		case reqErr.RequestBody != nil && strings.HasPrefix(reqErr.Reason, "header Content-Type"):
+			resp.Status = http.StatusUnsupportedMediaType
+			resp.Code = handlers.CodeUnsupportedMedia
+			resp.Message = "Content-Type must be application/json"
+			resp.Fields = nil
+			return resp
+		case reqErr.RequestBody != nil:
+			resp.Message = "invalid request body"
+			resp.Fields = append(resp.Fields, bodyFieldErrors(reqErr)...)
+		}
+	}
+	return resp
+}
+
+// bodyFieldErrors lists the schema violations in a request body, by field.
+func bodyFieldErrors(reqErr *openapi3filter.RequestError) []handlers.FieldError {
+	var schemaErrs openapi3.MultiError
+	if !errors.As(reqErr.Err, &schemaErrs) {
+		schemaErrs = openapi3.MultiError{reqErr.Err}
+	}
+	var fields []handlers.FieldError
+	for _, err := range schemaErrs {
+		var schemaErr *openapi3.SchemaError
+		if !errors.As(err, &schemaErr) {
+			reason := reqErr.Reason
+			if reason == "" && err != nil {
+				reason = err.Error()
+			}
+			fields = append(fields, handlers.FieldError{Message: reason})
+			continue
+		}
+		path, reason := schemaErr.JSONPointer(), schemaErr.Reason
+		// kin-openapi points at a missing property, but not at an unknown one
+		switch m := propertyReason.FindStringSubmatch(reason); {
+		case m != nil && m[2] == "missing":
+			reason = "required"
+		case m != nil:
+			path = append(path, m[1])
+			reason = "unknown field"
+		}
+		fields = append(fields, handlers.FieldError{Field: strings.Join(path, "."), Message: reason})
+	}
+	return fields
+}
@@ -1,5 +1,10 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
 /*
 	- the struct is used by multiple packages (db, user, etc). so better to move it out in a central place
 	- models is place for shared models only, not a junk drawer!
@@ -11,3 +16,82 @@ type ServiceUser struct {
 	Location string
 	IP_addr  string
 }
+
+// AuditEvent is one security relevant action, as stored in audit_events and
+// written to the other audit sinks.
+type AuditEvent struct {
+	ID        int64     `json:"id,omitempty"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Actor     string    `json:"actor,omitempty"`  // who did it. the attempted username for failed logins
+	Target    string    `json:"target,omitempty"` // who it was done to, for admin actions
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	IP_addr   string    `json:"ip_addr,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// AuditFilter narrows an audit_events query. Zero values mean "any".
+type AuditFilter struct {
+	Type    string
+	Actor   string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// Session is one login: the access/refresh token pair issued for it plus
+// where it came from. Stored in the tokens table.
+type Session struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"-"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	IP_addr     string    `json:"ip_addr,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Audience    string    `json:"audience,omitempty"`
+	RefreshHash string    `json:"-"`
+	AccessHash  string    `json:"-"`
+
+	// PreviousRefreshHash is the refresh token the last refresh spent.
+	PreviousRefreshHash string `json:"-"`
+}
+
+// LoginRecord is one login attempt on an existing account, as stored in
+// login_history. Latitude and Longitude are only set when geoip knew them.
+type LoginRecord struct {
+	ID        int64     `json:"id,omitempty"`
+	Username  string    `json:"-"`
+	Time      time.Time `json:"time"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason,omitempty"` // why it failed
+	IP_addr   string    `json:"ip_addr,omitempty"`
+	Location  string    `json:"location,omitempty"`
+	Country   string    `json:"country,omitempty"` // ISO 3166-1 alpha-2
+	Latitude  *float64  `json:"-"`
+	Longitude *float64  `json:"-"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Risk      []string  `json:"risk,omitempty"` // the risk rules it tripped
+}
+
+// Profile is what a user can see and change about their own account.
+// Metadata is any JSON object the client wants to keep there.
+type Profile struct {
+	Username    string          `json:"username"`
+	DisplayName string          `json:"display_name,omitempty"`
+	Email       string          `json:"email,omitempty"`
+	Metadata    json.RawMessage `json:"metadata"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   *time.Time      `json:"updated_at,omitempty"`
+}
+
+// ProfileUpdate changes the fields that are set, nil ones are left alone.
+// An empty DisplayName or Email clears it.
+type ProfileUpdate struct {
+	DisplayName *string
+	Email       *string
+	Metadata    json.RawMessage
+}
@@ -0,0 +1,69 @@
+// Package openapi holds the OpenAPI 3 description of the HTTP API, serves
+// it, and checks incoming requests against it.
+package openapi
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+// document is the spec as served. Edit it together with the routes in
+// cmd/routes.go; a test keeps the two in step.
+//
+//go:embed openapi.json
+var document []byte
+
+var (
+	loadOnce sync.Once
+	spec     *openapi3.T
+	router   routers.Router
+	loadErr  error
+)
+
+// Spec returns the parsed and validated document.
+func Spec() (*openapi3.T, error) {
+	load()
+	return spec, loadErr
+}
+
+// Router finds the operation of a request. Requests outside the spec get
+// routers.ErrPathNotFound or routers.ErrMethodNotAllowed.
+func Router() (routers.Router, error) {
+	load()
+	return router, loadErr
+}
+
+func load() {
+	loadOnce.Do(func() {
+		loader := openapi3.NewLoader()
+		spec, loadErr = loader.LoadFromData(document)
+		if loadErr != nil {
+			loadErr = fmt.Errorf("failed to load openapi spec: %w", loadErr)
+			return
+		}
+		if loadErr = spec.Validate(context.Background()); loadErr != nil {
+			loadErr = fmt.Errorf("invalid openapi spec: %w", loadErr)
+			return
+		}
+		// match on path only, whatever host we are served under
+		spec.Servers = nil
+		router, loadErr = gorillamux.NewRouter(spec)
+		if loadErr != nil {
+			loadErr = fmt.Errorf("failed to build openapi router: %w", loadErr)
+		}
+	})
+}
+
+// Handler serves GET /openapi.json.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(document)
+}
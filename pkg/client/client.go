@@ -0,0 +1,230 @@
+// Package client is a Go SDK for auth-api. It registers users, logs in,
+// keeps the access token fresh and logs out, so services talking to
+// auth-api don't each reimplement those calls.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotLoggedIn is returned by calls that need tokens before Login.
+var ErrNotLoggedIn = errors.New("client: not logged in")
+
+// JWTResponse is the token pair returned by /login and /refresh. It matches
+// auth.JWTResponse on the wire.
+type JWTResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// Error is an RFC 7807 problem returned by the API.
+type Error struct {
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("auth-api: %d %s: %s", e.Status, e.Code, e.Detail)
+}
+
+// Client talks to one auth-api instance on behalf of one user. It is safe
+// for concurrent use.
+type Client struct {
+	// BaseURL is where auth-api is served, e.g. http://auth:8976
+	BaseURL string
+	// HTTPClient makes the requests, http.DefaultClient when nil.
+	HTTPClient *http.Client
+	// Audience is sent as ?audience= on login, "" for the server default.
+	Audience string
+	// RefreshBefore is how long before expiry Token refreshes the access
+	// token.
+	RefreshBefore time.Duration
+
+	mu        sync.Mutex
+	tokens    JWTResponse
+	expiresAt time.Time
+	now       func() time.Time
+}
+
+// New returns a client for the API at baseURL.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:       strings.TrimRight(baseURL, "/"),
+		RefreshBefore: 30 * time.Second,
+	}
+}
+
+// Register creates an account. With REGISTER_CONCEAL_EXISTING on, a taken
+// username isn't reported as an error.
+func (c *Client) Register(ctx context.Context, username, password string) error {
+	body := map[string]string{"username": username, "password": password}
+	return c.do(ctx, http.MethodPost, "/register", "", body, nil)
+}
+
+// Login authenticates and keeps the returned tokens for later calls.
+func (c *Client) Login(ctx context.Context, username, password string) (JWTResponse, error) {
+	path := "/login"
+	if c.Audience != "" {
+		path += "?audience=" + url.QueryEscape(c.Audience)
+	}
+	body := map[string]string{"username": username, "password": password}
+
+	var envelope struct {
+		Auth JWTResponse `json:"auth"`
+	}
+	if err := c.do(ctx, http.MethodPost, path, "", body, &envelope); err != nil {
+		return JWTResponse{}, err
+	}
+	c.store(envelope.Auth)
+	return envelope.Auth, nil
+}
+
+// Refresh trades the stored refresh token for a new token pair. A refresh
+// token works once; the client always keeps the latest.
+func (c *Client) Refresh(ctx context.Context) (JWTResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refreshLocked(ctx)
+}
+
+func (c *Client) refreshLocked(ctx context.Context) (JWTResponse, error) {
+	if c.tokens.RefreshToken == "" {
+		return JWTResponse{}, ErrNotLoggedIn
+	}
+	body := map[string]string{"refresh_token": c.tokens.RefreshToken}
+
+	var envelope struct {
+		Auth JWTResponse `json:"auth"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/refresh", "", body, &envelope); err != nil {
+		return JWTResponse{}, err
+	}
+	c.storeLocked(envelope.Auth)
+	return envelope.Auth, nil
+}
+
+// Logout ends the session on the server and forgets the tokens.
+func (c *Client) Logout(ctx context.Context) error {
+	token, err := c.Token(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.do(ctx, http.MethodPost, "/logout", token, nil, nil)
+	c.store(JWTResponse{})
+	return err
+}
+
+// Token returns a usable access token, refreshing it first when it expires
+// within RefreshBefore.
+func (c *Client) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tokens.AccessToken == "" {
+		return "", ErrNotLoggedIn
+	}
+	if !c.expiresAt.IsZero() && c.clock().Add(c.RefreshBefore).After(c.expiresAt) {
+		if _, err := c.refreshLocked(ctx); err != nil {
+			return "", err
+		}
+	}
+	return c.tokens.AccessToken, nil
+}
+
+// Do sends req with a fresh access token in its Authorization header.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	token, err := c.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return c.httpClient().Do(req)
+}
+
+func (c *Client) store(tokens JWTResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.storeLocked(tokens)
+}
+
+func (c *Client) storeLocked(tokens JWTResponse) {
+	c.tokens = tokens
+	c.expiresAt = time.Time{}
+	if tokens.ExpiresIn > 0 {
+		c.expiresAt = c.clock().Add(time.Duration(tokens.ExpiresIn) * time.Second)
+	}
+}
+
+func (c *Client) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// do sends a JSON request and decodes a JSON reply into out (when non nil).
+// Error statuses come back as *Error.
+func (c *Client) do(ctx context.Context, method, path, token string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("client: failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("client: failed to build request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("client: %s %s: %w", method, path, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		apiErr := &Error{Status: res.StatusCode}
+		// a non problem body still leaves us the status
+		json.NewDecoder(res.Body).Decode(apiErr)
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("client: failed to decode %s response: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"auth-api/auth"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPI is a tiny stand-in for auth-api that hands out numbered tokens.
+type fakeAPI struct {
+	mu        sync.Mutex
+	issued    int
+	refreshes int
+	audience  string
+	logouts   []string
+}
+
+func (f *fakeAPI) tokens() JWTResponse {
+	f.issued++
+	n := strconv.Itoa(f.issued)
+	return JWTResponse{AccessToken: "access-" + n, TokenType: "bearer", ExpiresIn: 900, RefreshToken: "refresh-" + n}
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var body map[string]string
+	json.NewDecoder(r.Body).Decode(&body)
+
+	switch r.URL.Path {
+	case "/register":
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"message": "created"})
+	case "/login":
+		if body["password"] != "right" {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(Error{Status: 401, Code: "invalid_credentials", Detail: "invalid username or password"})
+			return
+		}
+		f.audience = r.URL.Query().Get("audience")
+		json.NewEncoder(w).Encode(map[string]any{"message": "login successful", "auth": f.tokens()})
+	case "/refresh":
+		f.refreshes++
+		json.NewEncoder(w).Encode(map[string]any{"message": "token refreshed", "auth": f.tokens()})
+	case "/logout":
+		f.logouts = append(f.logouts, r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode(map[string]string{"message": "logged out"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestClient(t *testing.T) (*Client, *fakeAPI) {
+	t.Helper()
+	api := &fakeAPI{}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return New(server.URL + "/"), api
+}
+
+// TestLoginAndLogout covers the token lifecycle against the fake API.
+func TestLoginAndLogout(t *testing.T) {
+	c, api := newTestClient(t)
+	c.Audience = "billing"
+	ctx := context.Background()
+
+	if err := c.Register(ctx, "alice", "right"); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if _, err := c.Token(ctx); !errors.Is(err, ErrNotLoggedIn) {
+		t.Fatalf("expected ErrNotLoggedIn before login, got %v", err)
+	}
+
+	tokens, err := c.Login(ctx, "alice", "right")
+	if err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+	if tokens.AccessToken != "access-1" || api.audience != "billing" {
+		t.Fatalf("unexpected login result %+v for audience %q", tokens, api.audience)
+	}
+	if token, _ := c.Token(ctx); token != "access-1" {
+		t.Fatalf("expected the login token, got %q", token)
+	}
+
+	if err := c.Logout(ctx); err != nil {
+		t.Fatalf("Logout returned error: %v", err)
+	}
+	if len(api.logouts) != 1 || api.logouts[0] != "Bearer access-1" {
+		t.Fatalf("unexpected logout calls: %v", api.logouts)
+	}
+	if _, err := c.Token(ctx); !errors.Is(err, ErrNotLoggedIn) {
+		t.Fatalf("expected tokens to be forgotten, got %v", err)
+	}
+}
+
+// TestLoginError checks problem responses come back as *Error.
+func TestLoginError(t *testing.T) {
+	c, _ := newTestClient(t)
+
+	_, err := c.Login(context.Background(), "alice", "wrong")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized || apiErr.Code != "invalid_credentials" {
+		t.Fatalf("expected an invalid_credentials error, got %v", err)
+	}
+}
+
+// TestTokenAutoRefresh checks the access token is refreshed shortly before
+// it expires, and not earlier.
+func TestTokenAutoRefresh(t *testing.T) {
+	c, api := newTestClient(t)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if _, err := c.Login(ctx, "alice", "right"); err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+
+	now = now.Add(10 * time.Minute)
+	if token, _ := c.Token(ctx); token != "access-1" || api.refreshes != 0 {
+		t.Fatalf("expected no refresh yet, got %q after %d refreshes", token, api.refreshes)
+	}
+
+	now = now.Add(4*time.Minute + 45*time.Second)
+	token, err := c.Token(ctx)
+	if err != nil || token != "access-2" || api.refreshes != 1 {
+		t.Fatalf("expected a refreshed token, got %q (%v) after %d refreshes", token, err, api.refreshes)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, c.BaseURL+"/register", nil)
+	if _, err := c.Do(req); err != nil {
+		t.Fatalf("Do returned error: %v", err)
+	}
+}
+
+// TestJWTResponseMatchesServer keeps the SDK's copy of the token pair in
+// step with the one the server encodes.
+func TestJWTResponseMatchesServer(t *testing.T) {
+	tags := func(v any) []string {
+		typ := reflect.TypeOf(v)
+		var out []string
+		for i := range typ.NumField() {
+			out = append(out, typ.Field(i).Tag.Get("json"))
+		}
+		return out
+	}
+	if got, want := tags(JWTResponse{}), tags(auth.JWTResponse{}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("client.JWTResponse fields %v drifted from auth.JWTResponse %v", got, want)
+	}
+}
@@ -0,0 +1,218 @@
+// Package verifier lets other services check auth-api access tokens. It
+// mounts as net/http middleware and answers rejected requests the way
+// auth-api's own CheckJwt does: a 401 problem+json body with a stable code
+// and a Bearer challenge.
+//
+// Verification is stateless: a token whose session was revoked keeps
+// passing here until it expires. Keep access token lifetimes short for
+// audiences where that matters.
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Typed rejections, all wrapping ErrInvalidToken. auth-api's own validator
+// returns the same ones.
+var (
+	ErrInvalidToken      = errors.New("invalid token")
+	ErrTokenExpired      = fmt.Errorf("%w: expired", ErrInvalidToken)
+	ErrTokenNotYetValid  = fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	ErrTokenSignature    = fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	ErrTokenAudience     = fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+	ErrTokenIssuer       = fmt.Errorf("%w: wrong issuer", ErrInvalidToken)
+	ErrTokenMissingClaim = fmt.Errorf("%w: missing claim", ErrInvalidToken)
+	ErrTokenMalformed    = fmt.Errorf("%w: malformed", ErrInvalidToken)
+)
+
+// Claims are the verified claims of a token. Extra holds every claim,
+// including profile ones such as roles or tenant.
+type Claims struct {
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+	Extra map[string]any `json:"-"`
+}
+
+// Options are the checks applied on top of the signature.
+type Options struct {
+	// Issuer and Audience must match iss and aud when set. Set Audience,
+	// otherwise tokens minted for other services pass too.
+	Issuer   string
+	Audience string
+	// Leeway is the clock skew allowed on exp, nbf and iat.
+	Leeway time.Duration
+	// Algorithms overrides the accepted alg values. Defaults to HS256 with
+	// a shared secret and RS256/ES256 with JWKS.
+	Algorithms []string
+}
+
+// Verifier checks tokens against a shared secret or a JWKS document.
+type Verifier struct {
+	opts    Options
+	keyFunc func(ctx context.Context, token *jwt.Token) (any, error)
+}
+
+// NewWithSecret verifies HMAC signed tokens, the way auth-api issues them
+// by default, using the shared signing secret. Anyone holding it can mint
+// tokens too: prefer NewWithJWKS where auth-api signs with a keypair.
+func NewWithSecret(secret []byte, opts Options) *Verifier {
+	if len(opts.Algorithms) == 0 {
+		opts.Algorithms = []string{"HS256"}
+	}
+	return &Verifier{
+		opts: opts,
+		keyFunc: func(context.Context, *jwt.Token) (any, error) {
+			return secret, nil
+		},
+	}
+}
+
+// NewWithJWKS verifies asymmetrically signed tokens with the keys published
+// at jwksURL, auth-api's /.well-known/jwks.json when it runs with
+// TOKEN_SIGNING_KEY_FILE. Keys are cached and refetched, at most once a
+// minute, when a token names an unknown kid.
+func NewWithJWKS(jwksURL string, opts Options) *Verifier {
+	if len(opts.Algorithms) == 0 {
+		opts.Algorithms = []string{"RS256", "ES256"}
+	}
+	keys := &jwks{url: jwksURL, client: http.DefaultClient}
+	return &Verifier{opts: opts, keyFunc: keys.keyFunc}
+}
+
+// Verify checks token and returns its claims.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(v.opts.Algorithms),
+		jwt.WithLeeway(v.opts.Leeway),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+	}
+	if v.opts.Issuer != "" {
+		options = append(options, jwt.WithIssuer(v.opts.Issuer))
+	}
+	if v.opts.Audience != "" {
+		options = append(options, jwt.WithAudience(v.opts.Audience))
+	}
+
+	raw := jwt.MapClaims{}
+	keyFunc := func(t *jwt.Token) (any, error) {
+		return v.keyFunc(ctx, t)
+	}
+	if _, err := jwt.NewParser(options...).ParseWithClaims(token, raw, keyFunc); err != nil {
+		return nil, Classify(err)
+	}
+
+	var claims Claims
+	data, err := json.Marshal(raw)
+	if err == nil {
+		err = json.Unmarshal(data, &claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenMalformed, err)
+	}
+	claims.Extra = raw
+	return &claims, nil
+}
+
+// Classify turns a jwt parse error into one of the typed errors above,
+// keeping the original reachable with errors.Is.
+func Classify(err error) error {
+	var typed error
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		typed = ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		typed = ErrTokenNotYetValid
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		// unverifiable covers a disallowed alg header
+		typed = ErrTokenSignature
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		typed = ErrTokenAudience
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		typed = ErrTokenIssuer
+	case errors.Is(err, jwt.ErrTokenRequiredClaimMissing):
+		typed = ErrTokenMissingClaim
+	default:
+		typed = ErrTokenMalformed
+	}
+	return fmt.Errorf("%w: %w", typed, err)
+}
+
+type claimsCtxKey struct{}
+
+// ClaimsFromContext returns the claims Middleware stored for the request.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsCtxKey{}).(*Claims)
+	return claims, ok
+}
+
+// Middleware rejects requests without a valid Bearer token and passes the
+// rest on with the claims in the context.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			reject(w, "token_missing", "no auth token", "", "")
+			return
+		}
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			reject(w, "token_malformed", "corrupt token format", "invalid_request", "expected a Bearer token")
+			return
+		}
+
+		claims, err := v.Verify(r.Context(), token)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrTokenExpired):
+				reject(w, "token_expired", "token expired", "invalid_token", "the access token expired")
+			case errors.Is(err, ErrTokenNotYetValid):
+				reject(w, "token_not_yet_valid", "token not valid yet", "invalid_token", "the access token is not valid yet")
+			case errors.Is(err, ErrTokenSignature):
+				reject(w, "token_bad_signature", "token signature invalid", "invalid_token", "the access token signature is invalid")
+			case errors.Is(err, ErrTokenAudience):
+				reject(w, "token_wrong_audience", "token not issued for this service", "invalid_token", "the access token is for another audience")
+			default:
+				reject(w, "token_invalid", "error validating token", "invalid_token", "the access token is invalid")
+			}
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsCtxKey{}, claims)))
+	})
+}
+
+// BearerChallenge builds an RFC 6750 WWW-Authenticate value. errCode is one of
+// invalid_request, invalid_token, insufficient_scope, or "" when the client
+// sent no credentials at all.
+func BearerChallenge(errCode, description string) string {
+	challenge := `Bearer realm="auth-api"`
+	if errCode != "" {
+		challenge += `, error="` + errCode + `"`
+	}
+	if description != "" {
+		challenge += `, error_description="` + description + `"`
+	}
+	return challenge
+}
+
+// reject writes a 401 problem body like auth-api's, see handlers/problem.go.
+func reject(w http.ResponseWriter, code, detail, challengeErr, challengeDesc string) {
+	w.Header().Set("WWW-Authenticate", BearerChallenge(challengeErr, challengeDesc))
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]any{
+		"type":   "urn:auth-api:problem:" + code,
+		"title":  http.StatusText(http.StatusUnauthorized),
+		"status": http.StatusUnauthorized,
+		"detail": detail,
+		"code":   code,
+	})
+}
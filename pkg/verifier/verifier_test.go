@@ -0,0 +1,239 @@
+package verifier
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func claimsFor(audience string, exp time.Time) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": "auth", "sub": "alice", "aud": audience, "sid": "s1", "roles": []string{"reader"},
+		"iat": time.Now().Unix(), "exp": exp.Unix(),
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+// TestVerifyWithSecret covers the shared secret mode and the typed errors.
+func TestVerifyWithSecret(t *testing.T) {
+	secret := []byte("secret")
+	v := NewWithSecret(secret, Options{Issuer: "auth", Audience: "billing"})
+	hour := time.Now().Add(time.Hour)
+
+	claims, err := v.Verify(context.Background(), sign(t, jwt.SigningMethodHS256, "", secret, claimsFor("billing", hour)))
+	if err != nil {
+		t.Fatalf("expected a valid token, got %v", err)
+	}
+	if claims.Subject != "alice" || claims.SessionID != "s1" || claims.Extra["roles"] == nil {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+
+	cases := map[string]struct {
+		token string
+		want  error
+	}{
+		"expired":       {sign(t, jwt.SigningMethodHS256, "", secret, claimsFor("billing", time.Now().Add(-time.Hour))), ErrTokenExpired},
+		"audience":      {sign(t, jwt.SigningMethodHS256, "", secret, claimsFor("auth-api", hour)), ErrTokenAudience},
+		"bad signature": {sign(t, jwt.SigningMethodHS256, "", []byte("other"), claimsFor("billing", hour)), ErrTokenSignature},
+		"wrong alg":     {sign(t, jwt.SigningMethodHS384, "", secret, claimsFor("billing", hour)), ErrTokenSignature},
+		"garbage":       {"nope", ErrTokenMalformed},
+	}
+	for name, tc := range cases {
+		if _, err := v.Verify(context.Background(), tc.token); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", name, tc.want, err)
+		}
+	}
+}
+
+func b64(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(key.X), "y": b64(key.Y)}
+}
+
+// TestVerifyWithJWKS checks RSA and EC keys are picked from the key set by
+// kid, and that the set is only fetched again for an unknown kid.
+func TestVerifyWithJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ec key: %v", err)
+	}
+
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": b64(rsaKey.N), "e": b64(big.NewInt(int64(rsaKey.E)))},
+			ecJWK("ec-1", ecKey),
+			{"kty": "oct", "kid": "ignored"},
+		}})
+	}))
+	t.Cleanup(server.Close)
+
+	v := NewWithJWKS(server.URL, Options{Audience: "billing"})
+	hour := time.Now().Add(time.Hour)
+
+	if _, err := v.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claimsFor("billing", hour))); err != nil {
+		t.Fatalf("expected the RSA token to verify, got %v", err)
+	}
+	if _, err := v.Verify(context.Background(), sign(t, jwt.SigningMethodES256, "ec-1", ecKey, claimsFor("billing", hour))); err != nil {
+		t.Fatalf("expected the EC token to verify, got %v", err)
+	}
+	if _, err := v.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "rsa-2", rsaKey, claimsFor("billing", hour))); !errors.Is(err, ErrTokenSignature) {
+		t.Fatalf("expected an unknown kid to be rejected, got %v", err)
+	}
+	// a shared secret token must not pass as one of the public keys
+	if _, err := v.Verify(context.Background(), sign(t, jwt.SigningMethodHS256, "rsa-1", []byte("secret"), claimsFor("billing", hour))); !errors.Is(err, ErrTokenSignature) {
+		t.Fatalf("expected HS256 to be refused in JWKS mode, got %v", err)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected the key set to be fetched once, got %d", n)
+	}
+}
+
+// TestJWKSFetchDoesNotBlock checks a slow refetch for a new kid holds up
+// neither tokens with known kids nor a second miss, which waits for the same
+// fetch instead of starting its own.
+func TestJWKSFetchDoesNotBlock(t *testing.T) {
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ec key: %v", err)
+	}
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ec key: %v", err)
+	}
+
+	var fetches atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := []map[string]string{ecJWK("old", oldKey)}
+		if fetches.Add(1) > 1 {
+			close(started)
+			<-release
+			keys = append(keys, ecJWK("new", newKey))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	t.Cleanup(server.Close)
+
+	keys := &jwks{url: server.URL, client: http.DefaultClient}
+	v := &Verifier{opts: Options{Algorithms: []string{"ES256"}}, keyFunc: keys.keyFunc}
+	hour := time.Now().Add(time.Hour)
+	oldToken := sign(t, jwt.SigningMethodES256, "old", oldKey, claimsFor("billing", hour))
+	newToken := sign(t, jwt.SigningMethodES256, "new", newKey, claimsFor("billing", hour))
+
+	if _, err := v.Verify(context.Background(), oldToken); err != nil {
+		t.Fatalf("expected the old key to verify, got %v", err)
+	}
+	keys.mu.Lock()
+	keys.fetchedAt = time.Time{}
+	keys.mu.Unlock()
+
+	results := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := v.Verify(context.Background(), newToken)
+			results <- err
+		}()
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := v.Verify(ctx, oldToken); err != nil {
+		t.Fatalf("expected a known kid to verify during the fetch, got %v", err)
+	}
+
+	close(release)
+	for range 2 {
+		if err := <-results; err != nil {
+			t.Fatalf("expected the new key to verify after the fetch, got %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("expected one refetch for both misses, got %d fetches", n-1)
+	}
+}
+
+// TestMiddleware checks rejections look like auth-api's and the claims reach
+// the wrapped handler.
+func TestMiddleware(t *testing.T) {
+	secret := []byte("secret")
+	v := NewWithSecret(secret, Options{Audience: "billing"})
+	handler := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFromContext(r.Context())
+		if !ok {
+			t.Fatalf("expected claims in the context")
+		}
+		w.Write([]byte(claims.Subject))
+	}))
+
+	cases := map[string]struct {
+		header string
+		status int
+		code   string
+	}{
+		"ok":         {"Bearer " + sign(t, jwt.SigningMethodHS256, "", secret, claimsFor("billing", time.Now().Add(time.Hour))), http.StatusOK, ""},
+		"missing":    {"", http.StatusUnauthorized, "token_missing"},
+		"not bearer": {"Basic abc", http.StatusUnauthorized, "token_malformed"},
+		"expired":    {"Bearer " + sign(t, jwt.SigningMethodHS256, "", secret, claimsFor("billing", time.Now().Add(-time.Hour))), http.StatusUnauthorized, "token_expired"},
+	}
+	for name, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tc.status {
+			t.Fatalf("%s: expected %d, got %d", name, tc.status, rr.Code)
+		}
+		if tc.code == "" {
+			if rr.Body.String() != "alice" {
+				t.Fatalf("%s: unexpected body %q", name, rr.Body.String())
+			}
+			continue
+		}
+		if !strings.HasPrefix(rr.Header().Get("WWW-Authenticate"), "Bearer ") {
+			t.Fatalf("%s: expected a Bearer challenge", name)
+		}
+		var problem map[string]any
+		if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil || problem["code"] != tc.code {
+			t.Fatalf("%s: expected code %s, got %v (%v)", name, tc.code, problem, err)
+		}
+	}
+}
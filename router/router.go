@@ -0,0 +1,136 @@
+// Package router wraps http.ServeMux method+pattern routing (Go 1.22) with
+// route groups, middleware chains and problem+json 404/405 answers.
+package router
+
+import (
+	"auth-api/handlers"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Middleware wraps a handler. Every middleware in auth-api/middleware fits.
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// Chain composes middlewares into one. The first one is the outermost, so
+// Chain(a, b)(h) is a(b(h)).
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// Route is a registered method and path.
+type Route struct {
+	Method string
+	Path   string
+}
+
+// table is shared by a router and all its groups.
+type table struct {
+	mux     *http.ServeMux
+	routes  []Route
+	methods []string
+}
+
+// Router registers routes on an http.ServeMux. Groups share the mux and
+// add a path prefix and middlewares of their own.
+type Router struct {
+	table      *table
+	prefix     string
+	middleware []Middleware
+}
+
+// New returns an empty router.
+func New() *Router {
+	return &Router{table: &table{mux: http.NewServeMux()}}
+}
+
+// Use appends middlewares to the routes registered on r from now on.
+func (r *Router) Use(middlewares ...Middleware) {
+	r.middleware = append(r.middleware, middlewares...)
+}
+
+// Group returns a router registering under prefix, with r's middlewares
+// followed by middlewares.
+func (r *Router) Group(prefix string, middlewares ...Middleware) *Router {
+	return &Router{
+		table:      r.table,
+		prefix:     r.prefix + prefix,
+		middleware: append(slices.Clone(r.middleware), middlewares...),
+	}
+}
+
+// Handle registers h for pattern, "METHOD /path" as for http.ServeMux. A
+// method is required; the path may use {wildcards}.
+func (r *Router) Handle(pattern string, h http.Handler, middlewares ...Middleware) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok || method == "" || !strings.HasPrefix(path, "/") {
+		panic("router: pattern must be \"METHOD /path\", got " + pattern)
+	}
+	path = r.prefix + path
+
+	chain := Chain(append(slices.Clone(r.middleware), middlewares...)...)
+	r.table.mux.Handle(method+" "+path, chain(h.ServeHTTP))
+	r.table.routes = append(r.table.routes, Route{Method: method, Path: path})
+	if !slices.Contains(r.table.methods, method) {
+		r.table.methods = append(r.table.methods, method)
+		slices.Sort(r.table.methods)
+	}
+}
+
+// HandleFunc is Handle for plain functions.
+func (r *Router) HandleFunc(pattern string, h http.HandlerFunc, middlewares ...Middleware) {
+	r.Handle(pattern, h, middlewares...)
+}
+
+// Routes lists everything registered, in registration order.
+func (r *Router) Routes() []Route {
+	return slices.Clone(r.table.routes)
+}
+
+// ServeHTTP dispatches req. Paths with no route get 404, paths routed for
+// other methods get 405 with an Allow header, both as problem+json.
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if _, pattern := r.table.mux.Handler(req); pattern != "" {
+		r.table.mux.ServeHTTP(w, req)
+		return
+	}
+
+	allowed := r.allowed(req)
+	if len(allowed) == 0 {
+		handlers.WriteResponse(w, &handlers.Response{
+			Status:  http.StatusNotFound,
+			Code:    handlers.CodeNotFound,
+			Message: "no such route",
+		})
+		return
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	handlers.WriteResponse(w, &handlers.Response{
+		Status:  http.StatusMethodNotAllowed,
+		Code:    handlers.CodeMethodNotAllowed,
+		Message: req.Method + " not allowed here",
+	})
+}
+
+// allowed lists the methods req's path is routed for.
+func (r *Router) allowed(req *http.Request) []string {
+	var allowed []string
+	probe := req.Clone(req.Context())
+	for _, method := range r.table.methods {
+		probe.Method = method
+		if _, pattern := r.table.mux.Handler(probe); pattern != "" {
+			allowed = append(allowed, method)
+			// ServeMux answers HEAD with the GET route
+			if method == http.MethodGet && !slices.Contains(r.table.methods, http.MethodHead) {
+				allowed = append(allowed, http.MethodHead)
+			}
+		}
+	}
+	slices.Sort(allowed)
+	return allowed
+}
@@ -0,0 +1,110 @@
+package router
+
+import (
+	"auth-api/handlers"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tag returns a middleware that appends name to the X-Trail header.
+func tag(name string) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Trail", name)
+			next(w, r)
+		}
+	}
+}
+
+// TestChain checks the first middleware runs outermost.
+func TestChain(t *testing.T) {
+	h := Chain(tag("a"), tag("b"), tag("c"))(func(w http.ResponseWriter, r *http.Request) {})
+	rr := httptest.NewRecorder()
+	h(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := strings.Join(rr.Header().Values("X-Trail"), ","); got != "a,b,c" {
+		t.Fatalf("expected a,b,c, got %s", got)
+	}
+}
+
+// TestGroups checks prefixes and middlewares stack through nested groups
+// without leaking into their parents.
+func TestGroups(t *testing.T) {
+	r := New()
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Pattern + " " + r.PathValue("name")))
+	}
+	api := r.Group("", tag("api"))
+	api.HandleFunc("GET /login", ok)
+	admin := api.Group("/admin", tag("admin"))
+	admin.HandleFunc("GET /users/{name}", ok, tag("route"))
+
+	cases := map[string]struct {
+		target, trail, body string
+	}{
+		"group":  {"/login", "api", "GET /login "},
+		"nested": {"/admin/users/bob", "api,admin,route", "GET /admin/users/{name} bob"},
+	}
+	for name, tc := range cases {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if got := strings.Join(rr.Header().Values("X-Trail"), ","); got != tc.trail || rr.Body.String() != tc.body {
+			t.Fatalf("%s: got trail %q body %q", name, got, rr.Body.String())
+		}
+	}
+
+	want := []Route{{"GET", "/login"}, {"GET", "/admin/users/{name}"}}
+	if got := r.Routes(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("unexpected routes: %v", got)
+	}
+}
+
+// TestMethodNotAllowed checks a known path with the wrong method gets a 405
+// problem with the Allow header, and an unknown path a 404 problem.
+func TestMethodNotAllowed(t *testing.T) {
+	r := New()
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	r.HandleFunc("POST /login", noop)
+	r.HandleFunc("GET /sessions", noop)
+	r.HandleFunc("DELETE /sessions/{id}", noop)
+
+	cases := map[string]struct {
+		method, target string
+		status         int
+		allow, code    string
+	}{
+		"login via GET":     {http.MethodGet, "/login", http.StatusMethodNotAllowed, "POST", handlers.CodeMethodNotAllowed},
+		"sessions via POST": {http.MethodPost, "/sessions", http.StatusMethodNotAllowed, "GET, HEAD", handlers.CodeMethodNotAllowed},
+		"session via GET":   {http.MethodGet, "/sessions/abc", http.StatusMethodNotAllowed, "DELETE", handlers.CodeMethodNotAllowed},
+		"unknown":           {http.MethodGet, "/nowhere", http.StatusNotFound, "", handlers.CodeNotFound},
+		"routed":            {http.MethodPost, "/login", http.StatusOK, "", ""},
+	}
+	for name, tc := range cases {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(tc.method, tc.target, nil))
+
+		if rr.Code != tc.status || rr.Header().Get("Allow") != tc.allow {
+			t.Fatalf("%s: expected %d with Allow %q, got %d with %q", name, tc.status, tc.allow, rr.Code, rr.Header().Get("Allow"))
+		}
+		if tc.code == "" {
+			continue
+		}
+		var problem handlers.Problem
+		if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil || problem.Code != tc.code {
+			t.Fatalf("%s: expected code %s, got %+v (%v)", name, tc.code, problem, err)
+		}
+	}
+}
+
+// TestHandleRequiresMethod checks patterns without a method are refused.
+func TestHandleRequiresMethod(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected a panic for a pattern without a method")
+		}
+	}()
+	New().HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {})
+}
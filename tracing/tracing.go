@@ -0,0 +1,125 @@
+package tracing
+
+/*
+	- opentelemetry setup: exporter selection, tracer provider, W3C propagation
+	- Tracer is what handlers, auth and db use to open their spans
+*/
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is reported as service.name on every span.
+const ServiceName = "auth-api"
+
+// Tracer opens spans for this service. Until Setup runs it is backed by the
+// global no-op provider, so instrumented code is safe to call in tests.
+var Tracer = otel.Tracer(ServiceName)
+
+// Exporter names accepted by Setup.
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// Setup installs the global tracer provider and the W3C traceparent/baggage
+// propagators. exporter picks where spans go; for "otlp" the endpoint comes
+// from the standard OTEL_EXPORTER_OTLP_* variables, for "file" spans are
+// appended to filePath. The returned func flushes and closes everything.
+func Setup(ctx context.Context, exporter, filePath string) (func(context.Context) error, error) {
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	var (
+		spanExporter sdktrace.SpanExporter
+		closer       io.Closer
+		err          error
+	)
+	switch exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		spanExporter, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case ExporterFile:
+		var f *os.File
+		f, err = os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		closer = f
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(newResource()),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// StartDBSpan opens a client span for a single SQL statement.
+func StartDBSpan(ctx context.Context, name, statement string) (context.Context, trace.Span) {
+	return Tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.statement", statement),
+		),
+	)
+}
+
+// End records err on span (if any) and ends it. Meant for
+// `defer func() { tracing.End(span, err) }()` with a named error result.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// newResource describes this process to the tracing backend. OTEL_SERVICE_NAME
+// and OTEL_RESOURCE_ATTRIBUTES from the environment take precedence.
+func newResource() *resource.Resource {
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName(ServiceName)),
+		resource.Environment(),
+	)
+	if err != nil {
+		return resource.Default()
+	}
+	return res
+}
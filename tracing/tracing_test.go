@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TestSetupRejectsUnknownExporter ensures typos in TRACE_EXPORTER fail loudly.
+func TestSetupRejectsUnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), "jaeger-ish", ""); err == nil {
+		t.Fatalf("expected unknown exporter to be rejected")
+	}
+}
+
+// TestSetupFileExporter checks spans written through the file exporter end up
+// in the file once the shutdown func flushes them.
+func TestSetupFileExporter(t *testing.T) {
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+
+	shutdown, err := Setup(context.Background(), ExporterFile, path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, span := StartDBSpan(context.Background(), "db.Test", "SELECT 1")
+	End(span, errors.New("boom"))
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected shutdown error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read trace file: %v", err)
+	}
+	for _, want := range []string{"db.Test", "SELECT 1", "boom"} {
+		if !strings.Contains(string(data), want) {
+			t.Fatalf("expected %q in trace output, got %s", want, data)
+		}
+	}
+}